@@ -0,0 +1,134 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// anomalyConfig configures the checks which compare a new snapshot with the
+// previous one to catch mass deletions. A zero value disables a check.
+type anomalyConfig struct {
+	CardDrop     int  `json:"card_drop"`    // minimum percentage of open cards removed
+	Lists        bool `json:"lists"`        // any open list removed
+	Descriptions int  `json:"descriptions"` // minimum number of card descriptions wiped (or the board's)
+	Members      bool `json:"members"`      // any member removed
+}
+
+// defaultAnomalyConfig is used for the checks which haven't been configured
+// for the backup directory. The list and member checks are off by default,
+// since lists and members are routinely removed on active boards.
+var defaultAnomalyConfig = anomalyConfig{
+	CardDrop:     50,
+	Descriptions: 5,
+}
+
+// Register adds the flags to fs, with the defaults from defaultAnomalyConfig.
+func (a *anomalyConfig) Register(fs *flag.FlagSet) {
+	fs.IntVar(&a.CardDrop, "alert-card-drop", defaultAnomalyConfig.CardDrop, "alert if this percentage of a board's open cards are removed (0 to disable)")
+	fs.BoolVar(&a.Lists, "alert-lists", defaultAnomalyConfig.Lists, "alert if any open lists are removed")
+	fs.IntVar(&a.Descriptions, "alert-descriptions", defaultAnomalyConfig.Descriptions, "alert if this many card descriptions (or the board's) are wiped (0 to disable)")
+	fs.BoolVar(&a.Members, "alert-members", defaultAnomalyConfig.Members, "alert if any members are removed")
+}
+
+// Merge updates cfg with the values of the flags which were set on fs. It
+// returns true if anything was set.
+func (a *anomalyConfig) Merge(fs *flag.FlagSet, cfg *anomalyConfig) bool {
+	var changed bool
+	fs.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "alert-card-drop":
+			cfg.CardDrop = a.CardDrop
+		case "alert-lists":
+			cfg.Lists = a.Lists
+		case "alert-descriptions":
+			cfg.Descriptions = a.Descriptions
+		case "alert-members":
+			cfg.Members = a.Members
+		default:
+			return
+		}
+		changed = true
+	})
+	return changed
+}
+
+// boardStats are the parts of a board export compared by the anomaly checks.
+type boardStats struct {
+	OpenCards int
+	Cards     map[string]bool   // IDs of all cards, including archived ones
+	Lists     map[string]string // open list ID to name
+	Descs     map[string]string // card ID to name, for cards with a description
+	Desc      bool              // if the board has a description
+	Members   map[string]string // member ID to username
+}
+
+// checkAnomalies compares cur with the previous snapshot of the board, and
+// returns a description of each check which failed.
+func checkAnomalies(cfg anomalyConfig, prev, cur boardStats) []string {
+	var as []string
+
+	if cfg.CardDrop > 0 && prev.OpenCards > 0 && cur.OpenCards < prev.OpenCards {
+		if pct := (prev.OpenCards - cur.OpenCards) * 100 / prev.OpenCards; pct >= cfg.CardDrop {
+			as = append(as, fmt.Sprintf("open cards dropped by %d%% from %d to %d", pct, prev.OpenCards, cur.OpenCards))
+		}
+	}
+
+	if cfg.Lists {
+		if ns := removedNames(prev.Lists, cur.Lists); len(ns) != 0 {
+			as = append(as, fmt.Sprintf("%d lists were removed or archived: %s", len(ns), strings.Join(ns, ", ")))
+		}
+	}
+
+	if cfg.Descriptions > 0 {
+		if prev.Desc && !cur.Desc {
+			as = append(as, "the board description was wiped")
+		}
+		wiped := map[string]string{}
+		for id, name := range prev.Descs {
+			if _, ok := cur.Descs[id]; !ok && cur.Cards[id] {
+				wiped[id] = name // removed cards are covered by the card count
+			}
+		}
+		if len(wiped) >= cfg.Descriptions {
+			as = append(as, fmt.Sprintf("%d card descriptions were wiped: %s", len(wiped), strings.Join(sortedNames(wiped), ", ")))
+		}
+	}
+
+	if cfg.Members {
+		if ns := removedNames(prev.Members, cur.Members); len(ns) != 0 {
+			as = append(as, fmt.Sprintf("%d members were removed: %s", len(ns), strings.Join(ns, ", ")))
+		}
+	}
+
+	return as
+}
+
+// removedNames returns the sorted names of the items in prev which aren't in
+// cur.
+func removedNames(prev, cur map[string]string) []string {
+	m := map[string]string{}
+	for id, name := range prev {
+		if _, ok := cur[id]; !ok {
+			m[id] = name
+		}
+	}
+	return sortedNames(m)
+}
+
+// sortedNames returns the sorted values of m, shortened to the first 10.
+func sortedNames(m map[string]string) []string {
+	ns := make([]string, 0, len(m))
+	for id, name := range m {
+		if name == "" {
+			name = id
+		}
+		ns = append(ns, fmt.Sprintf("%q", name))
+	}
+	sort.Strings(ns)
+	if len(ns) > 10 {
+		ns = append(ns[:10], fmt.Sprintf("and %d more", len(ns)-10))
+	}
+	return ns
+}
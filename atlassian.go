@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/xlzd/gotp"
+)
+
+// atlassianAuth logs in using the credentials for an Atlassian account. It
+// follows the same sequence as a browser: the id.atlassian.com login form,
+// the second step if two-step verification is enabled, the consent page if
+// Trello hasn't been authorized yet, then the callback which creates the
+// Trello session.
+type atlassianAuth struct {
+	Username, Password, TOTPSecret string
+
+	// TrelloURL and IDURL override the base URLs for Trello and
+	// id.atlassian.com (for testing against a fake flow).
+	TrelloURL, IDURL string
+}
+
+var atlassianCSRFRe = regexp.MustCompile(`"csrfToken"\s*:\s*"([^"]+)"`)
+
+// atlassianResponse is the response from the id.atlassian.com REST API.
+type atlassianResponse struct {
+	RedirectURI string `json:"redirect_uri"`
+	Step        string `json:"step"`
+	Token       string `json:"token"`
+	Error       string `json:"error"`
+	ErrorCode   string `json:"errorCode"`
+}
+
+func (a *atlassianAuth) Login(c *http.Client, w io.Writer) error {
+	trello, id := a.TrelloURL, a.IDURL
+	if trello == "" {
+		trello = "https://trello.com"
+	}
+	if id == "" {
+		id = "https://id.atlassian.com"
+	}
+
+	fmt.Fprintln(w, "Logging in with Atlassian account")
+
+	fmt.Fprintln(w, "Getting login page")
+	csrf, err := a.getLoginPage(c, id, trello)
+	if err != nil {
+		return fmt.Errorf("could not get login page: %w", err)
+	}
+
+	fmt.Fprintln(w, "Authenticating")
+	res, err := a.post(c, id+"/rest/authenticate", csrf, map[string]interface{}{
+		"username": a.Username,
+		"password": a.Password,
+		"state":    map[string]string{"csrfToken": csrf},
+	})
+	if err != nil {
+		return fmt.Errorf("could not authenticate: %w", err)
+	}
+
+	if res.Step == "2sv" || res.Step == "mfa" {
+		if a.TOTPSecret == "" {
+			return errors.New("could not authenticate: second factor required")
+		}
+		fmt.Fprintln(w, "Verifying second factor")
+		if res, err = a.post(c, id+"/rest/mfa/verify", csrf, map[string]interface{}{
+			"otpCode": gotp.NewDefaultTOTP(a.TOTPSecret).Now(),
+			"token":   res.Token,
+			"state":   map[string]string{"csrfToken": csrf},
+		}); err != nil {
+			return fmt.Errorf("could not verify second factor: %w", err)
+		}
+	}
+	if res.RedirectURI == "" {
+		return fmt.Errorf("could not authenticate: unexpected step %q (trellobackup may need to be updated)", res.Step)
+	}
+
+	fmt.Fprintln(w, "Creating Trello session")
+	if err := a.callback(c, w, id, res.RedirectURI); err != nil {
+		return fmt.Errorf("could not create session: %w", err)
+	}
+
+	u, err := url.Parse(trello)
+	if err != nil {
+		return err
+	}
+	for _, ck := range c.Jar.Cookies(u) {
+		if ck.Name == "token" {
+			return nil
+		}
+	}
+	return errors.New("could not create session: no token cookie (trellobackup may need to be updated)")
+}
+
+func (a *atlassianAuth) Renewable() bool {
+	return true
+}
+
+// getLoginPage gets the login page and returns the CSRF token from it.
+func (a *atlassianAuth) getLoginPage(c *http.Client, id, trello string) (string, error) {
+	resp, err := c.Get(id + "/login?" + url.Values{
+		"application": {"trello"},
+		"continue":    {trello + "/auth/atlassian/callback"},
+	}.Encode())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("response status %s", resp.Status)
+	}
+
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", fmt.Errorf("could not read response body: %w", err)
+	}
+
+	m := atlassianCSRFRe.FindSubmatch(buf)
+	if m == nil {
+		return "", errors.New("could not find csrf token (trellobackup may need to be updated)")
+	}
+	return string(m[1]), nil
+}
+
+// post sends a request to the id.atlassian.com REST API.
+func (a *atlassianAuth) post(c *http.Client, u, csrf string, obj interface{}) (*atlassianResponse, error) {
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, u, bytes.NewReader(buf))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("X-Csrf-Token", csrf)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send request (trellobackup may need to be updated): %w", err)
+	}
+	defer resp.Body.Close()
+
+	var res atlassianResponse
+	if err := json.NewDecoder(resp.Body).Decode(&res); err != nil {
+		return nil, fmt.Errorf("decode json (response status %s): %w", resp.Status, err)
+	}
+	if res.Error != "" || res.ErrorCode != "" {
+		return nil, fmt.Errorf("api error: %s", strings.TrimSpace(res.ErrorCode+" "+res.Error))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status %s", resp.Status)
+	}
+	return &res, nil
+}
+
+// callback follows the redirect from the login, accepting the consent page if
+// it is shown.
+func (a *atlassianAuth) callback(c *http.Client, w io.Writer, id, redirect string) error {
+	resp, err := c.Get(redirect)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+
+	if !strings.HasSuffix(resp.Request.URL.Path, "/consent") {
+		return nil
+	}
+
+	fmt.Fprintln(w, "Accepting consent")
+	buf, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("could not read response body: %w", err)
+	}
+
+	m := atlassianCSRFRe.FindSubmatch(buf)
+	if m == nil {
+		return errors.New("could not find consent csrf token (trellobackup may need to be updated)")
+	}
+
+	res, err := a.post(c, id+"/rest/consent", string(m[1]), map[string]interface{}{
+		"consented": true,
+		"state":     map[string]string{"csrfToken": string(m[1])},
+		"continue":  resp.Request.URL.Query().Get("continue"),
+	})
+	if err != nil {
+		return fmt.Errorf("could not accept consent: %w", err)
+	}
+	if res.RedirectURI == "" {
+		return errors.New("could not accept consent: no redirect")
+	}
+
+	cresp, err := c.Get(res.RedirectURI)
+	if err != nil {
+		return err
+	}
+	cresp.Body.Close()
+
+	if cresp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response status %s", cresp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xlzd/gotp"
+)
+
+// fakeAtlassian is a fake Trello and id.atlassian.com for testing the
+// Atlassian login flow.
+type fakeAtlassian struct {
+	Username, Password, TOTPSecret string
+	Consent                        bool // whether the consent page is shown
+
+	trello, id *httptest.Server
+	consented  bool
+	steps      []string
+}
+
+func newFakeAtlassian(t *testing.T, f *fakeAtlassian) *fakeAtlassian {
+	trello := http.NewServeMux()
+	trello.HandleFunc("/auth/atlassian/callback", func(w http.ResponseWriter, r *http.Request) {
+		f.steps = append(f.steps, "callback")
+		if r.URL.Query().Get("code") != "code" {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		if f.Consent && !f.consented {
+			http.Redirect(w, r, f.id.URL+"/consent?"+url.Values{"continue": {f.trello.URL + r.URL.RequestURI()}}.Encode(), http.StatusFound)
+			return
+		}
+		http.SetCookie(w, &http.Cookie{Name: "token", Value: "session", Path: "/"})
+		w.Write([]byte("ok"))
+	})
+
+	id := http.NewServeMux()
+	id.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
+		f.steps = append(f.steps, "login")
+		if q := r.URL.Query(); q.Get("application") != "trello" || q.Get("continue") != f.trello.URL+"/auth/atlassian/callback" {
+			t.Errorf("unexpected login query %s", r.URL.RawQuery)
+		}
+		fmt.Fprint(w, `<script>window.__INITIAL_STATE__ = {"csrfToken": "csrf1"};</script>`)
+	})
+	id.HandleFunc("/rest/authenticate", func(w http.ResponseWriter, r *http.Request) {
+		f.steps = append(f.steps, "authenticate")
+		var req struct {
+			Username, Password string
+			State              struct{ CSRFToken string }
+		}
+		if !f.decode(t, w, r, "csrf1", &req) {
+			return
+		}
+		if req.State.CSRFToken != "csrf1" {
+			t.Errorf("expected csrf token in state")
+		}
+		if req.Username != f.Username || req.Password != f.Password {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(atlassianResponse{ErrorCode: "AUTHENTICATION_FAILED"})
+			return
+		}
+		if f.TOTPSecret != "" {
+			json.NewEncoder(w).Encode(atlassianResponse{Step: "2sv", Token: "mfa"})
+			return
+		}
+		json.NewEncoder(w).Encode(atlassianResponse{RedirectURI: f.trello.URL + "/auth/atlassian/callback?code=code"})
+	})
+	id.HandleFunc("/rest/mfa/verify", func(w http.ResponseWriter, r *http.Request) {
+		f.steps = append(f.steps, "mfa")
+		var req struct {
+			OTPCode, Token string
+		}
+		if !f.decode(t, w, r, "csrf1", &req) {
+			return
+		}
+		totp, now := gotp.NewDefaultTOTP(f.TOTPSecret), int(time.Now().Unix())
+		if req.Token != "mfa" || (req.OTPCode != totp.At(now) && req.OTPCode != totp.At(now-30)) {
+			w.WriteHeader(http.StatusForbidden)
+			json.NewEncoder(w).Encode(atlassianResponse{ErrorCode: "INVALID_OTP"})
+			return
+		}
+		json.NewEncoder(w).Encode(atlassianResponse{RedirectURI: f.trello.URL + "/auth/atlassian/callback?code=code"})
+	})
+	id.HandleFunc("/consent", func(w http.ResponseWriter, r *http.Request) {
+		f.steps = append(f.steps, "consent")
+		fmt.Fprint(w, `<script>window.__INITIAL_STATE__ = {"csrfToken": "csrf2"};</script>`)
+	})
+	id.HandleFunc("/rest/consent", func(w http.ResponseWriter, r *http.Request) {
+		f.steps = append(f.steps, "accept")
+		var req struct {
+			Consented bool
+			Continue  string
+		}
+		if !f.decode(t, w, r, "csrf2", &req) {
+			return
+		}
+		if !req.Consented || !strings.HasPrefix(req.Continue, f.trello.URL+"/auth/atlassian/callback") {
+			t.Errorf("unexpected consent request %+v", req)
+		}
+		f.consented = true
+		json.NewEncoder(w).Encode(atlassianResponse{RedirectURI: req.Continue})
+	})
+
+	f.trello, f.id = httptest.NewServer(trello), httptest.NewServer(id)
+	return f
+}
+
+func (f *fakeAtlassian) decode(t *testing.T, w http.ResponseWriter, r *http.Request, csrf string, v interface{}) bool {
+	if r.Method != http.MethodPost || r.Header.Get("Content-Type") != "application/json" {
+		t.Errorf("%s: unexpected %s request", r.URL.Path, r.Method)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return false
+	}
+	if r.Header.Get("X-Csrf-Token") != csrf {
+		t.Errorf("%s: expected csrf token %q, got %q", r.URL.Path, csrf, r.Header.Get("X-Csrf-Token"))
+		http.Error(w, "Forbidden", http.StatusForbidden)
+		return false
+	}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		t.Errorf("%s: decode: %v", r.URL.Path, err)
+		http.Error(w, "Bad Request", http.StatusBadRequest)
+		return false
+	}
+	return true
+}
+
+func (f *fakeAtlassian) Close() {
+	f.trello.Close()
+	f.id.Close()
+}
+
+func TestAtlassianAuth(t *testing.T) {
+	const secret = "JBSWY3DPEHPK3PXP"
+	for _, c := range []struct {
+		Name  string
+		Fake  fakeAtlassian
+		Auth  atlassianAuth
+		Err   string
+		Steps string
+	}{
+		{
+			Name:  "Password",
+			Fake:  fakeAtlassian{Username: "user", Password: "pass"},
+			Auth:  atlassianAuth{Username: "user", Password: "pass"},
+			Steps: "login authenticate callback",
+		},
+		{
+			Name:  "WrongPassword",
+			Fake:  fakeAtlassian{Username: "user", Password: "pass"},
+			Auth:  atlassianAuth{Username: "user", Password: "wrong"},
+			Err:   "AUTHENTICATION_FAILED",
+			Steps: "login authenticate",
+		},
+		{
+			Name:  "TOTP",
+			Fake:  fakeAtlassian{Username: "user", Password: "pass", TOTPSecret: secret},
+			Auth:  atlassianAuth{Username: "user", Password: "pass", TOTPSecret: secret},
+			Steps: "login authenticate mfa callback",
+		},
+		{
+			Name:  "TOTPMissing",
+			Fake:  fakeAtlassian{Username: "user", Password: "pass", TOTPSecret: secret},
+			Auth:  atlassianAuth{Username: "user", Password: "pass"},
+			Err:   "second factor required",
+			Steps: "login authenticate",
+		},
+		{
+			Name:  "TOTPWrong",
+			Fake:  fakeAtlassian{Username: "user", Password: "pass", TOTPSecret: secret},
+			Auth:  atlassianAuth{Username: "user", Password: "pass", TOTPSecret: "KRSXG5CTMVRXEZLU"},
+			Err:   "INVALID_OTP",
+			Steps: "login authenticate mfa",
+		},
+		{
+			Name:  "Consent",
+			Fake:  fakeAtlassian{Username: "user", Password: "pass", Consent: true},
+			Auth:  atlassianAuth{Username: "user", Password: "pass"},
+			Steps: "login authenticate callback consent accept callback",
+		},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			f := newFakeAtlassian(t, &c.Fake)
+			defer f.Close()
+
+			a := c.Auth
+			a.TrelloURL, a.IDURL = f.trello.URL, f.id.URL
+
+			jar, _ := cookiejar.New(nil)
+			err := a.Login(&http.Client{Jar: jar}, ioutil.Discard)
+			if c.Err == "" && err != nil {
+				t.Errorf("login: %v", err)
+			} else if c.Err != "" && (err == nil || !strings.Contains(err.Error(), c.Err)) {
+				t.Errorf("expected error containing %q, got %v", c.Err, err)
+			}
+			if steps := strings.Join(f.steps, " "); steps != c.Steps {
+				t.Errorf("expected steps %q, got %q", c.Steps, steps)
+			}
+		})
+	}
+}
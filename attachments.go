@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// attachmentMeta is the sidecar saved alongside each attachment.
+type attachmentMeta struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	File      string    `json:"file"`
+	BoardID   string    `json:"boardId"`
+	BoardName string    `json:"boardName"`
+	CardID    string    `json:"cardId"`
+	CardName  string    `json:"cardName"`
+	MemberID  string    `json:"memberId,omitempty"`
+	Member    string    `json:"member,omitempty"`
+	MimeType  string    `json:"mimeType,omitempty"`
+	Bytes     *int64    `json:"bytes,omitempty"`
+	Date      time.Time `json:"date"`
+	URL       string    `json:"url"`
+}
+
+// attachmentPath gets the path an attachment is saved to:
+// attachments/BOARD_ID/CARD_ID/ATTACHMENT_ID/NAME. The sidecar is saved as
+// attachments/BOARD_ID/CARD_ID/ATTACHMENT_ID.json. The IDs come from the export,
+// so an error is returned if any of them could escape the directory.
+func attachmentPath(boardID, cardID string, a boardAttachment) (fn, sidecar string, err error) {
+	for _, id := range []string{boardID, cardID, a.ID} {
+		if id == "" || strings.ContainsAny(id, `/\`) || strings.Contains(id, "..") {
+			return "", "", fmt.Errorf("invalid id %q in attachment path", id)
+		}
+	}
+	dir := filepath.Join("attachments", boardID, cardID)
+	name := sanitizeFilename(a.Name)
+	if name == "" {
+		name = sanitizeFilename(filepath.Base(a.URL))
+	}
+	if name == "" {
+		name = "attachment"
+	}
+	return filepath.Join(dir, a.ID, name), filepath.Join(dir, a.ID+".json"), nil
+}
+
+// legacyAttachmentPath gets the path an attachment was saved to before they
+// were saved with the original name.
+func legacyAttachmentPath(au string) (string, bool) {
+	if !strings.Contains(au, "://trello-attachments.s3.amazonaws.com/") {
+		return "", false
+	}
+	fn, err := assetPath("attachments", au)
+	return fn, err == nil
+}
+
+// saveAttachment downloads an attachment (see fetchAsset) and writes its
+// sidecar. If it was downloaded to the legacy path, it is moved.
+func saveAttachment(c *http.Client, ac *assetCache, b *boardDoc, card boardCard, a boardAttachment) (assetResult, error) {
+	fn, _, err := attachmentPath(b.ID, card.ID, a)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := importLegacyAttachment(".", fn, a); err != nil {
+		return 0, err
+	}
+
+	res, err := fetchAsset(c, ac, a.URL, fn)
+	if err != nil {
+		return 0, err
+	}
+
+	if err := writeAttachmentInfo(b, card, a); err != nil {
+		return 0, err
+	}
+	return res, nil
+}
+
+// importLegacyAttachment moves an attachment saved to the legacy path in the
+// backup directory from to fn if it doesn't already exist. If from isn't the
+// current directory, it is copied instead. It returns true if fn exists
+// afterwards.
+func importLegacyAttachment(from, fn string, a boardAttachment) (bool, error) {
+	if _, err := os.Stat(fn); err == nil {
+		return true, nil
+	} else if !os.IsNotExist(err) {
+		return false, err
+	}
+
+	lfn, ok := legacyAttachmentPath(a.URL)
+	if !ok {
+		return false, nil
+	}
+	lfn = filepath.Join(from, lfn)
+	if _, err := os.Stat(lfn); os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return false, err
+	}
+	if filepath.Clean(from) == "." {
+		if err := os.Rename(lfn, fn); err != nil {
+			return false, fmt.Errorf("move legacy attachment: %w", err)
+		}
+	} else if err := copyFile(lfn, fn); err != nil {
+		return false, fmt.Errorf("copy legacy attachment: %w", err)
+	}
+	return true, nil
+}
+
+// writeAttachmentInfo sets the modification time of a saved attachment and
+// writes its sidecar.
+func writeAttachmentInfo(b *boardDoc, card boardCard, a boardAttachment) error {
+	fn, sidecar, err := attachmentPath(b.ID, card.ID, a)
+	if err != nil {
+		return err
+	}
+
+	meta := attachmentMeta{
+		ID:        a.ID,
+		Name:      a.Name,
+		File:      filepath.ToSlash(fn),
+		BoardID:   b.ID,
+		BoardName: b.Name,
+		CardID:    card.ID,
+		CardName:  card.Name,
+		MemberID:  a.IDMember,
+		MimeType:  a.MimeType,
+		Bytes:     a.Bytes,
+		Date:      a.Date,
+		URL:       a.URL,
+	}
+	if m := b.Member(a.IDMember); m != nil {
+		meta.Member = m.Username
+	}
+
+	if !a.Date.IsZero() {
+		if err := os.Chtimes(fn, a.Date, a.Date); err != nil {
+			return fmt.Errorf("set mtime: %w", err)
+		}
+	}
+
+	buf, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(sidecar, buf, 0644); err != nil {
+		return fmt.Errorf("write sidecar: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"strings"
+	"sync"
+)
+
+// errSessionExpired is returned when the session is lost and the
+// authentication method can't log in again by itself.
+var errSessionExpired = errors.New("session expired (log in again or get a new token cookie)")
+
+// authenticator establishes a Trello session.
+type authenticator interface {
+	// Login logs in using c, writing progress messages to w. The client does
+	// not detect session loss.
+	Login(c *http.Client, w io.Writer) error
+	// Renewable returns true if Login can be called again to recover from an
+	// expired session.
+	Renewable() bool
+}
+
+// tokenCookieAuth logs in using the token cookie from an existing session.
+type tokenCookieAuth string
+
+func (a tokenCookieAuth) Login(c *http.Client, w io.Writer) error {
+	fmt.Fprintln(w, "Logging in with token cookie")
+	u, err := url.Parse("https://trello.com")
+	if err != nil {
+		panic(err)
+	}
+	c.Jar.SetCookies(u, []*http.Cookie{&http.Cookie{
+		Name:     "token",
+		Domain:   "trello.com",
+		Path:     "/",
+		SameSite: http.SameSiteDefaultMode,
+		HttpOnly: false,
+		Value:    string(a),
+	}})
+	return nil
+}
+
+func (a tokenCookieAuth) Renewable() bool {
+	return false
+}
+
+// trelloAuth logs in using the credentials for a Trello account.
+type trelloAuth struct {
+	Username, Password, TOTPSecret string
+}
+
+func (a *trelloAuth) Login(c *http.Client, w io.Writer) error {
+	fmt.Fprintln(w, "Logging in with Trello account")
+
+	fmt.Fprintln(w, "Getting login token")
+	token, err := getLoginToken(c)
+	if err != nil {
+		return fmt.Errorf("could not get login token: %w", err)
+	}
+
+	fmt.Fprintln(w, "Authenticating")
+	authentication, err := getAuthentication(c, a.Username, a.Password, "")
+	if err != nil && strings.Contains(err.Error(), "TWO_FACTOR_MISSING") {
+		if a.TOTPSecret == "" {
+			return errors.New("could not authenticate: second factor required")
+		}
+		authentication, err = getAuthentication(c, a.Username, a.Password, a.TOTPSecret)
+	}
+	if err != nil {
+		return fmt.Errorf("could not authenticate: %w", err)
+	}
+
+	fmt.Fprintln(w, "Updating session info")
+	if err := updateSession(c, authentication, token); err != nil {
+		return fmt.Errorf("could not update session info: %w", err)
+	}
+	return nil
+}
+
+func (a *trelloAuth) Renewable() bool {
+	return true
+}
+
+// apiTokenAuth authenticates requests using an API key and token.
+type apiTokenAuth struct {
+	Key, Token string
+}
+
+func (a apiTokenAuth) Login(c *http.Client, w io.Writer) error {
+	fmt.Fprintln(w, "Logging in with API token")
+	return nil
+}
+
+func (a apiTokenAuth) Renewable() bool {
+	return false
+}
+
+func (a apiTokenAuth) Authorize(r *http.Request) {
+	r.Header.Set("Authorization", fmt.Sprintf(`OAuth oauth_consumer_key="%s", oauth_token="%s"`, a.Key, a.Token))
+}
+
+// isAPIToken checks whether auth uses an API token rather than a session.
+func isAPIToken(auth authenticator) bool {
+	_, ok := auth.(apiTokenAuth)
+	return ok
+}
+
+// requestAuthorizer is implemented by authenticators which need to modify
+// each request to Trello.
+type requestAuthorizer interface {
+	Authorize(r *http.Request)
+}
+
+// authorizeTransport calls Auth on a copy of every request to Trello.
+type authorizeTransport struct {
+	Base http.RoundTripper
+	Auth requestAuthorizer
+}
+
+func (t *authorizeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if isTrelloURL(req.URL) {
+		req = req.Clone(req.Context())
+		t.Auth.Authorize(req)
+	}
+	return t.Base.RoundTrip(req)
+}
+
+// authMode describes the authentication method used by auth.
+func authMode(auth authenticator) string {
+	switch auth.(type) {
+	case tokenCookieAuth:
+		return "token cookie"
+	case *trelloAuth:
+		return "Trello account"
+	case *atlassianAuth:
+		return "Atlassian account"
+	case apiTokenAuth:
+		return "API token"
+	default:
+		return "unknown"
+	}
+}
+
+// newClient creates a client logged in with auth, writing progress messages
+// to w. If the session is lost later, the client will log in again and
+// re-issue the failed request.
+func newClient(auth authenticator, w io.Writer) (*http.Client, error) {
+	base := http.DefaultTransport
+	if ra, ok := auth.(requestAuthorizer); ok {
+		base = &authorizeTransport{Base: base, Auth: ra}
+	}
+
+	jar, _ := cookiejar.New(nil)
+	lc := &http.Client{Jar: jar, Transport: base}
+	if err := auth.Login(lc, w); err != nil {
+		return nil, err
+	}
+	return &http.Client{
+		Jar: jar,
+		Transport: &authTransport{
+			Base:     base,
+			Jar:      jar,
+			Auth:     auth,
+			Login:    lc,
+			Progress: w,
+		},
+	}, nil
+}
+
+// authTransport detects responses indicating that the session was lost, and
+// logs in again before retrying the request.
+type authTransport struct {
+	Base     http.RoundTripper
+	Jar      http.CookieJar
+	Auth     authenticator
+	Login    *http.Client // without authTransport
+	Progress io.Writer
+
+	mu  sync.Mutex
+	gen int // incremented after every login
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	gen := t.gen
+	t.mu.Unlock()
+
+	resp, err := t.Base.RoundTrip(req)
+	if err != nil || !isTrelloURL(req.URL) || !isAuthLoss(req, resp) {
+		return resp, err
+	}
+	if req.Body != nil && req.GetBody == nil {
+		return resp, nil // can't re-issue it
+	}
+
+	if err := t.relogin(gen); err == errNotExpired {
+		return resp, nil // it's just a permission error
+	} else if err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+
+	r := req.Clone(req.Context())
+	if req.GetBody != nil {
+		if r.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	r.Header.Del("Cookie")
+	for _, ck := range t.Jar.Cookies(r.URL) {
+		r.AddCookie(ck)
+	}
+	return t.Base.RoundTrip(r)
+}
+
+var errNotExpired = errors.New("session not expired")
+
+// relogin logs in again if nobody has done it since gen and the session is
+// actually gone.
+func (t *authTransport) relogin(gen int) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.gen != gen {
+		return nil // someone else already did it
+	}
+
+	if ok, err := checkSession(t.Login); err != nil {
+		return fmt.Errorf("check session: %w", err)
+	} else if ok {
+		return errNotExpired
+	}
+
+	if !t.Auth.Renewable() {
+		return errSessionExpired
+	}
+
+	fmt.Fprintln(t.Progress, "Session expired, logging in again")
+	if err := t.Auth.Login(t.Login, t.Progress); err != nil {
+		return fmt.Errorf("could not log in again: %w", err)
+	}
+	t.gen++
+
+	if ok, err := checkSession(t.Login); err != nil {
+		return fmt.Errorf("check session: %w", err)
+	} else if !ok {
+		return errors.New("could not log in again: session still invalid")
+	}
+	return nil
+}
+
+// checkSession returns true if c is logged in.
+func checkSession(c *http.Client) (bool, error) {
+	resp, err := c.Get("https://trello.com/1/members/me?fields=id")
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusOK && !isHTML(resp):
+		return true, nil
+	case resp.StatusCode == http.StatusOK, resp.StatusCode == http.StatusUnauthorized:
+		return false, nil
+	default:
+		return false, fmt.Errorf("response status %s", resp.Status)
+	}
+}
+
+// isAuthLoss checks if resp looks like what Trello returns when the session
+// is gone: a 401, a redirect to the login page, or the login page itself in
+// place of JSON.
+func isAuthLoss(req *http.Request, resp *http.Response) bool {
+	switch {
+	case resp.StatusCode == http.StatusUnauthorized:
+		return true
+	case resp.StatusCode >= 300 && resp.StatusCode < 400:
+		loc, err := resp.Location()
+		return err == nil && isTrelloURL(loc) && strings.HasPrefix(loc.Path, "/login")
+	case resp.StatusCode == http.StatusOK:
+		return isJSONURL(req.URL) && isHTML(resp)
+	}
+	return false
+}
+
+func isTrelloURL(u *url.URL) bool {
+	return u.Hostname() == "trello.com" || strings.HasSuffix(u.Hostname(), ".trello.com")
+}
+
+func isJSONURL(u *url.URL) bool {
+	return strings.HasPrefix(u.Path, "/1/") || strings.HasSuffix(u.Path, ".json")
+}
+
+func isHTML(resp *http.Response) bool {
+	return strings.HasPrefix(resp.Header.Get("Content-Type"), "text/html")
+}
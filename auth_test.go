@@ -0,0 +1,307 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type recordTransport []*http.Request
+
+func (t *recordTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	*t = append(*t, req)
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody, Request: req}, nil
+}
+
+func TestAPITokenAuth(t *testing.T) {
+	var rt recordTransport
+	c := &http.Client{Transport: &authorizeTransport{
+		Base: &rt,
+		Auth: apiTokenAuth{Key: "key", Token: "token"},
+	}}
+
+	board := boardInfo{ID: "5f0000000000000000000001", ShortURL: "https://trello.com/b/abcdefgh"}
+	for _, u := range []string{
+		boardJSONURL(board, true),
+		"https://trello.com/1/members/me?fields=username",
+		"https://api.trello.com/1/members/me?fields=username",
+		"https://trello-attachments.s3.amazonaws.com/abc/def.png",
+	} {
+		resp, err := c.Get(u)
+		if err != nil {
+			t.Fatalf("get %s: %v", u, err)
+		}
+		resp.Body.Close()
+	}
+
+	for i, exp := range []string{
+		`OAuth oauth_consumer_key="key", oauth_token="token"`,
+		`OAuth oauth_consumer_key="key", oauth_token="token"`,
+		`OAuth oauth_consumer_key="key", oauth_token="token"`,
+		``, // not sent to other hosts
+	} {
+		if act := rt[i].Header.Get("Authorization"); act != exp {
+			t.Errorf("%s: expected authorization %q, got %q", rt[i].URL, exp, act)
+		}
+	}
+}
+
+func TestBoardJSONURL(t *testing.T) {
+	board := boardInfo{ID: "5f0000000000000000000001", ShortURL: "https://trello.com/b/abcdefgh"}
+
+	if u := boardJSONURL(board, false); u != "https://trello.com/b/abcdefgh.json" {
+		t.Errorf("expected the website export with a session, got %s", u)
+	}
+
+	// API tokens only work on the API, not the website's export
+	u, err := url.Parse(boardJSONURL(board, true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.Host != "trello.com" || u.Path != "/1/boards/5f0000000000000000000001" || !isJSONURL(u) {
+		t.Errorf("expected the board API with an API token, got %s", u)
+	}
+	if q := u.Query(); q.Get("actions_limit") != "1000" || q.Get("cards") != "all" || q.Get("card_attachments") != "true" {
+		t.Errorf("expected the same data as the website export, got %s", u.RawQuery)
+	}
+	if !isAPIToken(apiTokenAuth{}) || isAPIToken(tokenCookieAuth("")) {
+		t.Errorf("wrong isAPIToken result")
+	}
+}
+
+// fakeSessionServer is a fake Trello which only accepts the token cookie
+// Token, and fails like Mode otherwise (401, redirect, or html).
+type fakeSessionServer struct {
+	*httptest.Server
+	Token string
+	Mode  string
+
+	mu     sync.Mutex
+	bodies []string
+}
+
+func newFakeSessionServer(mode string) *fakeSessionServer {
+	f := &fakeSessionServer{Token: "new", Mode: mode}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ck, err := r.Cookie("token")
+		valid := err == nil && ck.Value == f.Token
+		switch r.URL.Path {
+		case "/login":
+			w.Header().Set("Content-Type", "text/html")
+			fmt.Fprint(w, "<html>log in</html>")
+		case "/1/members/me":
+			if !valid {
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"id":"me"}`)
+		case "/1/private":
+			http.Error(w, "unauthorized permission requested", http.StatusUnauthorized)
+		default:
+			if !valid {
+				switch f.Mode {
+				case "401":
+					http.Error(w, "invalid token", http.StatusUnauthorized)
+				case "redirect":
+					http.Redirect(w, r, "https://trello.com/login?returnUrl="+url.QueryEscape(r.URL.Path), http.StatusFound)
+				case "html":
+					w.Header().Set("Content-Type", "text/html")
+					fmt.Fprint(w, "<html>log in</html>")
+				}
+				return
+			}
+			buf, _ := ioutil.ReadAll(r.Body)
+			f.mu.Lock()
+			f.bodies = append(f.bodies, string(buf))
+			f.mu.Unlock()
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprint(w, `{"id":"b1"}`)
+		}
+	}))
+	return f
+}
+
+// Transport sends requests for trello.com to the fake server.
+func (f *fakeSessionServer) Transport() http.RoundTripper {
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if isTrelloURL(req.URL) {
+			u, _ := url.Parse(f.URL)
+			req = req.Clone(req.Context())
+			req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (fn roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return fn(req)
+}
+
+// fakeSessionAuth logs in by setting the token cookie to Token.
+type fakeSessionAuth struct {
+	Token     string
+	Renew     bool
+	mu        sync.Mutex
+	logins    int
+	loginWait time.Duration
+}
+
+func (a *fakeSessionAuth) Login(c *http.Client, w io.Writer) error {
+	a.mu.Lock()
+	a.logins++
+	a.mu.Unlock()
+	time.Sleep(a.loginWait)
+	c.Jar.SetCookies(&url.URL{Scheme: "https", Host: "trello.com"}, []*http.Cookie{{Name: "token", Value: a.Token, Path: "/"}})
+	return nil
+}
+
+func (a *fakeSessionAuth) Renewable() bool {
+	return a.Renew
+}
+
+// newTestSessionClient creates a client like newClient, with a session which
+// has already expired.
+func newTestSessionClient(f *fakeSessionServer, auth *fakeSessionAuth) *http.Client {
+	jar, _ := cookiejar.New(nil)
+	jar.SetCookies(&url.URL{Scheme: "https", Host: "trello.com"}, []*http.Cookie{{Name: "token", Value: "old", Path: "/"}})
+	base := f.Transport()
+	return &http.Client{
+		Jar: jar,
+		Transport: &authTransport{
+			Base:     base,
+			Jar:      jar,
+			Auth:     auth,
+			Login:    &http.Client{Jar: jar, Transport: base},
+			Progress: ioutil.Discard,
+		},
+	}
+}
+
+func TestAuthTransportRelogin(t *testing.T) {
+	for _, mode := range []string{"401", "redirect", "html"} {
+		t.Run(mode, func(t *testing.T) {
+			f := newFakeSessionServer(mode)
+			defer f.Close()
+
+			auth := &fakeSessionAuth{Token: "new", Renew: true}
+			c := newTestSessionClient(f, auth)
+
+			resp, err := c.Get("https://trello.com/1/boards/b1")
+			if err != nil {
+				t.Fatalf("get: %v", err)
+			}
+			buf, _ := ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK || string(buf) != `{"id":"b1"}` {
+				t.Errorf("expected the request to succeed after logging in again, got %s: %s", resp.Status, buf)
+			}
+			if auth.logins != 1 {
+				t.Errorf("expected 1 login, got %d", auth.logins)
+			}
+		})
+	}
+}
+
+func TestAuthTransportNotExpired(t *testing.T) {
+	f := newFakeSessionServer("401")
+	defer f.Close()
+
+	auth := &fakeSessionAuth{Token: "new", Renew: true}
+	c := newTestSessionClient(f, auth)
+	c.Jar.SetCookies(&url.URL{Scheme: "https", Host: "trello.com"}, []*http.Cookie{{Name: "token", Value: "new", Path: "/"}})
+
+	resp, err := c.Get("https://trello.com/1/private")
+	if err != nil {
+		t.Fatalf("get: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the permission error to be returned as-is, got %s", resp.Status)
+	}
+	if auth.logins != 0 {
+		t.Errorf("expected no login for a permission error, got %d", auth.logins)
+	}
+	if err := c.Transport.(*authTransport).relogin(0); err != errNotExpired {
+		t.Errorf("expected errNotExpired, got %v", err)
+	}
+}
+
+func TestAuthTransportNotRenewable(t *testing.T) {
+	f := newFakeSessionServer("401")
+	defer f.Close()
+
+	auth := &fakeSessionAuth{Token: "new"}
+	c := newTestSessionClient(f, auth)
+
+	if _, err := c.Get("https://trello.com/1/boards/b1"); !errors.Is(err, errSessionExpired) {
+		t.Errorf("expected errSessionExpired, got %v", err)
+	}
+	if auth.logins != 0 {
+		t.Errorf("expected no login, got %d", auth.logins)
+	}
+}
+
+func TestAuthTransportBody(t *testing.T) {
+	f := newFakeSessionServer("401")
+	defer f.Close()
+
+	auth := &fakeSessionAuth{Token: "new", Renew: true}
+	c := newTestSessionClient(f, auth)
+
+	resp, err := c.Post("https://trello.com/1/boards/b1", "application/json", strings.NewReader(`{"name":"x"}`))
+	if err != nil {
+		t.Fatalf("post: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("expected the request to be re-issued, got %s", resp.Status)
+	}
+	if len(f.bodies) != 1 || f.bodies[0] != `{"name":"x"}` {
+		t.Errorf("expected the body to be sent again, got %q", f.bodies)
+	}
+}
+
+func TestAuthTransportConcurrent(t *testing.T) {
+	f := newFakeSessionServer("401")
+	defer f.Close()
+
+	auth := &fakeSessionAuth{Token: "new", Renew: true, loginWait: time.Millisecond * 50}
+	c := newTestSessionClient(f, auth)
+
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			resp, err := c.Get("https://trello.com/1/boards/b1")
+			if err != nil {
+				t.Errorf("get: %v", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("expected success, got %s", resp.Status)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	if auth.logins != 1 {
+		t.Errorf("expected concurrent requests to only log in once, got %d", auth.logins)
+	}
+}
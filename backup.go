@@ -0,0 +1,763 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func backupCommand(args []string) {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	nameTemplate := fs.String("name-template", "", "template for snapshot filenames, saved for later runs (placeholders: {time}, {user}, {board_id}, {board_shortlink}, {board_name}, {run_id}) (default \""+defaultNameTemplate+"\")")
+	storage := fs.String("storage", "", "how to store snapshots, saved for later runs: full, or delta (JSON patches from the previous snapshot, requires -format canonical) (default \"full\")")
+	fullEvery := fs.Int("full-every", 0, "in the delta storage mode, store a full snapshot after this many deltas, saved for later runs (default "+strconv.Itoa(defaultFullEvery)+")")
+	format := fs.String("format", "", "how to save board JSON, saved for later runs: raw (as downloaded), or canonical (pretty-printed with sorted keys and arrays, keeping the raw export in .trellobackup/raw) (default \"raw\")")
+	dropRaw := fs.Bool("drop-raw-deltas", false, "in the delta storage mode, don't keep the raw export for snapshots stored as deltas, saved for later runs")
+	strip := fs.Bool("strip-volatile", false, "in the canonical format, remove fields which change without the board changing (limits, dateLastView), saved for later runs")
+	export := fs.String("export", "auto", "how to export boards: json (the board's JSON export), api (assembled from paginated API requests, for very large boards), or auto (api if the JSON export is truncated, or the previous one was)")
+	var rate, hostRate, maxBytes sizeFlag
+	fs.Var(&rate, "limit-rate", "maximum download rate in bytes per second, with an optional K, M, or G suffix (default: no limit)")
+	fs.Var(&hostRate, "limit-rate-host", "maximum download rate per host in bytes per second (default: no limit)")
+	fs.Var(&maxBytes, "max-bytes", "stop the run after downloading this many bytes, with an optional K, M, or G suffix (default: no limit)")
+	maxAttachments := fs.Int("max-attachments", 0, "stop the run after downloading this many attachments (default: no limit)")
+	maxDuration := fs.Duration("max-duration", 0, "stop the run after this long (default: no limit)")
+	restart := fs.Bool("restart", false, "don't continue where an incomplete previous run left off")
+	acceptDrop := fs.String("accept-drop", "", "comma-separated IDs or short links of boards to save even if most of their cards or lists were removed since the previous snapshot")
+	signingKey := fs.String("signing-key", "", "ed25519 key from keygen to sign the run with (can be a secret reference)")
+	var alerts anomalyConfig
+	alerts.Register(fs)
+	var af authFlags
+	af.Register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup backup [options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+		af.PrintNotes(fs.Output())
+		fmt.Fprintln(fs.Output(), "Note: If a run is stopped early by one of the -max-* options, the next run continues where it left off.")
+		fmt.Fprintln(fs.Output(), "Note: The -alert-* options are saved for later runs.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if !af.ValidArgs(fs.Args()) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch *export {
+	case "auto", "json", "api":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unsupported export method %q\n", *export)
+		os.Exit(2)
+	}
+
+	auth, err := af.Authenticator(fs.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	key, err := resolveSigningKey(*signingKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load signing key: %v\n", err)
+		os.Exit(1)
+	}
+
+	chdir(*dir)
+
+	cfg, err := loadStoreConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load config: %v\n", err)
+		os.Exit(1)
+	}
+	if *nameTemplate != "" && *nameTemplate != cfg.NameTemplate {
+		if err := cfg.SetNameTemplate(*nameTemplate); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid name template: %v\n", err)
+			os.Exit(2)
+		}
+		if err := cfg.save("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not save config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if (*storage != "" && *storage != cfg.Storage) || (*fullEvery != 0 && *fullEvery != cfg.FullEvery) || (*format != "" && *format != cfg.Format) {
+		if err := cfg.SetStorage(*storage, *fullEvery); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if *format != "" {
+			if err := cfg.SetFormat(*format); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		if err := cfg.check(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if err := cfg.save("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not save config: %v\n", err)
+			os.Exit(1)
+		}
+	} else if err := cfg.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+	if isFlagSet(fs, "strip-volatile") && *strip != cfg.Strip {
+		cfg.Strip = *strip
+		if err := cfg.save("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not save config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if isFlagSet(fs, "drop-raw-deltas") && *dropRaw != cfg.DropRaw {
+		cfg.DropRaw = *dropRaw
+		if err := cfg.save("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not save config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	if alerts.Merge(fs, &cfg.Anomalies) {
+		if err := cfg.save("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not save config: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	cat, err := openCatalog(".", false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cat.Close()
+
+	ac, err := loadAssetCache(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load asset cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	ms, err := loadRunManifests(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load previous runs: %v\n", err)
+		os.Exit(1)
+	}
+
+	m := &runManifest{
+		ID:      newID(),
+		Started: time.Now(),
+	}
+	fmt.Println("Starting run", m.ID)
+
+	if last := len(ms) - 1; last >= 0 && !ms[last].Complete && !*restart {
+		m.Resumed = ms[last].ID
+		for _, rb := range ms[last].Boards {
+			if rb.Status == "done" {
+				if rb.Run == "" {
+					rb.Run = ms[last].ID
+				}
+				m.Boards = append(m.Boards, rb)
+			}
+		}
+		fmt.Printf("Continuing incomplete run %s (%d boards already backed up)\n", m.Resumed, len(m.Boards))
+	}
+
+	c, err := newClient(auth, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	tt := newThrottleTransport(c.Transport, int64(rate), int64(hostRate))
+	c.Transport = tt
+
+	budget := runBudget{
+		MaxBytes:       int64(maxBytes),
+		MaxAttachments: *maxAttachments,
+		MaxDuration:    *maxDuration,
+	}
+
+	username, err := getUsername(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get username: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Logged in as", username)
+
+	fmt.Println("Getting boards")
+	boards, err := getBoards(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get boards: %v\n", err)
+		os.Exit(1)
+	}
+
+	r := &backupRun{
+		c:        c,
+		tt:       tt,
+		cat:      cat,
+		ac:       ac,
+		cfg:      cfg,
+		m:        m,
+		username: username,
+		export:   *export,
+		apiToken: isAPIToken(auth),
+		budget:   budget,
+	}
+	if *acceptDrop != "" {
+		r.acceptDrop = map[string]bool{}
+		for _, id := range strings.Split(*acceptDrop, ",") {
+			r.acceptDrop[strings.TrimSpace(id)] = true
+		}
+	}
+
+	vanished, err := checkVanishedBoards(cat, m, boards, username)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not check for missing boards: %v\n", err)
+		os.Exit(1)
+	}
+	if err := r.checkpoint(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, board := range boards {
+		if board.Closed {
+			fmt.Printf("Skipping closed board %s (%s) (id: %s)\n", board.Name, board.ShortLink, board.ID)
+			continue
+		}
+		if rb := m.Board(board.ID); rb != nil && rb.Status == "done" {
+			fmt.Printf("Skipping %s (%s) (id: %s), already backed up by run %s\n", board.Name, board.ShortLink, board.ID, rb.Run)
+			continue
+		}
+		if r.stop() {
+			break
+		}
+		if ok, err := r.backupBoard(board); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		} else if !ok {
+			break
+		}
+	}
+
+	finished := time.Now()
+	m.Finished = &finished
+	m.Complete = m.Stopped == ""
+	if err := r.checkpoint(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	if key != nil {
+		fn, err := signRun(cat, m, key)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not sign run: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Signed run as %s\n", fn)
+	}
+
+	if m.Stopped != "" {
+		fmt.Printf("Stopped early: %s\n", m.Stopped)
+		fmt.Println("The next run will continue where this one left off")
+	}
+
+	if r.failed != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d boards could not be backed up (see the quarantine directory)\n", r.failed)
+	}
+	if vanished != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d boards are no longer accessible (their last snapshots have been protected)\n", vanished)
+	}
+	if r.alerted != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d boards had large changes since the previous snapshot (the previous snapshots have been protected)\n", r.alerted)
+	}
+	if r.failed != 0 || vanished != 0 || r.alerted != 0 {
+		os.Exit(1)
+	}
+
+	if m.Stopped != "" {
+		os.Exit(0)
+	}
+
+	fmt.Println("Successfully backed up Trello data")
+	os.Exit(0)
+}
+
+// backupRun is the state of a backup run.
+type backupRun struct {
+	c        *http.Client
+	tt       *throttleTransport
+	cat      *catalog
+	ac       *assetCache
+	cfg      *storeConfig
+	m        *runManifest
+	username string
+	export   string // auto, json, or api
+	apiToken bool   // whether the client uses an API token rather than a session
+	budget   runBudget
+
+	acceptDrop map[string]bool // IDs or short links of boards not to check for removed cards or lists
+
+	failed, alerted int
+}
+
+// stop checks whether the run has exceeded its budget, and records why.
+func (r *backupRun) stop() bool {
+	if r.m.Stopped == "" {
+		r.m.Stopped = r.budget.Exceeded(r.tt.Bytes(), r.m.Attachments, time.Since(r.m.Started))
+	}
+	return r.m.Stopped != ""
+}
+
+// checkpoint saves the progress of the run so it can be continued.
+func (r *backupRun) checkpoint() error {
+	if err := r.ac.save("."); err != nil {
+		return fmt.Errorf("could not save asset cache: %w", err)
+	}
+	r.m.Bytes = r.tt.Bytes()
+	if err := r.m.save("."); err != nil {
+		return fmt.Errorf("could not save run manifest: %w", err)
+	}
+	if err := r.cat.PutRun(r.m); err != nil {
+		return fmt.Errorf("could not update catalog: %w", err)
+	}
+	return nil
+}
+
+// backupBoard backs up a board and its attachments. It returns false if the
+// run was stopped before it was done.
+func (r *backupRun) backupBoard(board boardInfo) (bool, error) {
+	fmt.Printf("Backing up %s (%s) (id: %s)\n", board.Name, board.ShortLink, board.ID)
+
+	now := time.Now()
+	fn := uniqueName(".", snapshotName(r.cfg.NameTemplate, nameVars{
+		Time:           now,
+		User:           r.username,
+		BoardID:        board.ID,
+		BoardShortLink: board.ShortLink,
+		BoardName:      board.Name,
+		RunID:          r.m.ID,
+	}), ".json", r.m.ID)
+
+	var prev *boardSummary
+	var ps *boardScan
+	pfn, err := findPreviousSnapshot(".", board.ID)
+	if err != nil {
+		return false, fmt.Errorf("could not find previous snapshot: %w", err)
+	} else if pfn != "" {
+		if ps, err = scanBoardFile(pfn); err == nil {
+			if !r.acceptDrop[board.ID] && !r.acceptDrop[board.ShortLink] {
+				prev = &ps.boardSummary
+			}
+		} else if errors.As(err, new(*os.PathError)) {
+			return false, fmt.Errorf("could not read previous snapshot: %w", err)
+		} // otherwise, don't hold a bad previous snapshot against the new one
+	}
+
+	var b *boardScan
+	if r.export == "api" {
+		fmt.Println("--> Saving JSON from the API")
+		b, err = saveBoardAPI(r.c, board.ID, fn, prev)
+	} else if r.export == "auto" && ps != nil && ps.truncated() {
+		// the JSON export would be truncated again, so don't download it
+		// every time just to find that out
+		fmt.Println("--> Saving JSON from the API (the previous export was too large for the JSON export)")
+		b, err = saveBoardAPI(r.c, board.ID, fn, prev)
+	} else {
+		fmt.Println("--> Saving JSON")
+		b, err = saveBoardJSON(r.c, board, r.apiToken, fn, prev)
+		if err == nil && r.export == "auto" && b.truncated() {
+			fmt.Println("--> Export is truncated, saving JSON from the API instead")
+			b, err = saveBoardAPI(r.c, board.ID, fn, prev)
+		}
+	}
+	if err != nil {
+		var ierr *invalidBoardError
+		if !errors.As(err, &ierr) {
+			return false, fmt.Errorf("could not save board JSON: %w", err)
+		}
+		fmt.Fprintf(os.Stderr, "Error: invalid board JSON, quarantining: %v\n", ierr.err)
+		if err := quarantine(fn, ierr.tmp, ierr.err); err != nil {
+			os.Remove(ierr.tmp)
+			return false, fmt.Errorf("could not quarantine file: %w", err)
+		}
+		r.m.SetBoard(runBoard{ID: board.ID, Name: board.Name, Status: "failed"})
+		if err := r.cat.PutFailure(catalogFailure{
+			Time:      now,
+			Run:       r.m.ID,
+			BoardID:   board.ID,
+			BoardName: board.Name,
+			Error:     ierr.err.Error(),
+			File:      filepath.ToSlash(filepath.Join("quarantine", filepath.Base(fn))),
+		}); err != nil {
+			return false, fmt.Errorf("could not update catalog: %w", err)
+		}
+		r.failed++
+		return true, r.checkpoint()
+	}
+
+	var raw string
+	if r.cfg.Format == "canonical" {
+		if err := canonicalizeSnapshot(fn, r.cfg.Strip, b); err != nil {
+			return false, fmt.Errorf("could not canonicalize board JSON: %w", err)
+		}
+		raw = filepath.ToSlash(rawSnapshotPath(fn))
+	}
+
+	var anomalies []string
+	if ps != nil {
+		anomalies = checkAnomalies(r.cfg.Anomalies, ps.Stats, b.Stats)
+	}
+	if len(anomalies) != 0 {
+		for _, a := range anomalies {
+			fmt.Printf("--> Warning: %s\n", a)
+		}
+		if err := protectPrevious(r.cat, pfn, "anomalies in the next snapshot ("+filepath.ToSlash(fn)+")"); err != nil {
+			return false, fmt.Errorf("could not protect previous snapshot: %w", err)
+		}
+		fmt.Printf("--> Protected the previous snapshot %s\n", pfn)
+		r.alerted++
+	}
+
+	if r.cfg.Storage == "delta" {
+		if ok, err := storeDelta(fn, pfn, r.cfg.FullEvery); err != nil {
+			return false, fmt.Errorf("could not store snapshot as a delta: %w", err)
+		} else if ok {
+			fmt.Printf("--> Stored as a delta from %s\n", pfn)
+			if b.SHA256, b.Size, err = snapshotSHA256(fn); err != nil {
+				return false, fmt.Errorf("could not hash reconstructed snapshot: %w", err)
+			}
+			if raw != "" && r.cfg.DropRaw {
+				if err := os.Remove(rawSnapshotPath(fn)); err != nil && !os.IsNotExist(err) {
+					return false, fmt.Errorf("could not remove raw export: %w", err)
+				}
+				raw = ""
+			}
+		}
+	}
+
+	rb := runBoard{ID: board.ID, Name: board.Name, File: filepath.ToSlash(fn), Status: "partial"}
+	r.m.SetBoard(rb)
+
+	snap := catalogSnapshot{
+		ID:          newID(),
+		Run:         r.m.ID,
+		Time:        now,
+		User:        r.username,
+		BoardID:     board.ID,
+		BoardName:   b.Board.Name,
+		File:        filepath.ToSlash(fn),
+		Size:        b.Size,
+		SHA256:      b.SHA256,
+		Counts:      b.Counts,
+		Partial:     true,
+		Attachments: b.AttachmentFiles(),
+		Anomalies:   anomalies,
+		Raw:         raw,
+	}
+	if err := r.cat.PutSnapshot(snap, board.ShortLink); err != nil {
+		return false, fmt.Errorf("could not update catalog: %w", err)
+	}
+	if err := r.checkpoint(); err != nil {
+		return false, err
+	}
+
+	fmt.Println("--> Downloading attachments")
+	for _, card := range b.Board.Cards {
+		for _, a := range card.Attachments {
+			if !a.IsUpload {
+				continue // link
+			}
+			if r.stop() {
+				return false, r.checkpoint()
+			}
+			fmt.Printf("    Downloading attachment %s\n", a.URL)
+			res, err := saveAttachment(r.c, r.ac, &b.Board, card, a)
+			if err != nil {
+				return false, fmt.Errorf("could not download attachment: %w", err)
+			}
+			if res != assetUnchanged {
+				r.m.Attachments++
+			}
+			printAssetResult(res)
+			if err := catalogAttachmentFile(r.cat, res, b.ID, card.ID, a); err != nil {
+				return false, fmt.Errorf("could not update catalog: %w", err)
+			}
+		}
+	}
+
+	fmt.Println("--> Downloading backgrounds")
+	for _, au := range b.Backgrounds {
+		if r.stop() {
+			return false, r.checkpoint()
+		}
+		fmt.Printf("    Downloading background %s\n", au)
+
+		fn, err := assetPath("backgrounds", au)
+		if err != nil {
+			return false, fmt.Errorf("could not parse background url: %w", err)
+		}
+
+		res, err := fetchAsset(r.c, r.ac, au, fn)
+		if err != nil {
+			return false, fmt.Errorf("could not download background: %w", err)
+		}
+		printAssetResult(res)
+	}
+
+	rb.Status = "done"
+	r.m.SetBoard(rb)
+	snap.Partial = false
+	if err := r.cat.PutSnapshot(snap, board.ShortLink); err != nil {
+		return false, fmt.Errorf("could not update catalog: %w", err)
+	}
+	return true, r.checkpoint()
+}
+
+// checkVanishedBoards compares the user's boards with the ones they backed up
+// before, and records the ones which are missing (i.e., the board was deleted
+// or the user was removed from it) in the catalog and the run. The last
+// snapshot of each one is protected. It returns the number of boards which
+// went missing since the last run.
+func checkVanishedBoards(cat *catalog, m *runManifest, boards []boardInfo, username string) (int, error) {
+	cur := map[string]bool{}
+	for _, board := range boards {
+		cur[board.ID] = true
+	}
+
+	cbs, err := cat.Boards()
+	if err != nil {
+		return 0, err
+	}
+
+	var n int
+	for _, cb := range cbs {
+		if cur[cb.ID] {
+			if cb.Vanished != nil {
+				fmt.Printf("Board %s (id: %s) is accessible again\n", cb.Name, cb.ID)
+				if err := cat.SetVanished(cb.ID, nil); err != nil {
+					return n, err
+				}
+			}
+			continue
+		}
+		if cb.LastSnapshot == "" {
+			continue
+		}
+		s, err := cat.Snapshot(cb.LastSnapshot)
+		if err != nil {
+			return n, err
+		}
+		if s == nil || s.User != username {
+			continue // backed up by someone else, so it may never have been accessible
+		}
+
+		if cb.Vanished != nil {
+			fmt.Printf("Board %s (id: %s) has been missing since %s, last backed up by snapshot %s (%s)\n", cb.Name, cb.ID, formatOptTime(cb.Vanished, ""), s.ID, s.File)
+		} else {
+			fmt.Printf("Warning: board %s (id: %s) is no longer accessible (it was deleted or you were removed from it), last backed up by snapshot %s (%s)\n", cb.Name, cb.ID, s.ID, s.File)
+			if err := cat.Protect(s.ID, "board vanished"); err != nil {
+				return n, err
+			}
+			now := time.Now()
+			if err := cat.SetVanished(cb.ID, &now); err != nil {
+				return n, err
+			}
+			n++
+		}
+		m.SetBoard(runBoard{ID: cb.ID, Name: cb.Name, File: s.File, Status: "vanished", Run: s.Run})
+	}
+	return n, nil
+}
+
+// protectPrevious protects the previous snapshot (saved to fn) of a board
+// which had anomalies. If it isn't in the catalog, it is added first.
+func protectPrevious(cat *catalog, fn, reason string) error {
+	s, err := cat.SnapshotFile(fn)
+	if err != nil {
+		return err
+	}
+	if s == nil {
+		if s, err = uncatalogedSnapshot(fn); err != nil {
+			return err
+		}
+		s.ID = newID()
+		if s.SHA256, s.Size, err = snapshotSHA256(fn); err != nil {
+			return err
+		}
+		if err := cat.PutSnapshot(*s, ""); err != nil {
+			return err
+		}
+	}
+	return cat.Protect(s.ID, reason)
+}
+
+// catalogAttachmentFile adds a saved attachment to the catalog, hashing it if
+// it changed or isn't in the catalog yet.
+func catalogAttachmentFile(cat *catalog, res assetResult, boardID, cardID string, a boardAttachment) error {
+	fn, _, err := attachmentPath(boardID, cardID, a)
+	if err != nil {
+		return err
+	}
+	if res == assetUnchanged {
+		if ca, err := cat.Attachment(fn); err != nil {
+			return err
+		} else if ca != nil && ca.SHA256 != "" {
+			return nil
+		}
+	}
+	sum, size, err := fileSHA256(fn)
+	if err != nil {
+		return err
+	}
+	return cat.PutAttachment(catalogAttachment{
+		File:    filepath.ToSlash(fn),
+		ID:      a.ID,
+		BoardID: boardID,
+		CardID:  cardID,
+		Name:    a.Name,
+		URL:     a.URL,
+		Date:    a.Date,
+		Size:    size,
+		SHA256:  sum,
+	})
+}
+
+func printAssetResult(res assetResult) {
+	switch res {
+	case assetChanged:
+		fmt.Println("      Changed since the last backup, updated")
+	case assetCorrupted:
+		fmt.Println("      Local copy was corrupted, downloaded again")
+	}
+}
+
+// boardExportParams request a board from the API in the same format as the
+// JSON export on the website.
+var boardExportParams = url.Values{
+	"fields":                {"all"},
+	"actions":               {"all"},
+	"action_fields":         {"all"},
+	"actions_limit":         {strconv.Itoa(exportLimits["actions"])},
+	"cards":                 {"all"},
+	"card_fields":           {"all"},
+	"card_attachments":      {"true"},
+	"card_customFieldItems": {"true"},
+	"customFields":          {"true"},
+	"labels":                {"all"},
+	"lists":                 {"all"},
+	"list_fields":           {"all"},
+	"members":               {"all"},
+	"member_fields":         {"all"},
+	"checklists":            {"all"},
+	"checklist_fields":      {"all"},
+	"organization":          {"false"},
+}
+
+// boardJSONURL gets the URL of the board's JSON export. The export on the
+// website needs a session, so with an API token, it is requested from the API
+// instead.
+func boardJSONURL(board boardInfo, apiToken bool) string {
+	if apiToken {
+		return "https://trello.com/1/boards/" + url.PathEscape(board.ID) + "?" + boardExportParams.Encode()
+	}
+	return board.ShortURL + ".json"
+}
+
+// saveBoardJSON saves the board's JSON export to fn.
+func saveBoardJSON(c *http.Client, board boardInfo, apiToken bool, fn string, prev *boardSummary) (*boardScan, error) {
+	resp, err := c.Get(boardJSONURL(board, apiToken))
+	if err != nil {
+		return nil, fmt.Errorf("get board json (trellobackup may need to be updated): %w", err)
+	}
+	defer resp.Body.Close()
+	return saveBoard(resp.Body, validateBoardResponse(resp), board.ID, fn, prev)
+}
+
+// saveBoardAPI saves a board export assembled from the API to fn.
+func saveBoardAPI(c *http.Client, id, fn string, prev *boardSummary) (*boardScan, error) {
+	pr, pw := io.Pipe()
+	defer pr.Close()
+	go func() {
+		pw.CloseWithError(exportBoardAPI(c, id, pw))
+	}()
+	return saveBoard(pr, nil, id, fn, prev)
+}
+
+// saveBoard streams the board export from r to fn. If it isn't a valid export
+// of the board id, or invalid is not nil (i.e., the response was already
+// known to be invalid), an *invalidBoardError is returned and the export is
+// left in a temporary file for quarantining.
+func saveBoard(r io.Reader, invalid error, id, fn string, prev *boardSummary) (*boardScan, error) {
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".download-*")
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	s, err := streamBoard(io.MultiWriter(f, h), r)
+	if errors.As(err, new(*streamError)) {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	fi, cerr := f.Stat()
+	if cerr != nil {
+		os.Remove(f.Name())
+		return nil, cerr
+	}
+	if cerr := f.Chmod(0644); cerr != nil {
+		os.Remove(f.Name())
+		return nil, cerr
+	}
+	if cerr := f.Close(); cerr != nil {
+		os.Remove(f.Name())
+		return nil, cerr
+	}
+
+	if invalid != nil {
+		err = invalid
+	} else if err == nil {
+		err = validateBoard(s.boardSummary, id, prev)
+	}
+	if err != nil {
+		return nil, &invalidBoardError{f.Name(), err}
+	}
+
+	if err := os.Rename(f.Name(), fn); err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	s.SHA256 = hex.EncodeToString(h.Sum(nil))
+	s.Size = fi.Size()
+	return s, nil
+}
+
+// invalidBoardError is returned by saveBoard if the export is not valid.
+type invalidBoardError struct {
+	tmp string
+	err error
+}
+
+func (e *invalidBoardError) Error() string {
+	return e.err.Error()
+}
+
+// assetPath gets the path an attachment or background (t) is saved to.
+func assetPath(t, au string) (string, error) {
+	u, err := url.Parse(au)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(t, strings.Replace(u.Path, "/", "_", -1)), nil
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// boardDoc is the subset of a board export used by trellobackup.
+type boardDoc struct {
+	ID, Name, Desc, URL, ShortURL string
+	Closed                        bool
+	Labels                        []boardLabel
+	Lists                         []boardList
+	Cards                         []boardCard
+	Checklists                    []boardChecklist
+	Actions                       []boardAction
+	Members                       []boardMember
+}
+
+type boardMember struct {
+	ID, Username, FullName string
+}
+
+type boardLabel struct {
+	ID, Name, Color string
+}
+
+type boardList struct {
+	ID, Name string
+	Closed   bool
+	Pos      float64
+}
+
+type boardCard struct {
+	ID, Name, Desc, IDList, ShortURL string
+	IDLabels                         []string
+	Closed                           bool
+	Pos                              float64
+	Due                              *time.Time
+	DueComplete                      bool
+	Attachments                      []boardAttachment
+}
+
+type boardAttachment struct {
+	ID, Name, URL, MimeType, IDMember string
+	Bytes                             *int64
+	Date                              time.Time
+	IsUpload                          bool
+}
+
+type boardChecklist struct {
+	ID, Name, IDCard string
+	Pos              float64
+	CheckItems       []struct {
+		ID, Name, State string
+		Pos             float64
+	}
+}
+
+type boardAction struct {
+	ID, Type      string
+	Date          time.Time
+	Data          json.RawMessage
+	MemberCreator struct {
+		ID, Username, FullName string
+	}
+}
+
+// loadBoard reads a board export.
+func loadBoard(fn string) (*boardDoc, error) {
+	buf, err := readSnapshot(fn)
+	if err != nil {
+		return nil, err
+	}
+	return parseBoard(buf)
+}
+
+// parseBoard parses a board export.
+func parseBoard(buf []byte) (*boardDoc, error) {
+	var b boardDoc
+	if err := json.Unmarshal(buf, &b); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return &b, nil
+}
+
+// Member returns the member with the specified ID, or nil.
+func (b *boardDoc) Member(id string) *boardMember {
+	for i := range b.Members {
+		if b.Members[i].ID == id {
+			return &b.Members[i]
+		}
+	}
+	return nil
+}
+
+// List returns the list with the specified ID, or nil.
+func (b *boardDoc) List(id string) *boardList {
+	for i := range b.Lists {
+		if b.Lists[i].ID == id {
+			return &b.Lists[i]
+		}
+	}
+	return nil
+}
+
+// Label returns the label with the specified ID, or nil.
+func (b *boardDoc) Label(id string) *boardLabel {
+	for i := range b.Labels {
+		if b.Labels[i].ID == id {
+			return &b.Labels[i]
+		}
+	}
+	return nil
+}
+
+// SortedLists returns the lists in board order.
+func (b *boardDoc) SortedLists() []boardList {
+	ls := append([]boardList(nil), b.Lists...)
+	sort.SliceStable(ls, func(i, j int) bool {
+		return ls[i].Pos < ls[j].Pos
+	})
+	return ls
+}
+
+// SortedCards returns the cards in the list in board order.
+func (b *boardDoc) SortedCards(idList string) []boardCard {
+	var cs []boardCard
+	for _, c := range b.Cards {
+		if c.IDList == idList {
+			cs = append(cs, c)
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].Pos < cs[j].Pos
+	})
+	return cs
+}
+
+// CardChecklists returns the checklists on the card in board order.
+func (b *boardDoc) CardChecklists(idCard string) []boardChecklist {
+	var cls []boardChecklist
+	for _, cl := range b.Checklists {
+		if cl.IDCard == idCard {
+			cls = append(cls, cl)
+		}
+	}
+	sort.SliceStable(cls, func(i, j int) bool {
+		return cls[i].Pos < cls[j].Pos
+	})
+	return cls
+}
+
+// Comments returns the comment actions on the card, oldest first.
+func (b *boardDoc) Comments(idCard string) []boardComment {
+	var cs []boardComment
+	for _, a := range b.Actions {
+		if a.Type != "commentCard" {
+			continue
+		}
+		var d struct {
+			Text string
+			Card struct{ ID string }
+		}
+		if json.Unmarshal(a.Data, &d) == nil && d.Card.ID == idCard {
+			cs = append(cs, boardComment{a.Date, a.MemberCreator.FullName, d.Text})
+		}
+	}
+	sort.SliceStable(cs, func(i, j int) bool {
+		return cs[i].Date.Before(cs[j].Date)
+	})
+	return cs
+}
+
+type boardComment struct {
+	Date   time.Time
+	Author string
+	Text   string
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+)
+
+// exportLimits are the maximum number of items in each collection included in
+// a board's JSON export. If an export reaches one, it is probably truncated.
+var exportLimits = map[string]int{
+	"actions": 1000,
+}
+
+// apiPageSize is the maximum number of items the API will return per request.
+const apiPageSize = 1000
+
+// boardResources are the API resources a board export is assembled from by
+// exportBoardAPI. Paged resources are requested in pages of apiPageSize,
+// newest first.
+var boardResources = []struct {
+	Key    string
+	Path   string
+	Params url.Values
+	Paged  bool
+}{
+	{"actions", "actions", url.Values{"filter": {"all"}}, true},
+	{"cards", "cards", url.Values{"filter": {"all"}, "attachments": {"true"}, "attachment_fields": {"all"}, "customFieldItems": {"true"}}, true},
+	{"checklists", "checklists", url.Values{"filter": {"all"}}, false},
+	{"labels", "labels", url.Values{"limit": {strconv.Itoa(apiPageSize)}}, false},
+	{"lists", "lists", url.Values{"filter": {"all"}}, false},
+	{"members", "members", nil, false},
+	{"customFields", "customFields", nil, false},
+}
+
+// truncated checks whether a board export reached any of the exportLimits.
+func (s boardSummary) truncated() bool {
+	for k, n := range exportLimits {
+		if s.Counts[k] >= n {
+			return true
+		}
+	}
+	return false
+}
+
+// exportBoardAPI assembles a board export from the API and writes it to w in
+// the same format as the JSON export. Unlike the JSON export, it isn't limited
+// in size, but it takes many more requests.
+func exportBoardAPI(c *http.Client, id string, w io.Writer) error {
+	var board map[string]json.RawMessage
+	if err := apiRequest(c, http.MethodGet, "boards/"+url.PathEscape(id), url.Values{"fields": {"all"}}, &board); err != nil {
+		return fmt.Errorf("get board: %w", err)
+	}
+	for _, r := range boardResources {
+		delete(board, r.Key)
+	}
+
+	keys := make([]string, 0, len(board))
+	for k := range board {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	bw := bufio.NewWriter(w)
+	bw.WriteByte('{')
+	for _, k := range keys {
+		kb, _ := json.Marshal(k)
+		bw.Write(kb)
+		bw.WriteByte(':')
+		bw.Write(board[k])
+		bw.WriteByte(',')
+	}
+	for i, r := range boardResources {
+		if i != 0 {
+			bw.WriteByte(',')
+		}
+		fmt.Fprintf(bw, "%q:[", r.Key)
+		var n int
+		if err := getBoardResource(c, id, r.Path, r.Params, r.Paged, func(item json.RawMessage) error {
+			if n != 0 {
+				bw.WriteByte(',')
+			}
+			n++
+			_, err := bw.Write(item)
+			return err
+		}); err != nil {
+			return fmt.Errorf("get board %s: %w", r.Key, err)
+		}
+		bw.WriteByte(']')
+	}
+	bw.WriteByte('}')
+	return bw.Flush()
+}
+
+// getBoardResource calls fn for each item in a board resource. If paged, the
+// items are requested in pages using the oldest ID from the previous page.
+func getBoardResource(c *http.Client, id, path string, params url.Values, paged bool, fn func(json.RawMessage) error) error {
+	var before string
+	for {
+		q := url.Values{}
+		for k, v := range params {
+			q[k] = v
+		}
+		if paged {
+			q.Set("limit", strconv.Itoa(apiPageSize))
+			if before != "" {
+				q.Set("before", before)
+			}
+		}
+
+		var page []json.RawMessage
+		if err := apiRequest(c, http.MethodGet, "boards/"+url.PathEscape(id)+"/"+path, q, &page); err != nil {
+			return err
+		}
+
+		oldest := before
+		for _, item := range page {
+			var v struct{ ID string }
+			if err := json.Unmarshal(item, &v); err != nil {
+				return fmt.Errorf("decode json: %w", err)
+			}
+			if before != "" && v.ID >= before {
+				continue // already seen
+			}
+			if err := fn(item); err != nil {
+				return err
+			}
+			if oldest == "" || v.ID < oldest {
+				oldest = v.ID
+			}
+		}
+
+		if !paged || len(page) < apiPageSize || oldest == before {
+			return nil
+		}
+		before = oldest
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeBoardAPI serves a board with Actions actions from the API (newest
+// first, in pages), and its JSON export (with the newest 1000 actions).
+type fakeBoardAPI struct {
+	*httptest.Server
+	Actions   int
+	Inclusive bool // whether the page before an ID includes it, to check duplicates are skipped
+
+	mu       sync.Mutex
+	requests []string // paths and queries
+}
+
+const testBoardID = "5f0000000000000000000001"
+
+func newFakeBoardAPI(actions int) *fakeBoardAPI {
+	f := &fakeBoardAPI{Actions: actions}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.requests = append(f.requests, r.URL.Path+"?"+r.URL.RawQuery)
+		f.mu.Unlock()
+
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/b/abc.json":
+			n := f.Actions
+			if n > exportLimits["actions"] {
+				n = exportLimits["actions"]
+			}
+			fmt.Fprintf(w, `{"id":%q,"name":"Board","actions":%s,"cards":[%s],"checklists":[],"labels":[],"lists":[{"id":"l1","name":"List"}],"members":[],"customFields":[]}`, testBoardID, f.actions(f.Actions, "", n), testBoardCard)
+		case "/1/boards/" + testBoardID:
+			fmt.Fprintf(w, `{"id":%q,"name":"Board","prefs":{"background":"blue"},"actions":"ignored"}`, testBoardID)
+		case "/1/boards/" + testBoardID + "/actions":
+			limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+			if limit > apiPageSize || limit == 0 {
+				limit = apiPageSize
+			}
+			fmt.Fprint(w, f.actions(f.Actions, r.URL.Query().Get("before"), limit))
+		case "/1/boards/" + testBoardID + "/cards":
+			fmt.Fprint(w, `[`+testBoardCard+`]`)
+		case "/1/boards/" + testBoardID + "/lists":
+			fmt.Fprint(w, `[{"id":"l1","name":"List"}]`)
+		case "/1/boards/" + testBoardID + "/checklists", "/1/boards/" + testBoardID + "/labels", "/1/boards/" + testBoardID + "/members", "/1/boards/" + testBoardID + "/customFields":
+			fmt.Fprint(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return f
+}
+
+const testBoardCard = `{"id":"5f00000000000000000000c1","name":"Card","idList":"l1","attachments":[]}`
+
+// testActionID is the ID of the ith action (the higher, the newer).
+func testActionID(i int) string {
+	return fmt.Sprintf("%024x", i)
+}
+
+// actions returns up to limit of the n actions older than before, newest
+// first.
+func (f *fakeBoardAPI) actions(n int, before string, limit int) string {
+	var as []string
+	for i := n; i > 0 && len(as) < limit; i-- {
+		if id := testActionID(i); before == "" || id < before || (f.Inclusive && id == before) {
+			as = append(as, fmt.Sprintf(`{"id":%q,"type":"commentCard","data":{"text":"%d"}}`, id, i))
+		}
+	}
+	return "[" + strings.Join(as, ",") + "]"
+}
+
+// Requests returns the requests since the last call.
+func (f *fakeBoardAPI) Requests() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	res := f.requests
+	f.requests = nil
+	return res
+}
+
+// Client returns a client which sends requests for trello.com to f.
+func (f *fakeBoardAPI) Client() *http.Client {
+	u, _ := url.Parse(f.URL)
+	return &http.Client{Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		if isTrelloURL(req.URL) {
+			req = req.Clone(req.Context())
+			req.URL.Scheme, req.URL.Host = u.Scheme, u.Host
+		}
+		return http.DefaultTransport.RoundTrip(req)
+	})}
+}
+
+func TestGetBoardResource(t *testing.T) {
+	for _, c := range []struct {
+		Actions   int
+		Inclusive bool
+		Pages     int
+	}{
+		{0, false, 1},
+		{999, false, 1},
+		{1000, false, 2}, // the second page is empty
+		{2500, false, 3},
+		{2500, true, 3},
+		{3000, true, 4},
+	} {
+		t.Run(fmt.Sprintf("Actions=%d,Inclusive=%t", c.Actions, c.Inclusive), func(t *testing.T) {
+			f := newFakeBoardAPI(c.Actions)
+			f.Inclusive = c.Inclusive
+			defer f.Close()
+
+			var ids []string
+			if err := getBoardResource(f.Client(), testBoardID, "actions", url.Values{"filter": {"all"}}, true, func(item json.RawMessage) error {
+				var v struct{ ID string }
+				if err := json.Unmarshal(item, &v); err != nil {
+					return err
+				}
+				ids = append(ids, v.ID)
+				return nil
+			}); err != nil {
+				t.Fatalf("get actions: %v", err)
+			}
+
+			if len(ids) != c.Actions {
+				t.Errorf("expected %d actions, got %d", c.Actions, len(ids))
+			}
+			if !sort.IsSorted(sort.Reverse(sort.StringSlice(ids))) {
+				t.Errorf("expected the actions newest first")
+			}
+			for i := 1; i < len(ids); i++ {
+				if ids[i] == ids[i-1] {
+					t.Errorf("duplicate action %s", ids[i])
+				}
+			}
+
+			reqs := f.Requests()
+			if len(reqs) != c.Pages {
+				t.Fatalf("expected %d requests, got %d: %v", c.Pages, len(reqs), reqs)
+			}
+			for i, r := range reqs {
+				q, _ := url.ParseQuery(r[strings.Index(r, "?")+1:])
+				if q.Get("filter") != "all" || q.Get("limit") != strconv.Itoa(apiPageSize) {
+					t.Errorf("request %d: expected the params and limit, got %s", i, r)
+				}
+				if i == 0 && q.Get("before") != "" {
+					t.Errorf("request %d: expected no before, got %s", i, r)
+				} else if i != 0 && !c.Inclusive && q.Get("before") != testActionID(c.Actions-i*apiPageSize+1) {
+					t.Errorf("request %d: expected it to be before the oldest action so far, got %s", i, r)
+				}
+			}
+		})
+	}
+}
+
+func TestExportBoardAPI(t *testing.T) {
+	f := newFakeBoardAPI(1500)
+	defer f.Close()
+
+	var buf strings.Builder
+	if err := exportBoardAPI(f.Client(), testBoardID, &buf); err != nil {
+		t.Fatalf("export: %v", err)
+	}
+
+	var board map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(buf.String()), &board); err != nil {
+		t.Fatalf("export isn't valid json: %v\n%s", err, buf.String())
+	}
+	if string(board["id"]) != `"`+testBoardID+`"` || string(board["prefs"]) != `{"background":"blue"}` {
+		t.Errorf("expected the board fields to be included, got %s %s", board["id"], board["prefs"])
+	}
+	for _, r := range boardResources {
+		var items []json.RawMessage
+		if err := json.Unmarshal(board[r.Key], &items); err != nil {
+			t.Errorf("expected %s to be an array: %v", r.Key, err)
+		}
+		exp := map[string]int{"actions": 1500, "cards": 1, "lists": 1}[r.Key]
+		if len(items) != exp {
+			t.Errorf("expected %d %s, got %d", exp, r.Key, len(items))
+		}
+	}
+
+	s, err := scanBoard(strings.NewReader(buf.String()))
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if err := validateBoard(s.boardSummary, testBoardID, nil); err != nil {
+		t.Errorf("expected a valid export: %v", err)
+	}
+}
+
+func TestBoardSummaryTruncated(t *testing.T) {
+	for n, exp := range map[int]bool{0: false, 999: false, 1000: true, 1500: true} {
+		if act := (boardSummary{Counts: map[string]int{"actions": n, "cards": 5000}}).truncated(); act != exp {
+			t.Errorf("%d actions: expected truncated=%t, got %t", n, exp, act)
+		}
+	}
+}
+
+// TestBackupBoardExportAuto checks that the JSON export is only downloaded
+// until it's known to be truncated for a board.
+func TestBackupBoardExportAuto(t *testing.T) {
+	defer testCanonicalDir(t)()
+
+	f := newFakeBoardAPI(500)
+	defer f.Close()
+	cat, err := openCatalog(".", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cat.Close()
+	ac, err := loadAssetCache(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, err := loadStoreConfig(".")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	board := boardInfo{ShortURL: "https://trello.com/b/abc", ShortLink: "abc", ID: testBoardID, Name: "Board"}
+	for i, c := range []struct {
+		Actions int
+		JSON    bool // whether the JSON export is downloaded
+		API     bool // whether the board is saved from the API
+	}{
+		{500, true, false},
+		{1200, true, true},  // truncated
+		{1300, false, true}, // the previous one was truncated
+		{1400, false, true},
+	} {
+		f.Actions = c.Actions
+
+		tt := newThrottleTransport(f.Client().Transport, 0, 0)
+		r := &backupRun{
+			c:        &http.Client{Transport: tt},
+			tt:       tt,
+			cat:      cat,
+			ac:       ac,
+			cfg:      cfg,
+			m:        &runManifest{ID: fmt.Sprintf("%08x", i)},
+			username: "user",
+			export:   "auto",
+		}
+		if ok, err := r.backupBoard(board); err != nil || !ok {
+			t.Fatalf("run %d: backup: %v", i, err)
+		}
+		if r.failed != 0 {
+			t.Fatalf("run %d: board failed", i)
+		}
+
+		var export, api bool
+		for _, req := range f.Requests() {
+			export = export || strings.HasPrefix(req, "/b/abc.json?")
+			api = api || strings.HasPrefix(req, "/1/boards/"+testBoardID+"/actions?")
+		}
+		if export != c.JSON || api != c.API {
+			t.Errorf("run %d: expected json=%t api=%t, got json=%t api=%t", i, c.JSON, c.API, export, api)
+		}
+
+		ss, err := cat.Snapshots(testBoardID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := ss[len(ss)-1].Counts["actions"]; n != c.Actions {
+			t.Errorf("run %d: expected all %d actions to be saved, got %d", i, c.Actions, n)
+		}
+	}
+}
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"text/tabwriter"
+	"time"
+)
+
+// boardListing is a row in the output of boards list.
+type boardListing struct {
+	ID           string     `json:"id"`
+	ShortLink    string     `json:"shortLink"`
+	Name         string     `json:"name"`
+	Workspace    string     `json:"workspace,omitempty"`
+	Closed       bool       `json:"closed"`
+	LastActivity *time.Time `json:"lastActivity"`
+	Members      int        `json:"members"`
+	Cards        *int       `json:"cards"`
+	LastBackup   *time.Time `json:"lastBackup"`
+}
+
+func boardsListCommand(args []string) {
+	fs := flag.NewFlagSet("boards list", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory to get the last backup time from (default: current directory)")
+	format := fs.String("format", "table", "output format (table, json, csv)")
+	cards := fs.Bool("cards", true, "count the open cards on each board (one request per board)")
+	var af authFlags
+	af.Register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup boards list [options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+		af.PrintNotes(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if !af.ValidArgs(fs.Args()) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var write func(io.Writer, []boardListing) error
+	switch *format {
+	case "table":
+		write = writeBoardsTable
+	case "json":
+		write = writeBoardsJSON
+	case "csv":
+		write = writeBoardsCSV
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unsupported format %q\n", *format)
+		os.Exit(2)
+	}
+
+	// keep the progress messages out of the output
+	auth, err := af.Authenticator(fs.Args(), os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	chdir(*dir)
+
+	c, err := newClient(auth, os.Stderr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	boards, err := getBoards(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get boards: %v\n", err)
+		os.Exit(1)
+	}
+
+	ss, err := listSnapshots(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	lastBackup := map[string]time.Time{}
+	for _, s := range ss {
+		lastBackup[s.BoardID] = s.Time // sorted oldest first
+	}
+
+	ls := make([]boardListing, len(boards))
+	for i, board := range boards {
+		ls[i] = boardListing{
+			ID:           board.ID,
+			ShortLink:    board.ShortLink,
+			Name:         board.Name,
+			Closed:       board.Closed,
+			LastActivity: board.DateLastActivity,
+			Members:      len(board.Memberships),
+		}
+		if board.Organization != nil {
+			ls[i].Workspace = board.Organization.DisplayName
+		}
+		if t, ok := lastBackup[board.ID]; ok {
+			ls[i].LastBackup = &t
+		}
+		if *cards {
+			n, err := getCardCount(c, board.ID)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not count cards on %s: %v\n", board.Name, err)
+				os.Exit(1)
+			}
+			ls[i].Cards = &n
+		}
+	}
+
+	if err := write(os.Stdout, ls); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not write output: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// getCardCount gets the number of open cards on a board.
+func getCardCount(c *http.Client, id string) (int, error) {
+	var cards []struct{}
+	if err := apiRequest(c, http.MethodGet, "boards/"+url.PathEscape(id)+"/cards/open", url.Values{"fields": {"id"}}, &cards); err != nil {
+		return 0, err
+	}
+	return len(cards), nil
+}
+
+func writeBoardsTable(w io.Writer, ls []boardListing) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSHORTLINK\tNAME\tWORKSPACE\tCLOSED\tLAST ACTIVITY\tMEMBERS\tCARDS\tLAST BACKUP")
+	for _, l := range ls {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			l.ID, l.ShortLink, l.Name, orDash(l.Workspace), yesNo(l.Closed),
+			formatOptTime(l.LastActivity, "-"), l.Members, formatOptInt(l.Cards, "-"), formatOptTime(l.LastBackup, "never"))
+	}
+	return tw.Flush()
+}
+
+func writeBoardsJSON(w io.Writer, ls []boardListing) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(ls)
+}
+
+func writeBoardsCSV(w io.Writer, ls []boardListing) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"id", "shortLink", "name", "workspace", "closed", "lastActivity", "members", "cards", "lastBackup"})
+	for _, l := range ls {
+		cw.Write([]string{
+			l.ID, l.ShortLink, l.Name, l.Workspace, strconv.FormatBool(l.Closed),
+			formatOptTime(l.LastActivity, ""), strconv.Itoa(l.Members), formatOptInt(l.Cards, ""), formatOptTime(l.LastBackup, ""),
+		})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func formatOptTime(t *time.Time, def string) string {
+	if t == nil {
+		return def
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+func formatOptInt(n *int, def string) string {
+	if n == nil {
+		return def
+	}
+	return strconv.Itoa(*n)
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
+
+func boardsHistoryCommand(args []string) {
+	fs := flag.NewFlagSet("boards history", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup boards history [options] BOARD")
+		fmt.Fprintln(fs.Output(), "Note: BOARD can be a board ID or short link.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	chdir(*dir)
+
+	cat, err := openCatalog(".", true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cat.Close()
+
+	b, err := cat.Board(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+		os.Exit(1)
+	}
+	if b == nil {
+		b = &catalogBoard{ID: fs.Arg(0)} // may have uncataloged snapshots
+	}
+
+	ls, err := listCatalogSnapshots(".", b.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	fails, err := cat.Failures(b.ID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	if len(ls) == 0 && len(fails) == 0 {
+		fmt.Fprintf(os.Stderr, "Error: no history for board %q\n", fs.Arg(0))
+		os.Exit(1)
+	}
+	if b.Name == "" && len(ls) != 0 {
+		b.Name = ls[len(ls)-1].BoardName
+	}
+
+	type event struct {
+		Time   time.Time
+		ID     string
+		Status string
+		Detail string
+	}
+	var es []event
+	for _, l := range ls {
+		detail := l.File
+		if l.Counts != nil {
+			detail = fmt.Sprintf("cards=%d lists=%d actions=%d  %s", l.Counts["cards"], l.Counts["lists"], l.Counts["actions"], l.File)
+		}
+		es = append(es, event{l.Time, l.ID, l.Status, detail})
+	}
+	for _, f := range fails {
+		es = append(es, event{f.Time, "", "failed", f.Error})
+	}
+	sort.SliceStable(es, func(i, j int) bool {
+		return es[i].Time.Before(es[j].Time)
+	})
+
+	fmt.Printf("Board:        %s (id: %s)\n", b.Name, b.ID)
+	if b.LastSuccess != nil {
+		fmt.Printf("Last backup:  %s (snapshot %s)\n", formatOptTime(b.LastSuccess, ""), b.LastSnapshot)
+	} else {
+		fmt.Printf("Last backup:  never (in the catalog)\n")
+	}
+	fmt.Printf("Last failure: %s\n", formatOptTime(b.LastFailure, "never"))
+	if b.Vanished != nil {
+		fmt.Printf("Missing:      since %s (deleted, or no longer accessible)\n", formatOptTime(b.Vanished, ""))
+	}
+	fmt.Println()
+	for _, e := range es {
+		fmt.Printf("%s  %-8s  %-11s  %s\n", e.Time.UTC().Format(time.RFC3339), orDash(e.ID), e.Status, e.Detail)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// assetCache is the index of the HTTP validators for downloaded attachments
+// and backgrounds, saved in the store directory.
+type assetCache struct {
+	Assets map[string]assetCacheEntry `json:"assets"` // by slash-separated path
+}
+
+type assetCacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	MD5          string `json:"md5,omitempty"` // only if verified against an S3 ETag
+}
+
+// loadAssetCache loads the asset cache for the backup directory dir. If there
+// isn't one, an empty one is returned.
+func loadAssetCache(dir string) (*assetCache, error) {
+	ac := &assetCache{
+		Assets: map[string]assetCacheEntry{},
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, storeDir, "assets.json"))
+	if os.IsNotExist(err) {
+		return ac, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, ac); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if ac.Assets == nil {
+		ac.Assets = map[string]assetCacheEntry{}
+	}
+	return ac, nil
+}
+
+// save writes the asset cache for the backup directory dir.
+func (ac *assetCache) save(dir string) error {
+	buf, err := json.MarshalIndent(ac, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, storeDir), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, storeDir, "assets.json"), buf, 0644)
+}
+
+// Check checks whether the file for an asset still matches the MD5 it was
+// downloaded with. If it wasn't verified when downloaded, it returns true.
+func (ac *assetCache) Check(fn string) (bool, error) {
+	e, ok := ac.Assets[filepath.ToSlash(fn)]
+	if !ok || e.MD5 == "" {
+		return true, nil
+	}
+	sum, err := fileMD5(fn)
+	if err != nil {
+		return false, err
+	}
+	return sum == e.MD5, nil
+}
+
+// assetResult is the result of fetchAsset.
+type assetResult int
+
+const (
+	assetUnchanged assetResult = iota
+	assetNew
+	assetChanged   // changed on the server
+	assetCorrupted // local copy didn't match the MD5
+)
+
+// fetchAsset downloads u to fn if it isn't already up to date. If fn exists,
+// the request is made conditional using the validators from the cache, or if
+// it was downloaded before the cache was added, the MD5 (which S3 uses as the
+// ETag for single-part uploads), in which case it is only reported as changed
+// if the downloaded file is different. Downloads from S3 are verified against
+// the ETag if it is an MD5.
+func fetchAsset(c *http.Client, ac *assetCache, u, fn string) (assetResult, error) {
+	key := filepath.ToSlash(fn)
+	e, cached := ac.Assets[key]
+
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	res := assetNew
+	var sum string
+	if _, err := os.Stat(fn); err == nil {
+		res = assetChanged
+		if ok, err := ac.Check(fn); err != nil {
+			return 0, err
+		} else if !ok {
+			res = assetCorrupted
+		} else if cached && e.URL == u {
+			if e.ETag != "" {
+				req.Header.Set("If-None-Match", e.ETag)
+			}
+			if e.LastModified != "" {
+				req.Header.Set("If-Modified-Since", e.LastModified)
+			}
+		} else if !cached {
+			if sum, err = fileMD5(fn); err != nil {
+				return 0, err
+			}
+			req.Header.Set("If-None-Match", `"`+sum+`"`)
+		}
+	} else if !os.IsNotExist(err) {
+		return 0, err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		if !cached {
+			e = assetCacheEntry{URL: u}
+			if want, ok := s3MD5(resp); ok && want == sum {
+				e.MD5 = want
+			}
+		}
+		if etag := resp.Header.Get("ETag"); etag != "" {
+			e.ETag = etag
+		}
+		if lm := resp.Header.Get("Last-Modified"); lm != "" {
+			e.LastModified = lm
+		}
+		ac.Assets[key] = e
+		return assetUnchanged, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("response status %s", resp.Status)
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return 0, err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".download-*")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), resp.Body); err != nil {
+		return 0, err
+	}
+
+	got := hex.EncodeToString(h.Sum(nil))
+	e = assetCacheEntry{
+		URL:          u,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+	if want, ok := s3MD5(resp); ok {
+		if got != want {
+			return 0, fmt.Errorf("md5 mismatch: expected %s, got %s", want, got)
+		}
+		e.MD5 = want
+	}
+	if res == assetChanged && sum != "" && got == sum {
+		res = assetUnchanged // just seeding the cache (e.g., the ETag is for a multipart upload, so it isn't the MD5)
+	}
+
+	if err := f.Chmod(0644); err != nil {
+		return 0, err
+	}
+	if err := f.Close(); err != nil {
+		return 0, err
+	}
+	if err := os.Rename(f.Name(), fn); err != nil {
+		return 0, err
+	}
+	ac.Assets[key] = e
+	return res, nil
+}
+
+var s3MD5ETagRe = regexp.MustCompile(`^"([0-9a-f]{32})"$`)
+
+// s3MD5 gets the MD5 from the ETag of a response from S3. Multipart uploads
+// have a different kind of ETag, so they can't be verified.
+func s3MD5(resp *http.Response) (string, bool) {
+	if !strings.HasSuffix(resp.Request.URL.Hostname(), ".amazonaws.com") {
+		return "", false
+	}
+	m := s3MD5ETagRe.FindStringSubmatch(resp.Header.Get("ETag"))
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+func fileMD5(fn string) (string, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := md5.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFetchAssetSeed(t *testing.T) {
+	content := "attachment"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		const etag = `"0123456789abcdef0123456789abcdef-2"` // multipart upload
+		w.Header().Set("ETag", etag)
+		if r.Header.Get("If-None-Match") == etag {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Write([]byte(content))
+	}))
+	defer srv.Close()
+
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "file.pdf")
+	if err := ioutil.WriteFile(fn, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	ac := &assetCache{Assets: map[string]assetCacheEntry{}}
+	if res, err := fetchAsset(srv.Client(), ac, srv.URL, fn); err != nil {
+		t.Fatalf("fetch: %v", err)
+	} else if res != assetUnchanged {
+		t.Errorf("expected an existing file without a cache entry to be unchanged, got %d", res)
+	}
+	if e, ok := ac.Assets[filepath.ToSlash(fn)]; !ok || e.ETag == "" {
+		t.Errorf("expected the cache to be seeded, got %+v", e)
+	}
+
+	if res, err := fetchAsset(srv.Client(), ac, srv.URL, fn); err != nil {
+		t.Fatalf("fetch: %v", err)
+	} else if res != assetUnchanged {
+		t.Errorf("expected cached file to be unchanged, got %d", res)
+	}
+
+	content = "changed"
+	delete(ac.Assets, filepath.ToSlash(fn))
+	if res, err := fetchAsset(srv.Client(), ac, srv.URL, fn); err != nil {
+		t.Fatalf("fetch: %v", err)
+	} else if res != assetChanged {
+		t.Errorf("expected a different file to be changed, got %d", res)
+	}
+	if buf, _ := ioutil.ReadFile(fn); string(buf) != content {
+		t.Errorf("expected the file to be updated, got %q", buf)
+	}
+}
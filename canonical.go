@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// In the canonical format, snapshots are saved as pretty-printed JSON with
+// sorted object keys and sorted arrays, so the same board is always saved the
+// same way and snapshots can be diffed. The export as downloaded is kept
+// (gzipped) in the store directory as raw/NAME.json.gz.
+
+// volatileFields are the object keys removed by -strip-volatile since they
+// change between requests without the board changing.
+var volatileFields = map[string]bool{
+	"limits":       true,
+	"dateLastView": true,
+}
+
+// rawSnapshotPath gets the path to save the raw export of the snapshot fn to.
+func rawSnapshotPath(fn string) string {
+	return filepath.Join(storeDir, "raw", filepath.Base(fn)+".gz")
+}
+
+// canonicalizeSnapshot saves the raw export of the snapshot fn, then rewrites
+// it in the canonical format, updating the hash and size in b.
+//
+// Unlike saving the export, this needs the whole board in memory, since the
+// arrays are sorted. The raw export is streamed, but the decoded board and the
+// canonical JSON are held in memory, which peaks at about 8 times the size of
+// the export.
+func canonicalizeSnapshot(fn string, strip bool, b *boardScan) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if err := saveRawSnapshot(rawSnapshotPath(fn), f); err != nil {
+		return fmt.Errorf("save raw export: %w", err)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	doc, err := decodeSnapshot(f)
+	if err != nil {
+		return err
+	}
+	f.Close()
+
+	buf, err := canonicalJSON(doc, strip)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(fn, buf); err != nil {
+		return err
+	}
+
+	sum := sha256.Sum256(buf)
+	b.SHA256, b.Size = hex.EncodeToString(sum[:]), int64(len(buf))
+	return nil
+}
+
+// saveRawSnapshot gzips r to fn.
+func saveRawSnapshot(fn string, r io.Reader) error {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		return err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".raw-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	zw := gzip.NewWriter(f)
+	if _, err := io.Copy(zw, r); err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
+
+// canonicalJSON encodes doc (decoded with UseNumber) in the canonical format,
+// removing the volatileFields if strip is true. The object keys are sorted by
+// the encoder, and arrays of objects are sorted by canonicalizeValue.
+func canonicalJSON(doc interface{}, strip bool) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(canonicalizeValue(doc, strip)); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// canonicalizeValue sorts the arrays of objects in v which all have a pos
+// (by pos, then id) or all have an id (by id). Other arrays are left as-is
+// since their order may be significant.
+func canonicalizeValue(v interface{}, strip bool) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		for k, x := range v {
+			if strip && volatileFields[k] {
+				delete(v, k)
+			} else {
+				v[k] = canonicalizeValue(x, strip)
+			}
+		}
+	case []interface{}:
+		byPos, byID := len(v) > 1, len(v) > 1
+		pos := make([]float64, len(v))
+		id := make([]string, len(v))
+		for i, x := range v {
+			v[i] = canonicalizeValue(x, strip)
+			m, ok := v[i].(map[string]interface{})
+			if !ok {
+				byPos, byID = false, false
+				continue
+			}
+			if n, ok := m["pos"].(json.Number); !ok {
+				byPos = false
+			} else if f, err := n.Float64(); err != nil {
+				byPos = false
+			} else {
+				pos[i] = f
+			}
+			if s, ok := m["id"].(string); !ok {
+				byID = false
+			} else {
+				id[i] = s
+			}
+		}
+		if byPos || byID {
+			idx := make([]int, len(v))
+			for i := range idx {
+				idx[i] = i
+			}
+			sort.SliceStable(idx, func(i, j int) bool {
+				a, b := idx[i], idx[j]
+				if byPos && pos[a] != pos[b] {
+					return pos[a] < pos[b]
+				}
+				return id[a] < id[b]
+			})
+			s := make([]interface{}, len(v))
+			for i, j := range idx {
+				s[i] = v[j]
+			}
+			return s
+		}
+	}
+	return v
+}
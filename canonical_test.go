@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+const testRawBoard = `{"name":"Board","id":"5f0000000000000000000001","limits":{"cards":{"perBoard":{"status":"ok"}}},` +
+	`"cards":[{"name":"two","pos":2,"id":"5f00000000000000000000c2","dateLastView":"2020-01-02T00:00:00.000Z"},{"id":"5f00000000000000000000c1","pos":1,"name":"one & <b>"}],` +
+	`"labels":[{"id":"b","name":"B"},{"id":"a","name":"A"}],"idTags":["z","a"],` +
+	`"actions":[],"checklists":[],"lists":[],"members":[]}`
+
+// testCanonicalDir creates a temporary backup directory and changes to it,
+// since the raw exports are saved relative to the current directory.
+func testCanonicalDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	return func() {
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestCanonicalizeSnapshot(t *testing.T) {
+	for _, strip := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Strip=%t", strip), func(t *testing.T) {
+			defer testCanonicalDir(t)()
+
+			fn := "board.json"
+			if err := ioutil.WriteFile(fn, []byte(testRawBoard), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var b boardScan
+			if err := canonicalizeSnapshot(fn, strip, &b); err != nil {
+				t.Fatalf("canonicalize: %v", err)
+			}
+
+			f, err := os.Open(rawSnapshotPath(fn))
+			if err != nil {
+				t.Fatalf("open raw export: %v", err)
+			}
+			zr, err := gzip.NewReader(f)
+			if err != nil {
+				t.Fatalf("open raw export: %v", err)
+			}
+			raw, err := ioutil.ReadAll(zr)
+			f.Close()
+			if err != nil {
+				t.Fatalf("read raw export: %v", err)
+			} else if string(raw) != testRawBoard {
+				t.Errorf("expected the raw export to be kept as-is, got %s", raw)
+			}
+
+			buf, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if b.SHA256 != sha256Hex(buf) || b.Size != int64(len(buf)) {
+				t.Errorf("incorrect hash or size")
+			}
+
+			s := string(buf)
+			for _, x := range [][2]string{
+				{`"actions"`, `"cards"`},            // keys sorted
+				{`"one & <b>"`, `"two"`},            // sorted by pos
+				{`"name": "A"`, `"name": "B"`},      // sorted by id
+				{`"z"`, `"a"`},                      // scalars left as-is
+				{"{\n  \"actions\": [],\n", `"id"`}, // pretty-printed
+			} {
+				if i, j := strings.Index(s, x[0]), strings.Index(s, x[1]); i == -1 || j == -1 || i > j {
+					t.Errorf("expected %s before %s in:\n%s", x[0], x[1], s)
+				}
+			}
+			for _, k := range []string{`"limits"`, `"dateLastView"`} {
+				if strings.Contains(s, k) == strip {
+					t.Errorf("expected %s to be stripped=%t", k, strip)
+				}
+			}
+
+			// canonicalizing it again doesn't change it
+			if err := canonicalizeSnapshot(fn, strip, &b); err != nil {
+				t.Fatalf("canonicalize: %v", err)
+			}
+			if again, err := ioutil.ReadFile(fn); err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(again, buf) {
+				t.Errorf("canonical format isn't stable:\n%s\n%s", buf, again)
+			}
+		})
+	}
+}
+
+func TestCanonicalizeSnapshotDelta(t *testing.T) {
+	defer testCanonicalDir(t)()
+
+	fn1, fn2 := "board1.json", "board2.json"
+	big := strings.Repeat("x", 4096) // so the delta is worth it
+	for fn, name := range map[string]string{fn1: "one", fn2: "renamed"} {
+		raw := strings.Replace(strings.Replace(testRawBoard, `"one & <b>"`, `"`+name+`"`, 1), `"name":"Board"`, `"name":"Board","desc":"`+big+`"`, 1)
+		if err := ioutil.WriteFile(fn, []byte(raw), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var b1, b2 boardScan
+	if err := canonicalizeSnapshot(fn1, true, &b1); err != nil {
+		t.Fatalf("canonicalize: %v", err)
+	}
+	if err := canonicalizeSnapshot(fn2, true, &b2); err != nil {
+		t.Fatalf("canonicalize: %v", err)
+	}
+	canonical, err := ioutil.ReadFile(fn2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ok, err := storeDelta(fn2, fn1, 10); err != nil {
+		t.Fatalf("store delta: %v", err)
+	} else if !ok {
+		t.Fatalf("expected canonical snapshot to be stored as a delta")
+	}
+	if exists(fn2) || !exists(fn2+patchExt) {
+		t.Errorf("expected only the delta to be stored")
+	}
+	if !exists(rawSnapshotPath(fn2)) {
+		t.Errorf("expected the raw export to be kept")
+	}
+
+	// it's reconstructed byte-for-byte
+	doc, _, err := loadSnapshotDoc(fn2, 0)
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if buf, err := encodeSnapshot(doc); err != nil {
+		t.Fatalf("encode: %v", err)
+	} else if !bytes.Equal(buf, canonical) {
+		t.Errorf("reconstructed snapshot doesn't match:\n%s\n%s", canonical, buf)
+	}
+	if sum, size, err := snapshotSHA256(fn2); err != nil {
+		t.Fatalf("hash: %v", err)
+	} else if sum != b2.SHA256 || size != b2.Size {
+		t.Errorf("reconstructed snapshot hash doesn't match")
+	}
+}
+
+// TestCanonicalizeSnapshotMemory checks the memory cost of canonicalizing a
+// snapshot (see canonicalizeSnapshot), so it's noticed if it gets any worse.
+// The total allocations are checked since they're deterministic. They're an
+// upper bound on the memory used: the peak heap is about 8 times the size of
+// the export, and most of the rest is from growing buffers.
+func TestCanonicalizeSnapshotMemory(t *testing.T) {
+	defer testCanonicalDir(t)()
+
+	var raw bytes.Buffer
+	raw.WriteString(`{"id":"5f0000000000000000000001","actions":[],"checklists":[],"labels":[],"lists":[],"members":[],"cards":[`)
+	for i := 2000; i > 0; i-- {
+		if i != 2000 {
+			raw.WriteByte(',')
+		}
+		fmt.Fprintf(&raw, `{"id":"5f00000000000000%08x","pos":%d,"name":"Card %d","desc":"%s"}`, i, i*1024, i, strings.Repeat("lorem ipsum ", 40))
+	}
+	raw.WriteString(`]}`)
+
+	fn := "board.json"
+	if err := ioutil.WriteFile(fn, raw.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	if err := canonicalizeSnapshot(fn, false, &boardScan{}); err != nil {
+		t.Fatalf("canonicalize: %v", err)
+	}
+	runtime.ReadMemStats(&after)
+
+	if ratio := float64(after.TotalAlloc-before.TotalAlloc) / float64(raw.Len()); ratio > 30 {
+		t.Errorf("expected canonicalizing to allocate at most 30 times the size of the export, got %.1f times", ratio)
+	} else {
+		t.Logf("allocated %.1f times the size of the export", ratio)
+	}
+}
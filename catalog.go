@@ -0,0 +1,511 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// The catalog is a database in the store directory which records every run,
+// board snapshot, attachment, and failure, so questions about the history of
+// the backups can be answered without scanning the snapshots.
+//
+// Each bucket is keyed by the ID (or path for attachments, SHA-256 for blobs,
+// and time for failures), and the values are JSON. The board_snapshots bucket
+// indexes snapshots by BOARD_ID/TIME/SNAPSHOT_ID.
+var (
+	catalogRuns           = []byte("runs")
+	catalogSnapshots      = []byte("snapshots")
+	catalogBoards         = []byte("boards")
+	catalogBoardSnapshots = []byte("board_snapshots")
+	catalogAttachments    = []byte("attachments")
+	catalogBlobs          = []byte("blobs")
+	catalogFailures       = []byte("failures")
+)
+
+// catalogSnapshot is a saved version of a board.
+type catalogSnapshot struct {
+	ID          string         `json:"id"`
+	Run         string         `json:"run,omitempty"`
+	Time        time.Time      `json:"time"`
+	User        string         `json:"user,omitempty"`
+	BoardID     string         `json:"board_id"`
+	BoardName   string         `json:"board_name"`
+	File        string         `json:"file"`
+	Size        int64          `json:"size"`
+	SHA256      string         `json:"sha256"`
+	Counts      map[string]int `json:"counts"`
+	Attachments []string       `json:"attachments,omitempty"` // paths
+	Partial     bool           `json:"partial,omitempty"`     // if the run stopped before the attachments were saved
+	Protected   string         `json:"protected,omitempty"`   // why it must be kept if old snapshots are cleaned up
+	Anomalies   []string       `json:"anomalies,omitempty"`   // failed checks against the previous snapshot
+	Raw         string         `json:"raw,omitempty"`         // the export as downloaded, if the file is canonicalized
+}
+
+// catalogBoard is the latest information about a board.
+type catalogBoard struct {
+	ID           string     `json:"id"`
+	Name         string     `json:"name"`
+	ShortLink    string     `json:"short_link,omitempty"`
+	LastSnapshot string     `json:"last_snapshot,omitempty"`
+	LastSuccess  *time.Time `json:"last_success,omitempty"`
+	LastFailure  *time.Time `json:"last_failure,omitempty"`
+	Vanished     *time.Time `json:"vanished,omitempty"` // when it was first missing from the user's boards
+}
+
+// catalogAttachment is a downloaded attachment.
+type catalogAttachment struct {
+	File    string    `json:"file"`
+	ID      string    `json:"id"`
+	BoardID string    `json:"board_id"`
+	CardID  string    `json:"card_id"`
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Date    time.Time `json:"date"`
+	Size    int64     `json:"size"`
+	SHA256  string    `json:"sha256"`
+}
+
+// catalogBlob is the content of one or more attachments.
+type catalogBlob struct {
+	SHA256 string   `json:"sha256"`
+	Size   int64    `json:"size"`
+	Files  []string `json:"files"`
+}
+
+// catalogFailure is a board which couldn't be backed up.
+type catalogFailure struct {
+	Time      time.Time `json:"time"`
+	Run       string    `json:"run,omitempty"`
+	BoardID   string    `json:"board_id"`
+	BoardName string    `json:"board_name"`
+	Error     string    `json:"error"`
+	File      string    `json:"file,omitempty"` // in the quarantine directory
+}
+
+// catalog is the catalog for a backup directory. The database is only opened
+// for each transaction, so other processes (e.g., the snapshots and boards
+// commands while a backup is running) can use it in between.
+type catalog struct {
+	fn       string
+	readOnly bool
+}
+
+// catalogTimeout is how long to wait for another process to finish a
+// transaction. Since the database isn't held open between transactions, this
+// only happens if it's stuck.
+const catalogTimeout = 10 * time.Second
+
+// openCatalog opens the catalog for the backup directory dir. If readOnly is
+// true and it doesn't exist, it will be empty.
+func openCatalog(dir string, readOnly bool) (*catalog, error) {
+	c := &catalog{filepath.Join(dir, storeDir, "catalog.db"), readOnly}
+	if readOnly {
+		return c, c.view(func(*bolt.Tx) error { return nil })
+	}
+	if err := os.MkdirAll(filepath.Join(dir, storeDir), 0755); err != nil {
+		return nil, err
+	}
+	if err := c.update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{catalogRuns, catalogSnapshots, catalogBoards, catalogBoardSnapshots, catalogAttachments, catalogBlobs, catalogFailures} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Close closes the catalog. The database is only open during transactions,
+// so there's nothing to do.
+func (c *catalog) Close() error {
+	return nil
+}
+
+// PutRun adds or updates a run.
+func (c *catalog) PutRun(m *runManifest) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return putJSON(tx.Bucket(catalogRuns), m.ID, m)
+	})
+}
+
+// PutSnapshot adds or updates a snapshot, and updates the board it is for.
+func (c *catalog) PutSnapshot(s catalogSnapshot, shortLink string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(catalogSnapshots), s.ID, s); err != nil {
+			return err
+		}
+		if err := tx.Bucket(catalogBoardSnapshots).Put([]byte(s.BoardID+"/"+catalogTime(s.Time)+"/"+s.ID), []byte(s.ID)); err != nil {
+			return err
+		}
+		return updateBoard(tx, s.BoardID, func(b *catalogBoard) {
+			latest := b.LastSuccess == nil || !s.Time.Before(*b.LastSuccess)
+			if latest || b.Name == "" {
+				b.Name = s.BoardName // an ingested snapshot may be older
+			}
+			if shortLink != "" {
+				b.ShortLink = shortLink
+			}
+			if !s.Partial && latest {
+				t := s.Time
+				b.LastSuccess = &t
+				b.LastSnapshot = s.ID
+			}
+		})
+	})
+}
+
+// PutAttachment adds or updates an attachment and its blob. If the file had
+// different content before, it is removed from the old blob.
+func (c *catalog) PutAttachment(a catalogAttachment) error {
+	return c.update(func(tx *bolt.Tx) error {
+		var old catalogAttachment
+		if ok, err := getJSON(tx.Bucket(catalogAttachments), a.File, &old); err != nil {
+			return err
+		} else if ok && old.SHA256 != a.SHA256 {
+			if err := removeBlobFile(tx, old.SHA256, a.File); err != nil {
+				return err
+			}
+		}
+		if err := putJSON(tx.Bucket(catalogAttachments), a.File, a); err != nil {
+			return err
+		}
+		var b catalogBlob
+		if _, err := getJSON(tx.Bucket(catalogBlobs), a.SHA256, &b); err != nil {
+			return err
+		}
+		b.SHA256, b.Size = a.SHA256, a.Size
+		for _, fn := range b.Files {
+			if fn == a.File {
+				return nil
+			}
+		}
+		b.Files = append(b.Files, a.File)
+		return putJSON(tx.Bucket(catalogBlobs), a.SHA256, b)
+	})
+}
+
+// PutFailure adds a failure, and updates the board it is for.
+func (c *catalog) PutFailure(f catalogFailure) error {
+	return c.update(func(tx *bolt.Tx) error {
+		if err := putJSON(tx.Bucket(catalogFailures), catalogTime(f.Time)+"/"+f.BoardID, f); err != nil {
+			return err
+		}
+		return updateBoard(tx, f.BoardID, func(b *catalogBoard) {
+			if b.Name == "" {
+				b.Name = f.BoardName
+			}
+			t := f.Time
+			b.LastFailure = &t
+		})
+	})
+}
+
+// Protect marks a snapshot as protected for reason. This is only recorded in
+// the catalog, since snapshots are never deleted by trellobackup.
+func (c *catalog) Protect(id, reason string) error {
+	return c.update(func(tx *bolt.Tx) error {
+		var s catalogSnapshot
+		if ok, err := getJSON(tx.Bucket(catalogSnapshots), id, &s); err != nil {
+			return err
+		} else if !ok {
+			return fmt.Errorf("no snapshot %q", id)
+		}
+		for _, r := range strings.Split(s.Protected, "; ") {
+			if r == reason {
+				return nil
+			}
+		}
+		if s.Protected != "" {
+			s.Protected += "; "
+		}
+		s.Protected += reason
+		return putJSON(tx.Bucket(catalogSnapshots), id, s)
+	})
+}
+
+// SetVanished sets or clears (if t is nil) when a board went missing.
+func (c *catalog) SetVanished(id string, t *time.Time) error {
+	return c.update(func(tx *bolt.Tx) error {
+		return updateBoard(tx, id, func(b *catalogBoard) {
+			b.Vanished = t
+		})
+	})
+}
+
+// Attachment gets an attachment by path, or nil.
+func (c *catalog) Attachment(fn string) (*catalogAttachment, error) {
+	var a *catalogAttachment
+	err := c.view(func(tx *bolt.Tx) error {
+		var v catalogAttachment
+		if ok, err := getJSON(tx.Bucket(catalogAttachments), filepath.ToSlash(fn), &v); !ok {
+			return err
+		}
+		a = &v
+		return nil
+	})
+	return a, err
+}
+
+// Snapshot gets a snapshot by ID, or nil.
+func (c *catalog) Snapshot(id string) (*catalogSnapshot, error) {
+	var s *catalogSnapshot
+	err := c.view(func(tx *bolt.Tx) error {
+		var v catalogSnapshot
+		if ok, err := getJSON(tx.Bucket(catalogSnapshots), id, &v); !ok {
+			return err
+		}
+		s = &v
+		return nil
+	})
+	return s, err
+}
+
+// SnapshotFile gets a snapshot by its file, or nil.
+func (c *catalog) SnapshotFile(fn string) (*catalogSnapshot, error) {
+	ss, err := c.Snapshots("")
+	if err != nil {
+		return nil, err
+	}
+	for i := range ss {
+		if ss[i].File == filepath.ToSlash(filepath.Clean(fn)) {
+			return &ss[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// Snapshots gets the snapshots of a board (or all boards if empty), oldest
+// first.
+func (c *catalog) Snapshots(boardID string) ([]catalogSnapshot, error) {
+	var ss []catalogSnapshot
+	if err := c.view(func(tx *bolt.Tx) error {
+		if boardID == "" {
+			return tx.Bucket(catalogSnapshots).ForEach(func(k, v []byte) error {
+				var s catalogSnapshot
+				if err := json.Unmarshal(v, &s); err != nil {
+					return fmt.Errorf("decode snapshot %s: %w", k, err)
+				}
+				ss = append(ss, s)
+				return nil
+			})
+		}
+		prefix := []byte(boardID + "/")
+		cur := tx.Bucket(catalogBoardSnapshots).Cursor()
+		for k, v := cur.Seek(prefix); k != nil && strings.HasPrefix(string(k), string(prefix)); k, v = cur.Next() {
+			var s catalogSnapshot
+			if ok, err := getJSON(tx.Bucket(catalogSnapshots), string(v), &s); err != nil {
+				return err
+			} else if ok {
+				ss = append(ss, s)
+			}
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(ss, func(i, j int) bool {
+		return ss[i].Time.Before(ss[j].Time)
+	})
+	return ss, nil
+}
+
+// Board gets a board by ID or short link, or nil.
+func (c *catalog) Board(id string) (*catalogBoard, error) {
+	var b *catalogBoard
+	err := c.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(catalogBoards).ForEach(func(k, v []byte) error {
+			if b != nil {
+				return nil
+			}
+			var x catalogBoard
+			if err := json.Unmarshal(v, &x); err != nil {
+				return fmt.Errorf("decode board %s: %w", k, err)
+			}
+			if x.ID == id || (x.ShortLink != "" && x.ShortLink == id) {
+				b = &x
+			}
+			return nil
+		})
+	})
+	return b, err
+}
+
+// Boards gets all boards.
+func (c *catalog) Boards() ([]catalogBoard, error) {
+	var bs []catalogBoard
+	err := c.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(catalogBoards).ForEach(func(k, v []byte) error {
+			var b catalogBoard
+			if err := json.Unmarshal(v, &b); err != nil {
+				return fmt.Errorf("decode board %s: %w", k, err)
+			}
+			bs = append(bs, b)
+			return nil
+		})
+	})
+	return bs, err
+}
+
+// Failures gets the failures for a board (or all boards if empty), oldest
+// first.
+func (c *catalog) Failures(boardID string) ([]catalogFailure, error) {
+	var fs []catalogFailure
+	err := c.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(catalogFailures).ForEach(func(k, v []byte) error {
+			var f catalogFailure
+			if err := json.Unmarshal(v, &f); err != nil {
+				return fmt.Errorf("decode failure %s: %w", k, err)
+			}
+			if boardID == "" || f.BoardID == boardID {
+				fs = append(fs, f)
+			}
+			return nil
+		})
+	})
+	return fs, err
+}
+
+// Run gets a run by ID, or nil.
+func (c *catalog) Run(id string) (*runManifest, error) {
+	var m *runManifest
+	err := c.view(func(tx *bolt.Tx) error {
+		var v runManifest
+		if ok, err := getJSON(tx.Bucket(catalogRuns), id, &v); !ok {
+			return err
+		}
+		m = &v
+		return nil
+	})
+	return m, err
+}
+
+// db opens the database.
+func (c *catalog) db() (*bolt.DB, error) {
+	db, err := bolt.Open(c.fn, 0644, &bolt.Options{
+		Timeout:  catalogTimeout,
+		ReadOnly: c.readOnly,
+	})
+	if err == bolt.ErrTimeout {
+		return nil, errors.New("open catalog: in use by another process (is another command stuck?)")
+	} else if err != nil {
+		return nil, fmt.Errorf("open catalog: %w", err)
+	}
+	return db, nil
+}
+
+// update runs fn in a read-write transaction.
+func (c *catalog) update(fn func(tx *bolt.Tx) error) error {
+	if c.readOnly {
+		return errors.New("catalog is read-only")
+	}
+	db, err := c.db()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.Update(fn)
+}
+
+// view runs fn in a read-only transaction. If the catalog doesn't exist, fn
+// isn't called.
+func (c *catalog) view(fn func(tx *bolt.Tx) error) error {
+	if c.readOnly {
+		if _, err := os.Stat(c.fn); os.IsNotExist(err) {
+			return nil
+		}
+	}
+	db, err := c.db()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	return db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(catalogRuns) == nil {
+			return nil // empty
+		}
+		return fn(tx)
+	})
+}
+
+// removeBlobFile removes a file from a blob, and the blob if it was the last
+// one.
+func removeBlobFile(tx *bolt.Tx, sha256, fn string) error {
+	var b catalogBlob
+	if ok, err := getJSON(tx.Bucket(catalogBlobs), sha256, &b); !ok {
+		return err
+	}
+	fns := b.Files[:0]
+	for _, x := range b.Files {
+		if x != fn {
+			fns = append(fns, x)
+		}
+	}
+	if b.Files = fns; len(b.Files) == 0 {
+		return tx.Bucket(catalogBlobs).Delete([]byte(sha256))
+	}
+	return putJSON(tx.Bucket(catalogBlobs), sha256, b)
+}
+
+func updateBoard(tx *bolt.Tx, id string, fn func(b *catalogBoard)) error {
+	var b catalogBoard
+	if _, err := getJSON(tx.Bucket(catalogBoards), id, &b); err != nil {
+		return err
+	}
+	b.ID = id
+	fn(&b)
+	return putJSON(tx.Bucket(catalogBoards), id, b)
+}
+
+func putJSON(b *bolt.Bucket, k string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(k), buf)
+}
+
+func getJSON(b *bolt.Bucket, k string, v interface{}) (bool, error) {
+	buf := b.Get([]byte(k))
+	if buf == nil {
+		return false, nil
+	}
+	if err := json.Unmarshal(buf, v); err != nil {
+		return false, fmt.Errorf("decode %s: %w", k, err)
+	}
+	return true, nil
+}
+
+// catalogTime formats a time so it sorts correctly as a key.
+func catalogTime(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04:05.000000000Z")
+}
+
+// fileSHA256 hashes a file, returning the hash and size.
+func fileSHA256(fn string) (string, int64, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
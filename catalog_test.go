@@ -0,0 +1,276 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+func testCatalog(t *testing.T) (*catalog, string) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cat, err := openCatalog(dir, false)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("open catalog: %v", err)
+	}
+	return cat, dir
+}
+
+func TestCatalogSnapshots(t *testing.T) {
+	cat, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+	defer cat.Close()
+
+	t1, t2 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	s1 := catalogSnapshot{ID: "s1", Run: "r1", Time: t1, BoardID: "b1", BoardName: "Old", File: "one.json", Counts: map[string]int{"cards": 1}}
+	s2 := catalogSnapshot{ID: "s2", Run: "r2", Time: t2, BoardID: "b1", BoardName: "New", File: "two.json", Attachments: []string{"attachments/b1/a.txt"}}
+	s3 := catalogSnapshot{ID: "s3", Run: "r2", Time: t1, BoardID: "b2", BoardName: "Other", File: "three.json", Partial: true}
+	for _, s := range []catalogSnapshot{s2, s1, s3} { // not in order
+		if err := cat.PutSnapshot(s, "short"+s.BoardID); err != nil {
+			t.Fatalf("put snapshot: %v", err)
+		}
+	}
+
+	if s, err := cat.Snapshot("s1"); err != nil {
+		t.Fatalf("get snapshot: %v", err)
+	} else if !reflect.DeepEqual(s, &s1) {
+		t.Errorf("expected %+v, got %+v", s1, s)
+	}
+	if s, err := cat.Snapshot("nope"); err != nil || s != nil {
+		t.Errorf("expected no snapshot, got %+v (err: %v)", s, err)
+	}
+	if s, err := cat.SnapshotFile("./two.json"); err != nil {
+		t.Fatalf("get snapshot: %v", err)
+	} else if s == nil || s.ID != "s2" {
+		t.Errorf("expected snapshot s2 for the file, got %+v", s)
+	}
+
+	if ss, err := cat.Snapshots("b1"); err != nil {
+		t.Fatalf("get snapshots: %v", err)
+	} else if len(ss) != 2 || ss[0].ID != "s1" || ss[1].ID != "s2" {
+		t.Errorf("expected the board's snapshots oldest first, got %+v", ss)
+	}
+	if ss, err := cat.Snapshots(""); err != nil {
+		t.Fatalf("get snapshots: %v", err)
+	} else if len(ss) != 3 || ss[2].ID != "s2" {
+		t.Errorf("expected all snapshots oldest first, got %+v", ss)
+	}
+
+	if err := cat.Protect("s1", "because"); err != nil {
+		t.Fatalf("protect: %v", err)
+	}
+	if err := cat.Protect("s1", "because"); err != nil {
+		t.Fatalf("protect: %v", err)
+	}
+	if err := cat.Protect("s1", "another reason"); err != nil {
+		t.Fatalf("protect: %v", err)
+	}
+	if s, err := cat.Snapshot("s1"); err != nil {
+		t.Fatalf("get snapshot: %v", err)
+	} else if s.Protected != "because; another reason" {
+		t.Errorf("expected each reason to be recorded once, got %q", s.Protected)
+	}
+	if err := cat.Protect("nope", "because"); err == nil {
+		t.Errorf("expected error for a missing snapshot")
+	}
+
+	// the board is updated from the latest complete snapshot
+	if b, err := cat.Board("shortb1"); err != nil {
+		t.Fatalf("get board: %v", err)
+	} else if b == nil || b.ID != "b1" || b.Name != "New" || b.LastSnapshot != "s2" || b.LastSuccess == nil || !b.LastSuccess.Equal(t2) {
+		t.Errorf("incorrect board %+v", b)
+	}
+	if b, err := cat.Board("b2"); err != nil {
+		t.Fatalf("get board: %v", err)
+	} else if b == nil || b.Name != "Other" || b.LastSnapshot != "" || b.LastSuccess != nil {
+		t.Errorf("expected a partial snapshot not to count as a success, got %+v", b)
+	}
+	if bs, err := cat.Boards(); err != nil {
+		t.Fatalf("get boards: %v", err)
+	} else if len(bs) != 2 {
+		t.Errorf("expected 2 boards, got %d", len(bs))
+	}
+}
+
+func TestCatalogRuns(t *testing.T) {
+	cat, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+	defer cat.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	m := &runManifest{ID: "r1", Started: now, Boards: []runBoard{{ID: "b1", Name: "Board", Status: "partial"}}}
+	if err := cat.PutRun(m); err != nil {
+		t.Fatalf("put run: %v", err)
+	}
+	m.Finished, m.Complete = &now, true
+	m.SetBoard(runBoard{ID: "b1", Name: "Board", File: "one.json", Status: "done"})
+	if err := cat.PutRun(m); err != nil {
+		t.Fatalf("put run: %v", err)
+	}
+
+	if x, err := cat.Run("r1"); err != nil {
+		t.Fatalf("get run: %v", err)
+	} else if !reflect.DeepEqual(x, m) {
+		t.Errorf("expected %+v, got %+v", m, x)
+	}
+	if x, err := cat.Run("nope"); err != nil || x != nil {
+		t.Errorf("expected no run, got %+v (err: %v)", x, err)
+	}
+}
+
+func TestCatalogFailures(t *testing.T) {
+	cat, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+	defer cat.Close()
+
+	t1, t2 := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2020, 1, 2, 0, 0, 0, 0, time.UTC)
+	for _, f := range []catalogFailure{
+		{Time: t2, Run: "r2", BoardID: "b1", BoardName: "Board", Error: "second"},
+		{Time: t1, Run: "r1", BoardID: "b1", BoardName: "Board", Error: "first", File: "quarantine/one.json"},
+		{Time: t1, Run: "r1", BoardID: "b2", BoardName: "Other", Error: "other"},
+	} {
+		if err := cat.PutFailure(f); err != nil {
+			t.Fatalf("put failure: %v", err)
+		}
+	}
+
+	if fs, err := cat.Failures("b1"); err != nil {
+		t.Fatalf("get failures: %v", err)
+	} else if len(fs) != 2 || fs[0].Error != "first" || fs[0].File != "quarantine/one.json" || fs[1].Error != "second" {
+		t.Errorf("expected the board's failures oldest first, got %+v", fs)
+	}
+	if fs, err := cat.Failures(""); err != nil {
+		t.Fatalf("get failures: %v", err)
+	} else if len(fs) != 3 {
+		t.Errorf("expected 3 failures, got %d", len(fs))
+	}
+
+	if b, err := cat.Board("b1"); err != nil {
+		t.Fatalf("get board: %v", err)
+	} else if b == nil || b.Name != "Board" || b.LastFailure == nil || !b.LastFailure.Equal(t1) || b.LastSuccess != nil {
+		t.Errorf("incorrect board %+v", b)
+	}
+}
+
+func TestCatalogAttachments(t *testing.T) {
+	cat, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+	defer cat.Close()
+
+	blob := func(sha256 string) *catalogBlob {
+		var b *catalogBlob
+		if err := cat.view(func(tx *bolt.Tx) error {
+			var v catalogBlob
+			if ok, err := getJSON(tx.Bucket(catalogBlobs), sha256, &v); !ok {
+				return err
+			}
+			b = &v
+			return nil
+		}); err != nil {
+			t.Fatalf("get blob: %v", err)
+		}
+		return b
+	}
+
+	a1 := catalogAttachment{File: "attachments/b1/c1/a1.txt", ID: "a1", BoardID: "b1", CardID: "c1", Name: "a1.txt", Size: 1, SHA256: "aaaa"}
+	a2 := catalogAttachment{File: "attachments/b1/c2/a2.txt", ID: "a2", BoardID: "b1", CardID: "c2", Name: "a2.txt", Size: 1, SHA256: "aaaa"}
+	for _, a := range []catalogAttachment{a1, a2, a1} {
+		if err := cat.PutAttachment(a); err != nil {
+			t.Fatalf("put attachment: %v", err)
+		}
+	}
+
+	if a, err := cat.Attachment("attachments/b1/c1/a1.txt"); err != nil {
+		t.Fatalf("get attachment: %v", err)
+	} else if !reflect.DeepEqual(a, &a1) {
+		t.Errorf("expected %+v, got %+v", a1, a)
+	}
+	if a, err := cat.Attachment("nope"); err != nil || a != nil {
+		t.Errorf("expected no attachment, got %+v (err: %v)", a, err)
+	}
+	if b := blob("aaaa"); b == nil || !reflect.DeepEqual(b.Files, []string{a1.File, a2.File}) {
+		t.Errorf("expected both files in the blob once, got %+v", b)
+	}
+
+	// the content of a file changes
+	a1.SHA256, a1.Size = "bbbb", 2
+	if err := cat.PutAttachment(a1); err != nil {
+		t.Fatalf("put attachment: %v", err)
+	}
+	if b := blob("aaaa"); b == nil || !reflect.DeepEqual(b.Files, []string{a2.File}) {
+		t.Errorf("expected the file to be removed from the old blob, got %+v", b)
+	}
+	if b := blob("bbbb"); b == nil || b.Size != 2 || !reflect.DeepEqual(b.Files, []string{a1.File}) {
+		t.Errorf("expected the file in the new blob, got %+v", b)
+	}
+
+	a2.SHA256 = "bbbb"
+	if err := cat.PutAttachment(a2); err != nil {
+		t.Fatalf("put attachment: %v", err)
+	}
+	if b := blob("aaaa"); b != nil {
+		t.Errorf("expected the old blob to be removed once unused, got %+v", b)
+	}
+}
+
+func TestCatalogConcurrent(t *testing.T) {
+	cat, dir := testCatalog(t)
+	defer os.RemoveAll(dir)
+	defer cat.Close()
+
+	if err := cat.PutRun(&runManifest{ID: "r1"}); err != nil {
+		t.Fatalf("put run: %v", err)
+	}
+
+	// e.g., snapshots list while a backup is running
+	ro, err := openCatalog(dir, true)
+	if err != nil {
+		t.Fatalf("open catalog read-only while it's open: %v", err)
+	}
+	defer ro.Close()
+	if m, err := ro.Run("r1"); err != nil || m == nil {
+		t.Errorf("expected to read the run, got %+v (err: %v)", m, err)
+	}
+	if err := ro.PutRun(&runManifest{ID: "r2"}); err == nil {
+		t.Errorf("expected error writing to a read-only catalog")
+	}
+
+	// e.g., ingest while a backup is running
+	rw, err := openCatalog(dir, false)
+	if err != nil {
+		t.Fatalf("open catalog while it's open: %v", err)
+	}
+	defer rw.Close()
+	if err := rw.PutRun(&runManifest{ID: "r2"}); err != nil {
+		t.Fatalf("put run: %v", err)
+	}
+	if m, err := cat.Run("r2"); err != nil || m == nil {
+		t.Errorf("expected to read the run written by the other one, got %+v (err: %v)", m, err)
+	}
+}
+
+func TestCatalogMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	cat, err := openCatalog(dir, true)
+	if err != nil {
+		t.Fatalf("open catalog: %v", err)
+	}
+	if ss, err := cat.Snapshots(""); err != nil || len(ss) != 0 {
+		t.Errorf("expected no snapshots, got %v (err: %v)", ss, err)
+	}
+	if exists(cat.fn) {
+		t.Errorf("expected the catalog not to be created when read-only")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+func compactCommand(args []string) {
+	fs := flag.NewFlagSet("compact", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	storage := fs.String("storage", "", "how to store snapshots, saved for later runs: full, or delta (JSON patches from the previous snapshot, requires the canonical format) (default: the saved mode)")
+	fullEvery := fs.Int("full-every", 0, "in the delta storage mode, store a full snapshot after this many deltas, saved for later runs (default: the saved value, or "+strconv.Itoa(defaultFullEvery)+")")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup compact [options]")
+		fmt.Fprintln(fs.Output(), "Note: This rebases each board's snapshots so every delta is from the previous snapshot, with a full snapshot after every -full-every deltas. In the full storage mode, all deltas are expanded.")
+		fmt.Fprintln(fs.Output(), "Note: Snapshots which weren't saved in the canonical format are kept in full, since they wouldn't be reconstructed byte-for-byte.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	chdir(*dir)
+
+	cfg, err := loadStoreConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load config: %v\n", err)
+		os.Exit(1)
+	}
+	if (*storage != "" && *storage != cfg.Storage) || (*fullEvery != 0 && *fullEvery != cfg.FullEvery) {
+		if err := cfg.SetStorage(*storage, *fullEvery); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if err := cfg.check(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+		if err := cfg.save("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not save config: %v\n", err)
+			os.Exit(1)
+		}
+	} else if err := cfg.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	ss, err := listSnapshots(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	boards := map[string][]snapshot{}
+	var ids []string
+	for _, s := range ss {
+		if _, ok := boards[s.BoardID]; !ok {
+			ids = append(ids, s.BoardID)
+		}
+		boards[s.BoardID] = append(boards[s.BoardID], s)
+	}
+
+	var before, after int64
+	var changed, failed int
+	for _, id := range ids {
+		var prev string
+		var prevDoc interface{}
+		var prevDepth int
+		for _, s := range boards[id] {
+			size := snapshotFileSize(s.Path)
+			before += size
+
+			doc, p, err := loadSnapshotDoc(s.Path, 0)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: could not read %s: %v\n", s.Path, err)
+				prev, prevDoc = "", nil
+				after += size
+				failed++
+				continue
+			}
+
+			base := prev
+			if cfg.Storage != "delta" || prevDepth >= cfg.FullEvery {
+				base = ""
+			}
+
+			var depth int
+			if base == "" && p == nil {
+				depth = 0 // already full
+			} else if base != "" && p != nil && p.Base == filepath.Base(base) && p.Depth == prevDepth+1 {
+				depth = p.Depth // already a delta from the previous snapshot
+			} else {
+				if depth, err = storeSnapshot(s.Path, doc, base, prevDoc, prevDepth); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not store %s: %v\n", s.Path, err)
+					os.Exit(1)
+				}
+				if depth != 0 {
+					fmt.Printf("Stored %s as a delta from %s\n", s.Path, base)
+					changed++
+				} else if p != nil {
+					fmt.Printf("Stored %s in full\n", s.Path)
+					changed++
+				} // otherwise, the delta wasn't worth it
+			}
+			after += snapshotFileSize(s.Path)
+
+			prev, prevDoc, prevDepth = s.Path, doc, depth
+		}
+	}
+
+	fmt.Printf("Compacted %d of %d snapshots (%d bytes before, %d bytes after)\n", changed, len(ss), before, after)
+	if failed != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d snapshots could not be read\n", failed)
+		os.Exit(1)
+	}
+}
+
+// snapshotFileSize returns the size of the file the snapshot fn is stored in.
+func snapshotFileSize(fn string) int64 {
+	if fi, err := os.Stat(fn); err == nil {
+		return fi.Size()
+	}
+	if fi, err := os.Stat(fn + patchExt); err == nil {
+		return fi.Size()
+	}
+	return 0
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// browserCookie gets the value of the token cookie for trello.com from a
+// browser's cookie database. The profile can be a profile directory, a cookie
+// database, or empty to find the most recently used profile.
+func browserCookie(browser, profile string) (string, error) {
+	var fn string
+	switch browser {
+	case "firefox":
+		fn = "cookies.sqlite"
+	case "chromium", "chrome":
+		fn = "Cookies"
+	default:
+		return "", fmt.Errorf("unsupported browser %q (firefox, chromium)", browser)
+	}
+
+	var db string
+	if profile == "" {
+		var err error
+		if db, err = findCookieDB(browser); err != nil {
+			return "", err
+		}
+	} else if fi, err := os.Stat(profile); err != nil {
+		return "", err
+	} else if !fi.IsDir() {
+		db = profile
+	} else if _, err := os.Stat(filepath.Join(profile, "Network", fn)); err == nil {
+		db = filepath.Join(profile, "Network", fn) // newer chromium
+	} else {
+		db = filepath.Join(profile, fn)
+	}
+
+	// the browser may have it locked (and be writing to it), so copy it first
+	td, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(td)
+
+	tf := filepath.Join(td, "cookies")
+	if err := copyFile(db, tf); err != nil {
+		return "", fmt.Errorf("copy cookie database: %w", err)
+	}
+	if err := copyFile(db+"-wal", tf+"-wal"); err != nil && !os.IsNotExist(err) {
+		return "", fmt.Errorf("copy cookie database wal: %w", err)
+	}
+
+	d, err := openSQLite(tf)
+	if err != nil {
+		return "", fmt.Errorf("open cookie database %s: %w", db, err)
+	}
+
+	var value string
+	var encrypted bool
+	switch browser {
+	case "firefox":
+		err = d.Table("moz_cookies", func(row map[string]interface{}) error {
+			if isTrelloCookieHost(row["host"]) && row["name"] == "token" {
+				value, _ = row["value"].(string)
+			}
+			return nil
+		})
+	default:
+		err = d.Table("cookies", func(row map[string]interface{}) error {
+			if isTrelloCookieHost(row["host_key"]) && row["name"] == "token" {
+				if value, _ = row["value"].(string); value == "" {
+					ev, _ := row["encrypted_value"].([]byte)
+					encrypted = len(ev) != 0
+				}
+			}
+			return nil
+		})
+	}
+	if err != nil {
+		return "", fmt.Errorf("read cookie database %s: %w", db, err)
+	}
+	if value == "" {
+		if encrypted {
+			return "", errors.New("token cookie is encrypted (only unencrypted chromium cookie databases are supported)")
+		}
+		return "", fmt.Errorf("no token cookie for trello.com in %s (are you logged in?)", db)
+	}
+	return value, nil
+}
+
+func isTrelloCookieHost(v interface{}) bool {
+	host, _ := v.(string)
+	return strings.TrimPrefix(host, ".") == "trello.com"
+}
+
+// findCookieDB finds the most recently modified cookie database in the default
+// profile locations for browser.
+func findCookieDB(browser string) (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	config, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+
+	var patterns []string
+	switch browser {
+	case "firefox":
+		switch runtime.GOOS {
+		case "windows":
+			patterns = append(patterns, filepath.Join(config, "Mozilla", "Firefox", "Profiles", "*", "cookies.sqlite"))
+		case "darwin":
+			patterns = append(patterns, filepath.Join(config, "Firefox", "Profiles", "*", "cookies.sqlite"))
+		default:
+			patterns = append(patterns, filepath.Join(home, ".mozilla", "firefox", "*", "cookies.sqlite"))
+		}
+	default:
+		if runtime.GOOS == "windows" {
+			config = os.Getenv("LOCALAPPDATA")
+		}
+		for _, d := range []string{
+			"chromium",
+			"google-chrome",
+			"Chromium",
+			filepath.Join("Google", "Chrome"),
+			filepath.Join("Chromium", "User Data"),
+			filepath.Join("Google", "Chrome", "User Data"),
+		} {
+			patterns = append(patterns, filepath.Join(config, d, "*", "Cookies"))
+			patterns = append(patterns, filepath.Join(config, d, "*", "Network", "Cookies"))
+		}
+	}
+
+	var fn string
+	var mt int64
+	for _, p := range patterns {
+		m, _ := filepath.Glob(p)
+		for _, x := range m {
+			if fi, err := os.Stat(x); err == nil && fi.ModTime().UnixNano() > mt {
+				fn, mt = x, fi.ModTime().UnixNano()
+			}
+		}
+	}
+	if fn == "" {
+		return "", fmt.Errorf("could not find a %s profile (specify it manually)", browser)
+	}
+	return fn, nil
+}
+
+func copyFile(src, dst string) error {
+	sf, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer sf.Close()
+
+	df, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer df.Close()
+
+	if _, err := io.Copy(df, sf); err != nil {
+		return err
+	}
+	return df.Close()
+}
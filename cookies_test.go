@@ -0,0 +1,64 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestBrowserCookie(t *testing.T) {
+	for _, c := range []struct {
+		Browser, Profile, Token, Err string
+	}{
+		{"firefox", "firefox.sqlite", "firefox-token", ""},
+		{"firefox", "firefox-wal.sqlite", "wal-token", ""},
+		{"chromium", "chromium.sqlite", "chromium-token", ""},
+		{"chromium", "chromium-encrypted.sqlite", "", "encrypted"},
+		{"chromium", "firefox.sqlite", "", "no such table"},
+		{"firefox", "overflow.sqlite", "", "no such table"},
+		{"safari", "firefox.sqlite", "", "unsupported browser"},
+	} {
+		token, err := browserCookie(c.Browser, filepath.Join("testdata", c.Profile))
+		if c.Err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.Err) {
+				t.Errorf("%s %s: expected error containing %q, got %v", c.Browser, c.Profile, c.Err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s %s: %v", c.Browser, c.Profile, err)
+		} else if token != c.Token {
+			t.Errorf("%s %s: expected token %q, got %q", c.Browser, c.Profile, c.Token, token)
+		}
+	}
+}
+
+func TestBrowserCookieProfile(t *testing.T) {
+	td, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	// newer chromium profiles have it in Network
+	if err := os.Mkdir(filepath.Join(td, "Network"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(filepath.Join("testdata", "chromium.sqlite"), filepath.Join(td, "Network", "Cookies")); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := browserCookie("chromium", td); err != nil {
+		t.Errorf("chromium profile: %v", err)
+	} else if token != "chromium-token" {
+		t.Errorf("expected token %q, got %q", "chromium-token", token)
+	}
+
+	if err := copyFile(filepath.Join("testdata", "firefox.sqlite"), filepath.Join(td, "cookies.sqlite")); err != nil {
+		t.Fatal(err)
+	}
+	if token, err := browserCookie("firefox", td); err != nil {
+		t.Errorf("firefox profile: %v", err)
+	} else if token != "firefox-token" {
+		t.Errorf("expected token %q, got %q", "firefox-token", token)
+	}
+}
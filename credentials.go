@@ -0,0 +1,82 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// credentials is the credential store.
+type credentials struct {
+	APIKey   string `json:"api_key,omitempty"`
+	APIToken string `json:"api_token,omitempty"`
+}
+
+// credentialsPath returns the path to the credential store.
+func credentialsPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "trellobackup", "credentials.json"), nil
+}
+
+// loadCredentials loads the credential store. If it doesn't exist, empty
+// credentials are returned.
+func loadCredentials() (*credentials, error) {
+	fn, err := credentialsPath()
+	if err != nil {
+		return nil, err
+	}
+
+	buf, err := ioutil.ReadFile(fn)
+	if os.IsNotExist(err) {
+		return &credentials{}, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var cr credentials
+	if err := json.Unmarshal(buf, &cr); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return &cr, nil
+}
+
+// save writes the credential store. It is only readable by the current user.
+func (cr *credentials) save() error {
+	fn, err := credentialsPath()
+	if err != nil {
+		return err
+	}
+
+	buf, err := json.MarshalIndent(cr, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fn), 0700); err != nil {
+		return err
+	}
+
+	// WriteFile wouldn't change the mode of an existing file
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".credentials-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	if _, err := f.Write(buf); err != nil {
+		return err
+	}
+	if err := f.Chmod(0600); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), fn)
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"runtime"
+	"testing"
+)
+
+func TestCredentialsSave(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("file modes aren't supported on windows")
+	}
+
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for _, k := range []string{"XDG_CONFIG_HOME", "HOME"} {
+		defer os.Setenv(k, os.Getenv(k))
+		os.Setenv(k, dir)
+	}
+
+	fn, err := credentialsPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&credentials{APIKey: "key"}).save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if err := os.Chmod(fn, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := (&credentials{APIKey: "key", APIToken: "token"}).save(); err != nil {
+		t.Fatalf("save: %v", err)
+	}
+	if fi, err := os.Stat(fn); err != nil {
+		t.Fatal(err)
+	} else if fi.Mode().Perm() != 0600 {
+		t.Errorf("expected the existing file to be made private, got mode %s", fi.Mode())
+	}
+
+	cr, err := loadCredentials()
+	if err != nil {
+		t.Fatalf("load: %v", err)
+	}
+	if cr.APIKey != "key" || cr.APIToken != "token" {
+		t.Errorf("unexpected credentials %+v", cr)
+	}
+}
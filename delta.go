@@ -0,0 +1,635 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// In the delta storage mode, a snapshot can be stored as a JSON Patch (RFC
+// 6902) from the previous snapshot of the board instead of the full export.
+// It is saved as NAME.json.patch instead of NAME.json, and everything which
+// reads snapshots reconstructs it transparently (see openSnapshot). The
+// reconstructed export has the same content as the original, but is only
+// byte-for-byte identical if it was in the canonical format since it is
+// re-encoded.
+
+// patchExt is appended to the filename of snapshots stored as a delta.
+const patchExt = ".patch"
+
+// defaultFullEvery is how often a full snapshot is stored in the delta storage
+// mode if it isn't configured.
+const defaultFullEvery = 10
+
+// maxPatchDepth limits how long a chain of patches can be, in case of a
+// cycle.
+const maxPatchDepth = 1000
+
+// snapshotPatch is the content of a snapshot stored as a delta.
+type snapshotPatch struct {
+	Base   string    `json:"base"`   // filename of the snapshot it applies to, in the same directory
+	Depth  int       `json:"depth"`  // number of patches to apply to the full snapshot it's based on
+	SHA256 string    `json:"sha256"` // of the reconstructed snapshot
+	Patch  []patchOp `json:"patch"`
+}
+
+// patchOp is a JSON Patch operation. Only add, remove, and replace are used.
+type patchOp struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// openSnapshot opens the snapshot fn, reconstructing it if it is stored as a
+// delta. If it doesn't exist, the error is from opening fn.
+func openSnapshot(fn string) (io.ReadCloser, error) {
+	f, err := os.Open(fn)
+	if err == nil || !os.IsNotExist(err) || !exists(fn+patchExt) {
+		return f, err
+	}
+	buf, err := readSnapshot(fn)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(buf)), nil
+}
+
+// readSnapshot reads the snapshot fn, reconstructing it if it is stored as a
+// delta.
+func readSnapshot(fn string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err == nil || !os.IsNotExist(err) || !exists(fn+patchExt) {
+		return buf, err
+	}
+	doc, p, err := loadSnapshotDoc(fn, 0)
+	if err != nil {
+		return nil, err
+	}
+	buf, err = encodeSnapshot(doc)
+	if err != nil {
+		return nil, err
+	}
+	if sum := sha256.Sum256(buf); hex.EncodeToString(sum[:]) != p.SHA256 {
+		return nil, fmt.Errorf("reconstruct %s: sha256 mismatch", filepath.Base(fn))
+	}
+	return buf, nil
+}
+
+// snapshotExists checks whether the snapshot fn exists, either in full or as
+// a delta.
+func snapshotExists(fn string) bool {
+	return exists(fn) || exists(fn+patchExt)
+}
+
+// snapshotStorage describes how the snapshot fn is stored.
+func snapshotStorage(fn string) string {
+	if exists(fn) {
+		return "full"
+	}
+	p, err := readSnapshotPatch(fn)
+	if err != nil {
+		return "unknown"
+	}
+	return fmt.Sprintf("delta from %s (%d patches)", p.Base, p.Depth)
+}
+
+// snapshotDepth returns the number of patches needed to reconstruct the
+// snapshot fn (0 if it is stored in full).
+func snapshotDepth(fn string) (int, error) {
+	if exists(fn) {
+		return 0, nil
+	}
+	p, err := readSnapshotPatch(fn)
+	if err != nil {
+		return 0, err
+	}
+	return p.Depth, nil
+}
+
+// snapshotSHA256 hashes a snapshot, returning the hash and size.
+func snapshotSHA256(fn string) (string, int64, error) {
+	f, err := openSnapshot(fn)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), n, nil
+}
+
+func readSnapshotPatch(fn string) (*snapshotPatch, error) {
+	buf, err := ioutil.ReadFile(fn + patchExt)
+	if err != nil {
+		return nil, err
+	}
+	var p snapshotPatch
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return nil, fmt.Errorf("decode %s: %w", filepath.Base(fn+patchExt), err)
+	}
+	if p.Base == "" || strings.ContainsAny(p.Base, `/\`) {
+		return nil, fmt.Errorf("decode %s: invalid base %q", filepath.Base(fn+patchExt), p.Base)
+	}
+	return &p, nil
+}
+
+// loadSnapshotDoc decodes the snapshot fn, applying the patches if it is
+// stored as a delta. If it is, the patch is also returned.
+func loadSnapshotDoc(fn string, depth int) (interface{}, *snapshotPatch, error) {
+	if depth > maxPatchDepth {
+		return nil, nil, errors.New("too many patches")
+	}
+
+	if f, err := os.Open(fn); err == nil {
+		defer f.Close()
+		doc, err := decodeSnapshot(f)
+		return doc, nil, err
+	} else if !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+
+	p, err := readSnapshotPatch(fn)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, _, err := loadSnapshotDoc(filepath.Join(filepath.Dir(fn), p.Base), depth+1)
+	if err != nil {
+		return nil, nil, fmt.Errorf("reconstruct %s: %w", filepath.Base(fn), err)
+	}
+	if doc, err = applyPatch(doc, p.Patch); err != nil {
+		return nil, nil, fmt.Errorf("reconstruct %s: %w", filepath.Base(fn), err)
+	}
+	return doc, p, nil
+}
+
+func decodeSnapshot(r io.Reader) (interface{}, error) {
+	dec := json.NewDecoder(r)
+	dec.UseNumber() // keep numbers exactly
+	var doc interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return doc, nil
+}
+
+// encodeSnapshot encodes a reconstructed snapshot. It is formatted like the
+// canonical format, so canonical snapshots are reconstructed exactly.
+func encodeSnapshot(doc interface{}) ([]byte, error) {
+	var b bytes.Buffer
+	enc := json.NewEncoder(&b)
+	enc.SetEscapeHTML(false)
+	enc.SetIndent("", "  ")
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// storeDelta stores the new snapshot fn as a delta from the previous snapshot
+// pfn of the board, unless there have already been fullEvery deltas since the
+// last full snapshot. It returns true if it was stored as a delta.
+func storeDelta(fn, pfn string, fullEvery int) (bool, error) {
+	if pfn == "" {
+		return false, nil
+	}
+	depth, err := snapshotDepth(pfn)
+	if err != nil || depth >= fullEvery {
+		return false, nil // don't depend on a bad previous snapshot
+	}
+	baseDoc, _, err := loadSnapshotDoc(pfn, 0)
+	if err != nil {
+		return false, nil
+	}
+	doc, _, err := loadSnapshotDoc(fn, 0)
+	if err != nil {
+		return false, err
+	}
+	depth, err = storeSnapshot(fn, doc, pfn, baseDoc, depth)
+	return depth != 0, err
+}
+
+// storeSnapshot stores the snapshot fn (with the content doc) as a delta from
+// base (with the content baseDoc and the specified depth), or in full if base
+// is empty or the delta wouldn't be much smaller. It returns the new depth.
+func storeSnapshot(fn string, doc interface{}, base string, baseDoc interface{}, baseDepth int) (int, error) {
+	full, err := encodeSnapshot(doc)
+	if err != nil {
+		return 0, err
+	}
+
+	if base != "" && exists(fn) {
+		if cur, err := ioutil.ReadFile(fn); err != nil {
+			return 0, err
+		} else if !bytes.Equal(cur, full) {
+			base = "" // it wouldn't be reconstructed byte-for-byte (i.e., it isn't in the canonical format)
+		}
+	}
+
+	var buf []byte
+	if base != "" {
+		var ops []patchOp
+		if err := diffJSON("", baseDoc, doc, &ops); err != nil {
+			return 0, err
+		}
+		sum := sha256.Sum256(full)
+		if buf, err = json.Marshal(snapshotPatch{
+			Base:   filepath.Base(base),
+			Depth:  baseDepth + 1,
+			SHA256: hex.EncodeToString(sum[:]),
+			Patch:  ops,
+		}); err != nil {
+			return 0, err
+		}
+		if len(buf) > len(full)/2 {
+			buf = nil // not worth it
+		} else if err := checkPatch(filepath.Dir(fn), buf, full); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: storing %s in full since the delta doesn't reconstruct it: %v\n", fn, err)
+			buf = nil
+		}
+	}
+
+	if buf == nil {
+		if exists(fn) {
+			return 0, nil // keep the original
+		}
+		if err := writeFileAtomic(fn, full); err != nil {
+			return 0, err
+		}
+		if err := os.Remove(fn + patchExt); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		return 0, nil
+	}
+
+	if err := writeFileAtomic(fn+patchExt, buf); err != nil {
+		return 0, err
+	}
+	if err := os.Remove(fn); err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	return baseDepth + 1, nil
+}
+
+// checkPatch checks that the encoded snapshotPatch buf (for a snapshot in
+// dir) reconstructs the snapshot full from its base as currently stored.
+func checkPatch(dir string, buf, full []byte) error {
+	var p snapshotPatch
+	if err := json.Unmarshal(buf, &p); err != nil {
+		return err
+	}
+	doc, _, err := loadSnapshotDoc(filepath.Join(dir, p.Base), 0)
+	if err != nil {
+		return err
+	}
+	if doc, err = applyPatch(doc, p.Patch); err != nil {
+		return err
+	}
+	rec, err := encodeSnapshot(doc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(rec, full) {
+		return errors.New("reconstructed snapshot is different")
+	}
+	if sum := sha256.Sum256(rec); hex.EncodeToString(sum[:]) != p.SHA256 {
+		return errors.New("sha256 mismatch")
+	}
+	return nil
+}
+
+func writeFileAtomic(fn string, buf []byte) error {
+	f, err := ioutil.TempFile(filepath.Dir(fn), ".write-*")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Chmod(0644); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	if err := os.Rename(f.Name(), fn); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return nil
+}
+
+// diffJSON appends the operations to turn a into b (at the JSON Pointer path)
+// to ops.
+func diffJSON(path string, a, b interface{}, ops *[]patchOp) error {
+	switch av := a.(type) {
+	case map[string]interface{}:
+		if bv, ok := b.(map[string]interface{}); ok {
+			ks := make([]string, 0, len(av))
+			for k := range av {
+				ks = append(ks, k)
+			}
+			sort.Strings(ks)
+			for _, k := range ks {
+				if v, ok := bv[k]; !ok {
+					*ops = append(*ops, patchOp{Op: "remove", Path: path + "/" + escapePointer(k)})
+				} else if err := diffJSON(path+"/"+escapePointer(k), av[k], v, ops); err != nil {
+					return err
+				}
+			}
+			ks = ks[:0]
+			for k := range bv {
+				if _, ok := av[k]; !ok {
+					ks = append(ks, k)
+				}
+			}
+			sort.Strings(ks)
+			for _, k := range ks {
+				if err := addOp(ops, "add", path+"/"+escapePointer(k), bv[k]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+	case []interface{}:
+		if bv, ok := b.([]interface{}); ok {
+			return diffArray(path, av, bv, ops)
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		return addOp(ops, "replace", path, b)
+	}
+	return nil
+}
+
+// maxArrayEdits is the maximum number of insertions and deletions to find
+// between two arrays before replacing the whole array instead.
+const maxArrayEdits = 2000
+
+// diffArray diffs arrays, matching objects by their id (if they have one) so
+// insertions and deletions don't change the rest of the array.
+func diffArray(path string, a, b []interface{}, ops *[]patchOp) error {
+	ak, bk := make([]string, len(a)), make([]string, len(b))
+	for i, v := range a {
+		ak[i] = arrayKey(v)
+	}
+	for i, v := range b {
+		bk[i] = arrayKey(v)
+	}
+
+	es, ok := diffSeq(ak, bk, maxArrayEdits)
+	if !ok {
+		return addOp(ops, "replace", path, b)
+	}
+
+	var i int
+	for _, e := range es {
+		switch {
+		case e.x >= 0 && e.y >= 0:
+			if err := diffJSON(path+"/"+strconv.Itoa(i), a[e.x], b[e.y], ops); err != nil {
+				return err
+			}
+			i++
+		case e.x >= 0:
+			*ops = append(*ops, patchOp{Op: "remove", Path: path + "/" + strconv.Itoa(i)})
+		default:
+			if err := addOp(ops, "add", path+"/"+strconv.Itoa(i), b[e.y]); err != nil {
+				return err
+			}
+			i++
+		}
+	}
+	return nil
+}
+
+func arrayKey(v interface{}) string {
+	if m, ok := v.(map[string]interface{}); ok {
+		if id, ok := m["id"].(string); ok {
+			return "id:" + id
+		}
+	}
+	buf, _ := json.Marshal(v)
+	return "v:" + string(buf)
+}
+
+func addOp(ops *[]patchOp, op, path string, v interface{}) error {
+	buf, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	*ops = append(*ops, patchOp{Op: op, Path: path, Value: buf})
+	return nil
+}
+
+// seqEdit is an item in an edit script. If x and y are both set, a[x] is
+// kept as b[y]. If only x is set, a[x] is deleted. If only y is set, b[y] is
+// inserted.
+type seqEdit struct {
+	x, y int
+}
+
+// diffSeq finds the shortest edit script to turn a into b using Myers'
+// algorithm. If it needs more than maxD insertions and deletions, it returns
+// false.
+func diffSeq(a, b []string, maxD int) ([]seqEdit, bool) {
+	n, m := len(a), len(b)
+	max := n + m
+	if max > maxD {
+		max = maxD
+	}
+	off := max + 1
+	v := make([]int, 2*max+3)
+
+	// trace[d] is v[off-d-1:off+d+2] before step d
+	var trace [][]int
+	for d := 0; d <= max; d++ {
+		trace = append(trace, append([]int(nil), v[off-d-1:off+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[off+k-1] < v[off+k+1]) {
+				x = v[off+k+1]
+			} else {
+				x = v[off+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[off+k] = x
+			if x >= n && y >= m {
+				return backtrackSeq(trace, n, m, d), true
+			}
+		}
+	}
+	return nil, false
+}
+
+func backtrackSeq(trace [][]int, n, m, dEnd int) []seqEdit {
+	var es []seqEdit
+	x, y := n, m
+	for d := dEnd; d >= 0; d-- {
+		tv := trace[d]
+		get := func(k int) int {
+			return tv[k+d+1]
+		}
+		k := x - y
+		var pk int
+		if k == -d || (k != d && get(k-1) < get(k+1)) {
+			pk = k + 1
+		} else {
+			pk = k - 1
+		}
+		px := 0
+		if d > 0 {
+			px = get(pk)
+		}
+		py := px - pk
+		for x > px && y > py && x > 0 && y > 0 {
+			x--
+			y--
+			es = append(es, seqEdit{x, y})
+		}
+		if d > 0 {
+			if x == px {
+				es = append(es, seqEdit{-1, py})
+			} else {
+				es = append(es, seqEdit{px, -1})
+			}
+		}
+		x, y = px, py
+	}
+	for i, j := 0, len(es)-1; i < j; i, j = i+1, j-1 {
+		es[i], es[j] = es[j], es[i]
+	}
+	return es
+}
+
+// applyPatch applies JSON Patch operations to doc, which may be modified.
+func applyPatch(doc interface{}, ops []patchOp) (interface{}, error) {
+	for _, op := range ops {
+		var v interface{}
+		if op.Op != "remove" {
+			var err error
+			if v, err = decodeSnapshot(bytes.NewReader(op.Value)); err != nil {
+				return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+			}
+		}
+		var tokens []string
+		if op.Path != "" {
+			if !strings.HasPrefix(op.Path, "/") {
+				return nil, fmt.Errorf("%s %s: invalid path", op.Op, op.Path)
+			}
+			for _, t := range strings.Split(op.Path[1:], "/") {
+				tokens = append(tokens, unescapePointer(t))
+			}
+		}
+		var err error
+		if doc, err = applyOp(doc, tokens, op.Op, v); err != nil {
+			return nil, fmt.Errorf("%s %s: %w", op.Op, op.Path, err)
+		}
+	}
+	return doc, nil
+}
+
+// applyOp applies an operation at the path tokens in node, returning the new
+// node.
+func applyOp(node interface{}, tokens []string, op string, v interface{}) (interface{}, error) {
+	if len(tokens) == 0 {
+		switch op {
+		case "add", "replace":
+			return v, nil
+		}
+		return nil, fmt.Errorf("unsupported operation %q on the root", op)
+	}
+
+	switch n := node.(type) {
+	case map[string]interface{}:
+		k := tokens[0]
+		if len(tokens) > 1 {
+			c, ok := n[k]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", k)
+			}
+			c, err := applyOp(c, tokens[1:], op, v)
+			if err != nil {
+				return nil, err
+			}
+			n[k] = c
+			return n, nil
+		}
+		switch op {
+		case "add":
+			n[k] = v
+		case "replace", "remove":
+			if _, ok := n[k]; !ok {
+				return nil, fmt.Errorf("no member %q", k)
+			}
+			if op == "remove" {
+				delete(n, k)
+			} else {
+				n[k] = v
+			}
+		default:
+			return nil, fmt.Errorf("unsupported operation %q", op)
+		}
+		return n, nil
+	case []interface{}:
+		i, err := strconv.Atoi(tokens[0])
+		if tokens[0] == "-" && len(tokens) == 1 && op == "add" {
+			i, err = len(n), nil
+		}
+		if err != nil || i < 0 || i > len(n) || (i == len(n) && (op != "add" || len(tokens) > 1)) {
+			return nil, fmt.Errorf("invalid index %q", tokens[0])
+		}
+		if len(tokens) > 1 {
+			c, err := applyOp(n[i], tokens[1:], op, v)
+			if err != nil {
+				return nil, err
+			}
+			n[i] = c
+			return n, nil
+		}
+		switch op {
+		case "add":
+			n = append(n, nil)
+			copy(n[i+1:], n[i:])
+			n[i] = v
+		case "replace":
+			n[i] = v
+		case "remove":
+			n = append(n[:i], n[i+1:]...)
+		default:
+			return nil, fmt.Errorf("unsupported operation %q", op)
+		}
+		return n, nil
+	}
+	return nil, fmt.Errorf("can't %s in a %T", op, node)
+}
+
+func escapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~", "~0", -1), "/", "~1", -1)
+}
+
+func unescapePointer(s string) string {
+	return strings.Replace(strings.Replace(s, "~1", "/", -1), "~0", "~", -1)
+}
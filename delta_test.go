@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestDiffSeq(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 2000; i++ {
+		a, b := randSeq(r), randSeq(r)
+
+		es, ok := diffSeq(a, b, len(a)+len(b))
+		if !ok {
+			t.Fatalf("%q -> %q: no edit script", a, b)
+		}
+
+		// the edit script must turn a into b, in order
+		var x, y, keep int
+		for _, e := range es {
+			switch {
+			case e.x >= 0 && e.y >= 0:
+				if e.x != x || e.y != y || a[x] != b[y] {
+					t.Fatalf("%q -> %q: invalid keep %v at %d,%d", a, b, e, x, y)
+				}
+				x, y, keep = x+1, y+1, keep+1
+			case e.x >= 0:
+				if e.x != x {
+					t.Fatalf("%q -> %q: invalid delete %v at %d,%d", a, b, e, x, y)
+				}
+				x++
+			default:
+				if e.y != y {
+					t.Fatalf("%q -> %q: invalid insert %v at %d,%d", a, b, e, x, y)
+				}
+				y++
+			}
+		}
+		if x != len(a) || y != len(b) {
+			t.Fatalf("%q -> %q: edit script ends at %d,%d", a, b, x, y)
+		}
+
+		// and it must be the shortest one
+		if lcs := lcsLength(a, b); keep != lcs {
+			t.Fatalf("%q -> %q: kept %d, but the lcs is %d", a, b, keep, lcs)
+		}
+	}
+}
+
+func TestDiffSeqMaxD(t *testing.T) {
+	a, b := strings.Split("abcdef", ""), strings.Split("uvwxyz", "")
+	if _, ok := diffSeq(a, b, 11); ok {
+		t.Errorf("expected no edit script with maxD < 12")
+	}
+	if _, ok := diffSeq(a, b, 12); !ok {
+		t.Errorf("expected an edit script with maxD = 12")
+	}
+}
+
+func TestDiffJSON(t *testing.T) {
+	r := rand.New(rand.NewSource(2))
+	for i := 0; i < 2000; i++ {
+		a, b := roundTrip(t, randDoc(r)), roundTrip(t, randDoc(r))
+
+		var ops []patchOp
+		if err := diffJSON("", a, b, &ops); err != nil {
+			t.Fatalf("diff: %v", err)
+		}
+		out, err := applyPatch(roundTrip(t, a), ops)
+		if err != nil {
+			t.Fatalf("apply %s: %v", mustJSON(t, ops), err)
+		}
+		if !reflect.DeepEqual(out, b) {
+			t.Fatalf("%s -> %s: patch %s gives %s", mustJSON(t, a), mustJSON(t, b), mustJSON(t, ops), mustJSON(t, out))
+		}
+	}
+}
+
+func TestDiffArrayByID(t *testing.T) {
+	a := roundTrip(t, map[string]interface{}{"cards": []interface{}{
+		map[string]interface{}{"id": "1", "name": "one"},
+		map[string]interface{}{"id": "2", "name": "two"},
+		map[string]interface{}{"id": "3", "name": "three"},
+	}})
+	b := roundTrip(t, map[string]interface{}{"cards": []interface{}{
+		map[string]interface{}{"id": "0", "name": "zero"},
+		map[string]interface{}{"id": "1", "name": "one"},
+		map[string]interface{}{"id": "3", "name": "THREE"},
+	}})
+
+	var ops []patchOp
+	if err := diffJSON("", a, b, &ops); err != nil {
+		t.Fatal(err)
+	}
+	// the unchanged card isn't touched, and the changed one only has its
+	// name replaced
+	exp := `[{"op":"add","path":"/cards/0","value":{"id":"0","name":"zero"}},{"op":"remove","path":"/cards/2"},{"op":"replace","path":"/cards/2/name","value":"THREE"}]`
+	if act := string(mustJSON(t, ops)); act != exp {
+		t.Errorf("expected %s, got %s", exp, act)
+	}
+}
+
+func TestApplyPatch(t *testing.T) {
+	for _, c := range []struct {
+		doc, patch, exp string
+	}{
+		{`{"a":1}`, `[{"op":"add","path":"/b","value":2}]`, `{"a":1,"b":2}`},
+		{`{"a":1}`, `[{"op":"replace","path":"/a","value":null}]`, `{"a":null}`},
+		{`{"a":1,"b":2}`, `[{"op":"remove","path":"/a"}]`, `{"b":2}`},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/1","value":3}]`, `{"a":[1,3,2]}`},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/2","value":3}]`, `{"a":[1,2,3]}`},
+		{`{"a":[1,2]}`, `[{"op":"add","path":"/a/-","value":3}]`, `{"a":[1,2,3]}`},
+		{`{"a":[1,2]}`, `[{"op":"remove","path":"/a/0"}]`, `{"a":[2]}`},
+		{`{"a":[{"b":1}]}`, `[{"op":"replace","path":"/a/0/b","value":2}]`, `{"a":[{"b":2}]}`},
+		{`{"a/b":1,"c~d":2}`, `[{"op":"remove","path":"/a~1b"},{"op":"remove","path":"/c~0d"}]`, `{}`},
+		{`{"a":1}`, `[{"op":"replace","path":"","value":[1]}]`, `[1]`},
+		{`{"n":1.50}`, `[{"op":"add","path":"/m","value":12345678901234567890}]`, `{"m":12345678901234567890,"n":1.50}`},
+		{`{"a":1}`, `[{"op":"remove","path":"/b"}]`, ``},
+		{`{"a":1}`, `[{"op":"replace","path":"/b","value":1}]`, ``},
+		{`{"a":[1]}`, `[{"op":"remove","path":"/a/1"}]`, ``},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/3","value":1}]`, ``},
+		{`{"a":[1]}`, `[{"op":"add","path":"/a/x","value":1}]`, ``},
+		{`{"a":1}`, `[{"op":"add","path":"/a/b","value":1}]`, ``},
+		{`{"a":1}`, `[{"op":"move","from":"/a","path":"/b"}]`, ``},
+		{`{"a":1}`, `[{"op":"add","path":"a","value":1}]`, ``},
+	} {
+		doc, err := decodeSnapshot(strings.NewReader(c.doc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ops []patchOp
+		if err := json.Unmarshal([]byte(c.patch), &ops); err != nil {
+			t.Fatal(err)
+		}
+		out, err := applyPatch(doc, ops)
+		if c.exp == "" {
+			if err == nil {
+				t.Errorf("%s %s: expected error, got %s", c.doc, c.patch, mustJSON(t, out))
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", c.doc, c.patch, err)
+		} else if act := string(mustJSON(t, out)); act != c.exp {
+			t.Errorf("%s %s: expected %s, got %s", c.doc, c.patch, c.exp, act)
+		}
+	}
+}
+
+func TestStoreSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	r := rand.New(rand.NewSource(3))
+	board := func() map[string]interface{} {
+		var cards []interface{}
+		for i := 0; i < 100; i++ {
+			cards = append(cards, map[string]interface{}{
+				"id":   string(rune('a'+r.Intn(26))) + string(rune('a'+r.Intn(26))),
+				"name": strings.Repeat("card ", 10),
+				"pos":  json.Number("1"),
+			})
+		}
+		return map[string]interface{}{"id": "B1", "cards": cards}
+	}
+
+	b1, b2 := board(), board()
+	b2["cards"] = append(b1["cards"].([]interface{})[1:], b2["cards"].([]interface{})[0])
+
+	base := filepath.Join(dir, "b1.json")
+	fn := filepath.Join(dir, "b2.json")
+	for f, doc := range map[string]interface{}{base: b1, fn: b2} {
+		if err := ioutil.WriteFile(f, mustJSON(t, doc), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	doc, _, err := loadSnapshotDoc(fn, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	baseDoc, _, err := loadSnapshotDoc(base, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it isn't in the canonical format, so it can't be reconstructed exactly
+	if depth, err := storeSnapshot(fn, doc, base, baseDoc, 0); err != nil {
+		t.Fatal(err)
+	} else if depth != 0 || !exists(fn) || exists(fn+patchExt) {
+		t.Fatalf("expected a snapshot which isn't canonical to be kept in full")
+	}
+
+	canonical, err := encodeSnapshot(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, canonical, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if depth, err := storeSnapshot(fn, doc, base, baseDoc, 0); err != nil {
+		t.Fatal(err)
+	} else if depth != 1 {
+		t.Fatalf("expected a delta, got depth %d", depth)
+	}
+	if exists(fn) || !exists(fn+patchExt) {
+		t.Fatalf("expected only the delta to be stored")
+	}
+
+	buf, err := readSnapshot(fn)
+	if err != nil {
+		t.Fatalf("reconstruct: %v", err)
+	}
+	exp, err := encodeSnapshot(roundTrip(t, b2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, exp) {
+		t.Errorf("reconstructed snapshot is different")
+	}
+
+	// expanding it again
+	if depth, err := storeSnapshot(fn, doc, "", nil, 0); err != nil {
+		t.Fatal(err)
+	} else if depth != 0 || !exists(fn) || exists(fn+patchExt) {
+		t.Fatalf("expected it to be stored in full")
+	}
+}
+
+func TestCheckPatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "b1.json"), []byte(`{"a":1}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	full, _ := encodeSnapshot(roundTrip(t, map[string]interface{}{"a": 2}))
+
+	ok := mustJSON(t, snapshotPatch{Base: "b1.json", Depth: 1, SHA256: sha256Hex(full), Patch: []patchOp{
+		{Op: "replace", Path: "/a", Value: json.RawMessage(`2`)},
+	}})
+	if err := checkPatch(dir, ok, full); err != nil {
+		t.Errorf("valid patch: %v", err)
+	}
+
+	bad := mustJSON(t, snapshotPatch{Base: "b1.json", Depth: 1, SHA256: sha256Hex(full), Patch: []patchOp{
+		{Op: "replace", Path: "/a", Value: json.RawMessage(`3`)},
+	}})
+	if err := checkPatch(dir, bad, full); err == nil {
+		t.Errorf("expected an error for a patch which doesn't reconstruct the snapshot")
+	}
+}
+
+func sha256Hex(buf []byte) string {
+	sum := sha256.Sum256(buf)
+	return hex.EncodeToString(sum[:])
+}
+
+func randSeq(r *rand.Rand) []string {
+	s := make([]string, r.Intn(20))
+	for i := range s {
+		s[i] = string(rune('a' + r.Intn(5)))
+	}
+	return s
+}
+
+func randDoc(r *rand.Rand) interface{} {
+	var cards []interface{}
+	for _, id := range randSeq(r) {
+		c := map[string]interface{}{"id": id}
+		if r.Intn(2) == 0 {
+			c["name"] = randSeq(r)
+		}
+		if r.Intn(3) == 0 {
+			c["closed"] = r.Intn(2) == 0
+		}
+		cards = append(cards, c)
+	}
+	doc := map[string]interface{}{
+		"cards":  cards,
+		"labels": randSeq(r),
+	}
+	if r.Intn(2) == 0 {
+		doc["desc/~"] = nil
+	}
+	if r.Intn(4) == 0 {
+		doc["cards"] = "not an array"
+	}
+	return doc
+}
+
+func lcsLength(a, b []string) int {
+	dp := make([][]int, len(a)+1)
+	for i := range dp {
+		dp[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				dp[i][j] = dp[i+1][j+1] + 1
+			} else if dp[i+1][j] > dp[i][j+1] {
+				dp[i][j] = dp[i+1][j]
+			} else {
+				dp[i][j] = dp[i][j+1]
+			}
+		}
+	}
+	return dp[0][0]
+}
+
+// roundTrip encodes and decodes v like a snapshot.
+func roundTrip(t *testing.T, v interface{}) interface{} {
+	t.Helper()
+	doc, err := decodeSnapshot(bytes.NewReader(mustJSON(t, v)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return doc
+}
+
+func mustJSON(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	buf, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf
+}
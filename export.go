@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/csv"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+func exportCommand(args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	format := fs.String("format", "markdown", "output format (csv, markdown)")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup export [options] SNAPSHOT")
+		fmt.Fprintln(fs.Output(), "Note: SNAPSHOT can be a file or a board ID (for the latest snapshot).")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var exp func(io.Writer, *boardDoc) error
+	switch *format {
+	case "csv":
+		exp = exportCSV
+	case "markdown", "md":
+		exp = exportMarkdown
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unsupported format %q\n", *format)
+		os.Exit(2)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not create output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	chdir(*dir)
+
+	fn, err := resolveSnapshot(".", fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	b, err := loadBoard(fn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load snapshot: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := exp(w, b); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not export snapshot: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// exportCSV writes a row for each card.
+func exportCSV(w io.Writer, b *boardDoc) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Board", "List", "Card", "Description", "Labels", "Due", "Archived", "URL"})
+	for _, l := range b.SortedLists() {
+		for _, c := range b.SortedCards(l.ID) {
+			var labels []string
+			for _, id := range c.IDLabels {
+				if lb := b.Label(id); lb != nil {
+					labels = append(labels, labelName(*lb))
+				}
+			}
+			var due string
+			if c.Due != nil {
+				due = c.Due.Format(time.RFC3339)
+			}
+			cw.Write([]string{b.Name, l.Name, c.Name, c.Desc, strings.Join(labels, ", "), due, fmt.Sprint(c.Closed || l.Closed), c.ShortURL})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// exportMarkdown writes a document with a section for each list.
+func exportMarkdown(w io.Writer, b *boardDoc) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "# %s\n\n", b.Name)
+	if b.Desc != "" {
+		fmt.Fprintf(&sb, "%s\n\n", b.Desc)
+	}
+	for _, l := range b.SortedLists() {
+		fmt.Fprintf(&sb, "## %s", l.Name)
+		if l.Closed {
+			sb.WriteString(" (archived)")
+		}
+		sb.WriteString("\n\n")
+		for _, c := range b.SortedCards(l.ID) {
+			fmt.Fprintf(&sb, "### %s", c.Name)
+			if c.Closed {
+				sb.WriteString(" (archived)")
+			}
+			sb.WriteString("\n\n")
+			if len(c.IDLabels) != 0 {
+				var labels []string
+				for _, id := range c.IDLabels {
+					if lb := b.Label(id); lb != nil {
+						labels = append(labels, "`"+labelName(*lb)+"`")
+					}
+				}
+				fmt.Fprintf(&sb, "Labels: %s  \n", strings.Join(labels, " "))
+			}
+			if c.Due != nil {
+				fmt.Fprintf(&sb, "Due: %s", c.Due.Format("2006-01-02 15:04 MST"))
+				if c.DueComplete {
+					sb.WriteString(" (complete)")
+				}
+				sb.WriteString("  \n")
+			}
+			fmt.Fprintf(&sb, "URL: %s\n\n", c.ShortURL)
+			if c.Desc != "" {
+				fmt.Fprintf(&sb, "%s\n\n", c.Desc)
+			}
+			for _, cl := range b.CardChecklists(c.ID) {
+				fmt.Fprintf(&sb, "**%s**\n\n", cl.Name)
+				for _, it := range cl.CheckItems {
+					if it.State == "complete" {
+						fmt.Fprintf(&sb, "- [x] %s\n", it.Name)
+					} else {
+						fmt.Fprintf(&sb, "- [ ] %s\n", it.Name)
+					}
+				}
+				sb.WriteString("\n")
+			}
+			for _, cm := range b.Comments(c.ID) {
+				fmt.Fprintf(&sb, "> **%s** (%s):  \n", cm.Author, cm.Date.Format("2006-01-02 15:04 MST"))
+				for _, line := range strings.Split(cm.Text, "\n") {
+					fmt.Fprintf(&sb, "> %s\n", line)
+				}
+				sb.WriteString("\n")
+			}
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func labelName(lb boardLabel) string {
+	if lb.Name != "" {
+		return lb.Name
+	}
+	return lb.Color
+}
@@ -2,4 +2,7 @@ module github.com/pgaskin/trellobackup
 
 go 1.14
 
-require github.com/xlzd/gotp v0.0.0-20181030022105-c8557ba2c119
+require (
+	github.com/xlzd/gotp v0.0.0-20181030022105-c8557ba2c119
+	go.etcd.io/bbolt v1.3.6
+)
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func importLegacyCommand(args []string) {
+	fs := flag.NewFlagSet("import-legacy", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory to import into (default: current directory)")
+	from := fs.String("from", "", "directory containing the legacy backups, if it isn't the backup directory (files are copied instead of moved)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup import-legacy [options]")
+		fmt.Fprintln(fs.Output(), "Note: Snapshots which are already in the catalog are skipped, so it can be run more than once.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src := "."
+	if *from != "" {
+		var err error
+		if src, err = filepath.Abs(*from); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	chdir(*dir)
+
+	if wd, err := os.Getwd(); err == nil && wd == src {
+		src = "."
+	}
+
+	cat, err := openCatalog(".", false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cat.Close()
+
+	cs, err := cat.Snapshots("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+		os.Exit(1)
+	}
+	cataloged := map[string]bool{}
+	for _, c := range cs {
+		cataloged[c.File] = true
+	}
+
+	ss, err := listSnapshots(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	// snapshots from the same run have the same run ID or were started in
+	// the same minute by the same user
+	var keys []string
+	groups := map[string][]snapshot{}
+	for _, s := range ss {
+		if cataloged[filepath.Base(s.Path)] {
+			continue
+		}
+		k := s.RunID
+		if k == "" {
+			k = s.Username + "/" + s.Time.Truncate(time.Minute).Format(time.RFC3339)
+		}
+		if _, ok := groups[k]; !ok {
+			keys = append(keys, k)
+		}
+		groups[k] = append(groups[k], s)
+	}
+
+	var runs, snapshots, attachments, missing int
+	for _, k := range keys {
+		m := &runManifest{
+			ID:       groups[k][0].RunID,
+			Started:  groups[k][0].Time,
+			Complete: true,
+			Imported: true,
+		}
+		if m.ID == "" {
+			m.ID = newID()
+		}
+
+		for _, s := range groups[k] {
+			fmt.Printf("Importing %s\n", filepath.Base(s.Path))
+
+			fn := filepath.Base(s.Path)
+			if src != "." && !exists(fn) {
+				if err := copyFile(s.Path, fn); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not copy snapshot: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			b, err := scanBoardFile(fn)
+			if err == nil {
+				err = validateBoard(b.boardSummary, b.ID, nil)
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Warning: skipping invalid snapshot %s: %v\n", fn, err)
+				continue
+			}
+
+			sum, size, err := snapshotSHA256(fn)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not hash snapshot: %v\n", err)
+				os.Exit(1)
+			}
+
+			for _, card := range b.Board.Cards {
+				for _, a := range card.Attachments {
+					if !a.IsUpload {
+						continue
+					}
+					afn, sidecar, err := attachmentPath(b.ID, card.ID, a)
+					if err != nil {
+						fmt.Fprintf(os.Stderr, "Error: could not import attachment: %v\n", err)
+						os.Exit(1)
+					}
+					if ok, err := importLegacyAttachment(src, afn, a); err != nil {
+						fmt.Fprintf(os.Stderr, "Error: could not import attachment: %v\n", err)
+						os.Exit(1)
+					} else if !ok {
+						fmt.Printf("--> Missing attachment %s\n", a.URL)
+						missing++
+						continue
+					}
+					if !exists(sidecar) {
+						if err := writeAttachmentInfo(&b.Board, card, a); err != nil {
+							fmt.Fprintf(os.Stderr, "Error: could not import attachment: %v\n", err)
+							os.Exit(1)
+						}
+					}
+					if err := catalogAttachmentFile(cat, assetUnchanged, b.ID, card.ID, a); err != nil {
+						fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+						os.Exit(1)
+					}
+					attachments++
+				}
+			}
+
+			for _, au := range b.Backgrounds {
+				bfn, err := assetPath("backgrounds", au)
+				if err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not parse background url: %v\n", err)
+					os.Exit(1)
+				}
+				if exists(bfn) {
+					continue
+				}
+				if src == "." || !exists(filepath.Join(src, bfn)) {
+					fmt.Printf("--> Missing background %s\n", au)
+					missing++
+					continue
+				}
+				if err := os.MkdirAll(filepath.Dir(bfn), 0755); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not import background: %v\n", err)
+					os.Exit(1)
+				}
+				if err := copyFile(filepath.Join(src, bfn), bfn); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not import background: %v\n", err)
+					os.Exit(1)
+				}
+			}
+
+			name := b.Board.Name
+			if name == "" {
+				name = s.BoardName
+			}
+			if err := cat.PutSnapshot(catalogSnapshot{
+				ID:          newID(),
+				Run:         m.ID,
+				Time:        s.Time,
+				User:        s.Username,
+				BoardID:     b.ID,
+				BoardName:   name,
+				File:        filepath.ToSlash(fn),
+				Size:        size,
+				SHA256:      sum,
+				Counts:      b.Counts,
+				Attachments: b.AttachmentFiles(),
+			}, ""); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+				os.Exit(1)
+			}
+			m.Boards = append(m.Boards, runBoard{ID: b.ID, Name: name, File: filepath.ToSlash(fn), Status: "done"})
+			if m.Finished == nil || s.Time.After(*m.Finished) {
+				t := s.Time
+				m.Finished = &t
+			}
+			snapshots++
+		}
+
+		if len(m.Boards) != 0 {
+			if err := cat.PutRun(m); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+				os.Exit(1)
+			}
+			runs++
+		}
+	}
+
+	fmt.Printf("Imported %d snapshots from %d runs with %d attachments\n", snapshots, runs, attachments)
+	if missing != 0 {
+		fmt.Printf("%d attachments or backgrounds were missing (the next backup will download any which are still on the board)\n", missing)
+	}
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+func ingestCommand(args []string) {
+	fs := flag.NewFlagSet("ingest", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory to add the snapshot to (default: current directory)")
+	at := fs.String("time", "", "when the export was made, in RFC 3339 format (default: the file's modification time)")
+	board := fs.String("board", "", "ID or short link of the board the export should be of (default: don't check)")
+	user := fs.String("user", "", "username of the account the export was made with, to notice if the board stops being accessible to it (default: the logged in user, or the one who last backed up the board)")
+	var af authFlags
+	af.Register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup ingest [options] FILE [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+		fmt.Fprintln(fs.Output(), "Note: FILE is a board JSON export downloaded from Trello (Menu > Print and export > Export as JSON).")
+		fmt.Fprintln(fs.Output(), "Note: Missing attachments and backgrounds are only downloaded if credentials are available.")
+		af.PrintNotes(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || !af.ValidArgs(fs.Args()[1:]) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	src, err := filepath.Abs(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	fi, err := os.Stat(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	t := fi.ModTime()
+	if *at != "" {
+		if t, err = time.Parse(time.RFC3339, *at); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: invalid time: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	s, err := scanBoardFile(src)
+	if err == nil && *board != "" && *board != s.ID && *board != s.ShortLink {
+		err = fmt.Errorf("expected board %q, got %s (%s)", *board, s.ID, s.ShortLink)
+	}
+	if err == nil {
+		err = validateBoard(s.boardSummary, s.ID, nil) // the id was checked above
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid board JSON: %v\n", err)
+		os.Exit(1)
+	}
+
+	// if credentials were specified, they must work, but otherwise it's fine
+	// to only ingest what we have
+	auth, err := af.Authenticator(fs.Args()[1:], os.Stdout)
+	if err != nil {
+		if fs.NArg() > 1 || af.Browser != "" {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("Not downloading missing attachments: %v\n", err)
+		auth = nil
+	}
+
+	chdir(*dir)
+
+	cfg, err := loadStoreConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load config: %v\n", err)
+		os.Exit(1)
+	}
+
+	cat, err := openCatalog(".", false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cat.Close()
+
+	ac, err := loadAssetCache(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load asset cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	m := &runManifest{
+		ID:       newID(),
+		Started:  time.Now(),
+		Ingested: filepath.Base(src),
+	}
+	fmt.Println("Starting run", m.ID)
+
+	var c *http.Client
+	var tt *throttleTransport
+	var username string
+	if auth != nil {
+		if c, err = newClient(auth, os.Stdout); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		tt = newThrottleTransport(c.Transport, 0, 0)
+		c.Transport = tt
+
+		if username, err = getUsername(c); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not get username: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Println("Logged in as", username)
+	}
+
+	if *user != "" {
+		username = *user
+	} else if username == "" {
+		// it was probably exported by the same account as the earlier
+		// backups of the board
+		css, err := cat.Snapshots(s.ID)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+			os.Exit(1)
+		}
+		for i := len(css) - 1; i >= 0 && username == ""; i-- {
+			username = css[i].User
+		}
+		if username != "" {
+			fmt.Printf("Assuming it was exported by %s, who last backed up the board (use -user to change it)\n", username)
+		}
+	}
+	if username == "" {
+		fmt.Println("Warning: the snapshot isn't associated with a user (use -user), so it won't be noticed if the board stops being accessible")
+	}
+
+	fmt.Printf("Ingesting %s (%s) (id: %s)\n", s.Board.Name, s.ShortLink, s.ID)
+
+	nameUser := username
+	if nameUser == "" {
+		nameUser = "ingested" // the placeholder can't be empty
+	}
+	fn := uniqueName(".", snapshotName(cfg.NameTemplate, nameVars{
+		Time:           t,
+		User:           nameUser,
+		BoardID:        s.ID,
+		BoardShortLink: s.ShortLink,
+		BoardName:      s.Board.Name,
+		RunID:          m.ID,
+	}), ".json", m.ID)
+
+	f, err := os.Open(src)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	// the export isn't checked against the previous snapshot since it may
+	// be older than it
+	b, err := saveBoard(f, nil, s.ID, fn, nil)
+	f.Close()
+	if err != nil {
+		var ierr *invalidBoardError
+		if errors.As(err, &ierr) {
+			os.Remove(ierr.tmp)
+		}
+		fmt.Fprintf(os.Stderr, "Error: could not save board JSON: %v\n", err)
+		os.Exit(1)
+	}
+	var raw string
+	if cfg.Format == "canonical" {
+		if err := canonicalizeSnapshot(fn, cfg.Strip, b); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not canonicalize board JSON: %v\n", err)
+			os.Exit(1)
+		}
+		raw = filepath.ToSlash(rawSnapshotPath(fn))
+	}
+	fmt.Printf("--> Saved as %s\n", fn)
+	if b.truncated() {
+		fmt.Println("--> Warning: export is truncated, so older actions are missing (the next backup will save the full board)")
+	}
+
+	var missing int
+	fmt.Println("--> Checking attachments")
+	for _, card := range b.Board.Cards {
+		for _, a := range card.Attachments {
+			if !a.IsUpload {
+				continue // link
+			}
+			afn, sidecar, err := attachmentPath(b.ID, card.ID, a)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not import attachment: %v\n", err)
+				os.Exit(1)
+			}
+			if _, err := importLegacyAttachment(".", afn, a); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not import attachment: %v\n", err)
+				os.Exit(1)
+			}
+			res := assetUnchanged
+			if !exists(afn) {
+				if c == nil {
+					fmt.Printf("    Missing attachment %s\n", a.URL)
+					missing++
+					continue
+				}
+				fmt.Printf("    Downloading attachment %s\n", a.URL)
+				if res, err = saveAttachment(c, ac, &b.Board, card, a); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not download attachment: %v\n", err)
+					os.Exit(1)
+				}
+				m.Attachments++
+			} else if !exists(sidecar) {
+				if err := writeAttachmentInfo(&b.Board, card, a); err != nil {
+					fmt.Fprintf(os.Stderr, "Error: could not write attachment info: %v\n", err)
+					os.Exit(1)
+				}
+			}
+			if err := catalogAttachmentFile(cat, res, b.ID, card.ID, a); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	fmt.Println("--> Checking backgrounds")
+	for _, au := range b.Backgrounds {
+		bfn, err := assetPath("backgrounds", au)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not parse background url: %v\n", err)
+			os.Exit(1)
+		}
+		if exists(bfn) {
+			continue
+		}
+		if c == nil {
+			fmt.Printf("    Missing background %s\n", au)
+			missing++
+			continue
+		}
+		fmt.Printf("    Downloading background %s\n", au)
+		if _, err := fetchAsset(c, ac, au, bfn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not download background: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if err := ac.save("."); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not save asset cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	if err := cat.PutSnapshot(catalogSnapshot{
+		ID:          newID(),
+		Run:         m.ID,
+		Time:        t,
+		User:        username,
+		BoardID:     b.ID,
+		BoardName:   b.Board.Name,
+		File:        filepath.ToSlash(fn),
+		Size:        b.Size,
+		SHA256:      b.SHA256,
+		Counts:      b.Counts,
+		Attachments: b.AttachmentFiles(),
+		Raw:         raw,
+	}, b.ShortLink); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	finished := time.Now()
+	m.Finished = &finished
+	m.Complete = true
+	if tt != nil {
+		m.Bytes = tt.Bytes()
+	}
+	m.Boards = []runBoard{{ID: b.ID, Name: b.Board.Name, File: filepath.ToSlash(fn), Status: "done"}}
+	if err := cat.PutRun(m); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+		os.Exit(1)
+	}
+
+	if missing != 0 {
+		fmt.Printf("%d attachments or backgrounds are missing (run ingest again with credentials to download them)\n", missing)
+	}
+	fmt.Println("Successfully ingested board JSON")
+}
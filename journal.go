@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// The journal is an append-only log of the actions received by the webhook
+// server, saved in the store directory as journal/BOARD_ID.jsonl with one
+// journalEntry per line.
+
+// journalEntry is an action received for a board.
+type journalEntry struct {
+	Received time.Time       `json:"received"`
+	Action   json.RawMessage `json:"action"`
+}
+
+var journalMu sync.Mutex
+
+// appendJournal adds an action to the journal of the board id in the backup
+// directory dir.
+func appendJournal(dir, id string, e journalEntry) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	journalMu.Lock()
+	defer journalMu.Unlock()
+
+	if err := os.MkdirAll(filepath.Join(dir, storeDir, "journal"), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, storeDir, "journal", id+".jsonl"), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(append(buf, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readJournal reads the journal of the board id in the backup directory dir.
+// If there isn't one, it is empty.
+func readJournal(dir, id string) ([]journalEntry, error) {
+	f, err := os.Open(filepath.Join(dir, storeDir, "journal", id+".jsonl"))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var es []journalEntry
+	dec := json.NewDecoder(f)
+	for dec.More() {
+		var e journalEntry
+		if err := dec.Decode(&e); err != nil {
+			return es, fmt.Errorf("decode journal: %w", err) // may have been cut off
+		}
+		es = append(es, e)
+	}
+	return es, nil
+}
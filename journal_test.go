@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if es, err := readJournal(dir, "B1"); err != nil || len(es) != 0 {
+		t.Fatalf("missing journal: expected no entries, got %d (err: %v)", len(es), err)
+	}
+
+	// concurrent appends must not interleave
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			buf, _ := json.Marshal(map[string]int{"n": i})
+			if err := appendJournal(dir, "B1", journalEntry{Received: time.Now(), Action: buf}); err != nil {
+				t.Errorf("append: %v", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	es, err := readJournal(dir, "B1")
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+	seen := map[int]bool{}
+	for _, e := range es {
+		var a struct{ N int }
+		if err := json.Unmarshal(e.Action, &a); err != nil {
+			t.Fatalf("invalid action %s: %v", e.Action, err)
+		}
+		seen[a.N] = true
+	}
+	if len(es) != 20 || len(seen) != 20 {
+		t.Errorf("expected 20 distinct entries, got %d (%d distinct)", len(es), len(seen))
+	}
+
+	// a cut-off last line returns the entries before it
+	f, err := os.OpenFile(filepath.Join(dir, storeDir, "journal", "B1.jsonl"), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.WriteString(`{"received":"2020-01-01T00:00:00Z","act`)
+	f.Close()
+
+	es, err = readJournal(dir, "B1")
+	if err == nil {
+		t.Errorf("expected an error for a truncated journal")
+	}
+	if len(es) != 20 {
+		t.Errorf("expected the 20 complete entries, got %d", len(es))
+	}
+}
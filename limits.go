@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// throttleTransport limits the rate responses are read at, both in total and
+// per host, and counts the bytes read.
+type throttleTransport struct {
+	n        int64 // atomic, first for alignment
+	base     http.RoundTripper
+	global   *rateLimiter
+	hostRate int64
+	mu       sync.Mutex
+	hosts    map[string]*rateLimiter
+}
+
+// newThrottleTransport creates a throttleTransport with the specified limits
+// in bytes per second (or 0 for no limit).
+func newThrottleTransport(base http.RoundTripper, rate, hostRate int64) *throttleTransport {
+	t := &throttleTransport{
+		base:     base,
+		hostRate: hostRate,
+		hosts:    map[string]*rateLimiter{},
+	}
+	if rate > 0 {
+		t.global = &rateLimiter{rate: rate}
+	}
+	return t
+}
+
+func (t *throttleTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+
+	var ls []*rateLimiter
+	if t.global != nil {
+		ls = append(ls, t.global)
+	}
+	if t.hostRate > 0 {
+		t.mu.Lock()
+		l, ok := t.hosts[req.URL.Hostname()]
+		if !ok {
+			l = &rateLimiter{rate: t.hostRate}
+			t.hosts[req.URL.Hostname()] = l
+		}
+		t.mu.Unlock()
+		ls = append(ls, l)
+	}
+
+	resp.Body = &throttledBody{resp.Body, &t.n, ls}
+	return resp, nil
+}
+
+// Bytes returns the number of response bytes read so far.
+func (t *throttleTransport) Bytes() int64 {
+	return atomic.LoadInt64(&t.n)
+}
+
+type throttledBody struct {
+	io.ReadCloser
+	n  *int64
+	ls []*rateLimiter
+}
+
+func (b *throttledBody) Read(p []byte) (int, error) {
+	if len(b.ls) != 0 && len(p) > 32*1024 {
+		p = p[:32*1024] // so it doesn't burst too much
+	}
+	n, err := b.ReadCloser.Read(p)
+	atomic.AddInt64(b.n, int64(n))
+	for _, l := range b.ls {
+		l.Wait(n)
+	}
+	return n, err
+}
+
+// rateLimiter spaces out reads so they average to rate bytes per second.
+type rateLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time // when the bytes read so far will have been paid for
+}
+
+// Wait waits until n more bytes can be read.
+func (l *rateLimiter) Wait(n int) {
+	if n <= 0 {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(float64(n) / float64(l.rate) * float64(time.Second)))
+	d := l.next.Sub(now)
+	l.mu.Unlock()
+	time.Sleep(d)
+}
+
+// runBudget limits how much a backup run can do before it stops. Zero values
+// mean no limit. The limits are checked between files, so they may be
+// exceeded by up to one file.
+type runBudget struct {
+	MaxBytes       int64
+	MaxAttachments int
+	MaxDuration    time.Duration
+}
+
+// Exceeded returns the reason the run should stop, or an empty string if it
+// can continue.
+func (b runBudget) Exceeded(bytes int64, attachments int, elapsed time.Duration) string {
+	switch {
+	case b.MaxBytes > 0 && bytes >= b.MaxBytes:
+		return fmt.Sprintf("reached the byte budget (%s)", formatSize(b.MaxBytes))
+	case b.MaxAttachments > 0 && attachments >= b.MaxAttachments:
+		return fmt.Sprintf("reached the attachment budget (%d)", b.MaxAttachments)
+	case b.MaxDuration > 0 && elapsed >= b.MaxDuration:
+		return fmt.Sprintf("reached the duration budget (%s)", b.MaxDuration)
+	}
+	return ""
+}
+
+// sizeFlag is a flag.Value for a size in bytes, with an optional K, M, or G
+// suffix (powers of 1024).
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return formatSize(int64(*s))
+}
+
+func (s *sizeFlag) Set(v string) error {
+	n, err := parseSize(v)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(n)
+	return nil
+}
+
+func parseSize(s string) (int64, error) {
+	v := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(s)), "B"), "I")
+	mul := int64(1)
+	if len(v) != 0 {
+		switch v[len(v)-1] {
+		case 'K':
+			mul = 1 << 10
+		case 'M':
+			mul = 1 << 20
+		case 'G':
+			mul = 1 << 30
+		}
+		if mul != 1 {
+			v = v[:len(v)-1]
+		}
+	}
+	n, err := strconv.ParseFloat(v, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return int64(n * float64(mul)), nil
+}
+
+func formatSize(n int64) string {
+	switch {
+	case n >= 1<<30 && n%(1<<30) == 0:
+		return strconv.FormatInt(n>>30, 10) + "G"
+	case n >= 1<<20 && n%(1<<20) == 0:
+		return strconv.FormatInt(n>>20, 10) + "M"
+	case n >= 1<<10 && n%(1<<10) == 0:
+		return strconv.FormatInt(n>>10, 10) + "K"
+	}
+	return strconv.FormatInt(n, 10)
+}
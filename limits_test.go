@@ -0,0 +1,211 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testThrottleServer serves /N with N bytes.
+func testThrottleServer() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n, err := parseSize(strings.TrimPrefix(r.URL.Path, "/"))
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(bytes.Repeat([]byte{'x'}, int(n)))
+	}))
+}
+
+// testThrottleGet gets each URL concurrently, returning how long it took.
+func testThrottleGet(t *testing.T, c *http.Client, urls ...string) time.Duration {
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, u := range urls {
+		wg.Add(1)
+		go func(u string) {
+			defer wg.Done()
+			resp, err := c.Get(u)
+			if err != nil {
+				t.Errorf("get %s: %v", u, err)
+				return
+			}
+			defer resp.Body.Close()
+			if _, err := ioutil.ReadAll(resp.Body); err != nil {
+				t.Errorf("read %s: %v", u, err)
+			}
+		}(u)
+	}
+	wg.Wait()
+	return time.Since(start)
+}
+
+func TestThrottleTransportBytes(t *testing.T) {
+	s := testThrottleServer()
+	defer s.Close()
+
+	tt := newThrottleTransport(http.DefaultTransport, 0, 0)
+	c := &http.Client{Transport: tt}
+	if d := testThrottleGet(t, c, s.URL+"/100K", s.URL+"/1M", s.URL+"/0"); d > time.Second {
+		t.Errorf("expected no throttling without a limit, took %s", d)
+	}
+	if n := tt.Bytes(); n != 100<<10+1<<20 {
+		t.Errorf("expected %d bytes read, got %d", 100<<10+1<<20, n)
+	}
+
+	// only the bytes read are counted
+	resp, err := c.Get(s.URL + "/1M")
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 1000)
+	n, _ := resp.Body.Read(buf)
+	resp.Body.Close()
+	if exp := int64(100<<10 + 1<<20 + n); tt.Bytes() != exp {
+		t.Errorf("expected %d bytes read, got %d", exp, tt.Bytes())
+	}
+}
+
+func TestThrottleTransportRate(t *testing.T) {
+	s := testThrottleServer()
+	defer s.Close()
+	other := strings.Replace(s.URL, "127.0.0.1", "localhost", 1) // another host for the same server
+
+	// 256K at 1M/s takes at least 250ms, no matter how it's split
+	for _, c := range []struct {
+		Name           string
+		Rate, HostRate int64
+		URLs           []string
+	}{
+		{"Global", 1 << 20, 0, []string{s.URL + "/256K"}},
+		{"GlobalConcurrent", 1 << 20, 0, []string{s.URL + "/128K", other + "/128K"}},
+		{"Host", 0, 1 << 20, []string{s.URL + "/256K"}},
+		{"HostConcurrent", 0, 1 << 20, []string{s.URL + "/128K", s.URL + "/128K"}},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			tt := newThrottleTransport(http.DefaultTransport, c.Rate, c.HostRate)
+			if d := testThrottleGet(t, &http.Client{Transport: tt}, c.URLs...); d < 240*time.Millisecond {
+				t.Errorf("expected it to be throttled to take at least 250ms, took %s", d)
+			}
+			if tt.Bytes() != 256<<10 {
+				t.Errorf("expected %d bytes read, got %d", 256<<10, tt.Bytes())
+			}
+		})
+	}
+
+	// each host has its own limit
+	tt := newThrottleTransport(http.DefaultTransport, 0, 1<<20)
+	same := testThrottleGet(t, &http.Client{Transport: tt}, s.URL+"/128K", s.URL+"/128K")
+	tt = newThrottleTransport(http.DefaultTransport, 0, 1<<20)
+	separate := testThrottleGet(t, &http.Client{Transport: tt}, s.URL+"/128K", other+"/128K")
+	if separate >= same {
+		t.Errorf("expected different hosts to be limited separately, took %s (vs %s for the same host)", separate, same)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	l := &rateLimiter{rate: 1 << 20}
+
+	start := time.Now()
+	l.Wait(0)
+	l.Wait(-1)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expected no wait for nothing read, took %s", d)
+	}
+
+	// the time is paid for even if read in small pieces
+	for i := 0; i < 64; i++ {
+		l.Wait(2 << 10)
+	}
+	if d := time.Since(start); d < 120*time.Millisecond {
+		t.Errorf("expected 128K at 1M/s to take at least 125ms, took %s", d)
+	}
+
+	// but not for idle time
+	time.Sleep(100 * time.Millisecond)
+	start = time.Now()
+	l.Wait(1 << 10)
+	if d := time.Since(start); d > 50*time.Millisecond {
+		t.Errorf("expected idle time not to be saved up, took %s", d)
+	}
+}
+
+func TestRunBudgetExceeded(t *testing.T) {
+	b := runBudget{MaxBytes: 10 << 20, MaxAttachments: 5, MaxDuration: time.Hour}
+	for _, c := range []struct {
+		Bytes       int64
+		Attachments int
+		Elapsed     time.Duration
+		Reason      string
+	}{
+		{0, 0, 0, ""},
+		{10<<20 - 1, 4, time.Hour - time.Second, ""},
+		{10 << 20, 0, 0, "reached the byte budget (10M)"},
+		{0, 5, 0, "reached the attachment budget (5)"},
+		{0, 0, time.Hour, "reached the duration budget (1h0m0s)"},
+		{20 << 20, 10, 2 * time.Hour, "reached the byte budget (10M)"},
+	} {
+		if act := b.Exceeded(c.Bytes, c.Attachments, c.Elapsed); act != c.Reason {
+			t.Errorf("Exceeded(%d, %d, %s): expected %q, got %q", c.Bytes, c.Attachments, c.Elapsed, c.Reason, act)
+		}
+	}
+
+	if act := (runBudget{}).Exceeded(1<<40, 1<<20, 1000*time.Hour); act != "" {
+		t.Errorf("expected no limits by default, got %q", act)
+	}
+}
+
+func TestBackupRunStop(t *testing.T) {
+	r := &backupRun{
+		tt:     newThrottleTransport(http.DefaultTransport, 0, 0),
+		m:      &runManifest{Started: time.Now()},
+		budget: runBudget{MaxAttachments: 2, MaxDuration: time.Hour},
+	}
+	if r.stop() {
+		t.Fatalf("expected the run not to stop yet")
+	}
+
+	r.m.Attachments = 2
+	if !r.stop() || r.m.Stopped != "reached the attachment budget (2)" {
+		t.Fatalf("expected the run to stop and record why, got %q", r.m.Stopped)
+	}
+
+	// the first reason is kept
+	r.m.Started = r.m.Started.Add(-2 * time.Hour)
+	if !r.stop() || r.m.Stopped != "reached the attachment budget (2)" {
+		t.Errorf("expected the first reason to be kept, got %q", r.m.Stopped)
+	}
+}
+
+func TestParseSize(t *testing.T) {
+	for s, exp := range map[string]int64{
+		"0":     0,
+		"100":   100,
+		"1K":    1 << 10,
+		"1.5M":  3 << 19,
+		"2g":    2 << 30,
+		"10MB":  10 << 20,
+		"10MiB": 10 << 20,
+		" 5k ":  5 << 10,
+	} {
+		if n, err := parseSize(s); err != nil || n != exp {
+			t.Errorf("parseSize(%q): expected %d, got %d (err: %v)", s, exp, n, err)
+		}
+	}
+	for _, s := range []string{"", "K", "-1", "1T", "abc"} {
+		if _, err := parseSize(s); err == nil {
+			t.Errorf("parseSize(%q): expected error", s)
+		}
+	}
+	for n, exp := range map[int64]string{0: "0", 1000: "1000", 1 << 10: "1K", 3 << 19: "1536K", 10 << 20: "10M", 2 << 30: "2G"} {
+		if act := formatSize(n); act != exp {
+			t.Errorf("formatSize(%d): expected %q, got %q", n, exp, act)
+		}
+	}
+}
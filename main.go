@@ -3,14 +3,13 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
-	"net/http/cookiejar"
 	"net/url"
 	"os"
-	"path/filepath"
 	"regexp"
 	"strings"
 	"time"
@@ -18,164 +17,128 @@ import (
 	"github.com/xlzd/gotp"
 )
 
-func main() {
-	if len(os.Args) != 2 && len(os.Args) != 3 && len(os.Args) != 4 {
-		fmt.Println("Usage: trellobackup (TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET])")
-		fmt.Println("Note: If you're using an Atlassian account, you must use the token cookie.")
-		os.Exit(1)
-	}
+// command is a subcommand.
+type command struct {
+	Name string // may have multiple words
+	Args string
+	Help string
+	Run  func(args []string)
+}
 
-	c := &http.Client{}
-	c.Jar, _ = cookiejar.New(nil)
+var commands []command
+
+func init() {
+	commands = []command{
+		{"backup", "[options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]", "back up boards and attachments (default)", backupCommand},
+		{"boards list", "[options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]", "list the boards which would be backed up", boardsListCommand},
+		{"boards history", "[options] BOARD", "show the snapshots and failures of a board", boardsHistoryCommand},
+		{"snapshots list", "[options]", "list saved snapshots", snapshotsListCommand},
+		{"snapshots show", "[options] SNAPSHOT", "show a snapshot's details from the catalog", snapshotsShowCommand},
+		{"import-legacy", "[options]", "add backups from older versions to the catalog", importLegacyCommand},
+		{"ingest", "[options] FILE [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]", "add a board JSON exported from Trello to the catalog", ingestCommand},
+		{"webhooks serve", "[options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]", "back up boards as they change using webhooks", webhooksServeCommand},
+		{"webhooks test", "[options] BOARD_ID", "send signed test webhooks to webhooks serve", webhooksTestCommand},
+		{"reconstruct", "[options] BOARD TIME", "reconstruct a board at any time from snapshots and actions", reconstructCommand},
+		{"compact", "[options]", "convert snapshots between full and delta storage", compactCommand},
+		{"keygen", "", "generate a key for signing runs", keygenCommand},
+		{"verify", "[options] [SNAPSHOT...]", "check saved snapshots and their attachments", verifyCommand},
+		{"export", "[options] SNAPSHOT", "export a snapshot as CSV or Markdown", exportCommand},
+		{"restore", "[options] SNAPSHOT [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]", "restore a snapshot as a new board", restoreCommand},
+		{"whoami", "[options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]", "show account and token info", whoamiCommand},
+		{"login", "-key API_KEY [options]", "get an API token and save it", loginCommand},
+		{"help", "", "show this help", func([]string) { usage(os.Stdout); os.Exit(0) }},
+	}
+}
 
-	switch len(os.Args) - 1 {
-	case 1:
-		fmt.Println("Logging in with token cookie")
-		u, err := url.Parse("https://trello.com")
-		if err != nil {
-			panic(err)
+func main() {
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "-h", "-help", "--help":
+			usage(os.Stdout)
+			os.Exit(0)
 		}
-		c.Jar.SetCookies(u, []*http.Cookie{&http.Cookie{
-			Name:     "token",
-			Domain:   "trello.com",
-			Path:     "/",
-			Expires:  time.Now().Add(time.Hour),
-			SameSite: http.SameSiteDefaultMode,
-			HttpOnly: false,
-			Value:    os.Args[1],
-		}})
-	case 2, 3:
-		fmt.Println("Logging in with Trello account")
-		var password, totp string
-		username, password, totp := os.Args[1], os.Args[2], ""
+	}
 
-		if len(os.Args) == 4 {
-			totp = os.Args[3]
+	cmd, args := findCommand(os.Args[1:])
+	if cmd == nil {
+		if len(os.Args) > 1 && isCommandGroup(os.Args[1]) {
+			usage(os.Stderr)
+			os.Exit(2)
 		}
+		cmd, args = &commands[0], os.Args[1:] // backwards compatibility
+	}
+	cmd.Run(args)
+	os.Exit(0)
+}
 
-		fmt.Println("Getting login token")
-		token, err := getLoginToken(c)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: could not get login token: %v\n", err)
-			os.Exit(1)
+// findCommand finds the command for args, returning the remaining arguments.
+func findCommand(args []string) (*command, []string) {
+	for i, cmd := range commands {
+		w := strings.Fields(cmd.Name)
+		if len(args) < len(w) {
+			continue
 		}
-
-		fmt.Println("Authenticating")
-		authentication, err := getAuthentication(c, username, password, "")
-		if err != nil && strings.Contains(err.Error(), "TWO_FACTOR_MISSING") {
-			if totp == "" {
-				fmt.Fprintf(os.Stderr, "Error: could not authenticate: second factor required\n")
-				os.Exit(1)
+		match := true
+		for j := range w {
+			if args[j] != w[j] {
+				match = false
+				break
 			}
-			authentication, err = getAuthentication(c, username, password, totp)
 		}
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: could not authenticate: %v\n", err)
-			os.Exit(1)
+		if match {
+			return &commands[i], args[len(w):]
 		}
+	}
+	return nil, nil
+}
 
-		fmt.Println("Updating session info")
-		err = updateSession(c, authentication, token)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: could not update session info: %v\n", err)
-			os.Exit(1)
+// isCommandGroup checks if s is the first word of a multi-word command.
+func isCommandGroup(s string) bool {
+	for _, cmd := range commands {
+		if w := strings.Fields(cmd.Name); len(w) > 1 && w[0] == s {
+			return true
 		}
-	default:
-		panic("invalid arguments")
 	}
+	return false
+}
 
-	username, err := getUsername(c)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: could not get username: %v\n", err)
-		os.Exit(1)
+func usage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: trellobackup COMMAND [options] [args]")
+	fmt.Fprintln(w, "       trellobackup [options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Commands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-15s %s\n", cmd.Name, cmd.Help)
 	}
-	fmt.Println("Logged in as", username)
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Use trellobackup COMMAND -h for more information about a command.")
+	fmt.Fprintln(w, "If no command is specified, backup is used.")
+}
 
-	fmt.Println("Getting boards")
-	boards, err := getBoards(c)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error: could not get boards: %v\n", err)
+// chdir changes to the backup directory if it is set.
+func chdir(dir string) {
+	if dir == "" {
+		return
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not create backup directory: %v\n", err)
 		os.Exit(1)
 	}
-
-	for _, board := range boards {
-		if board.Closed {
-			fmt.Printf("Skipping closed board %s (%s) (id: %s)\n", board.Name, board.ShortLink, board.ID)
-			continue
-		}
-
-		fmt.Printf("Backing up %s (%s) (id: %s)\n", board.Name, board.ShortLink, board.ID)
-		fmt.Println("--> Saving JSON")
-		resp, err := c.Get(board.ShortURL + ".json")
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: could not get board JSON (trellobackup may need to be updated): %v\n", err)
-			os.Exit(1)
-		}
-
-		buf, err := ioutil.ReadAll(resp.Body)
-		resp.Body.Close()
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: could not read response body: %v\n", err)
-			os.Exit(1)
-		}
-
-		err = ioutil.WriteFile(fmt.Sprintf(
-			"trello_%s_%s_%s_%s.json",
-			time.Now().Format("2006-01-02_15-04"),
-			username,
-			board.ID,
-			regexp.MustCompile("[^a-zA-Z0-9_)(-]+").ReplaceAllString(board.Name, ""),
-		), buf, 0644)
-		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error: could not save file: %v\n", err)
-			os.Exit(1)
-		}
-
-		for _, t := range []string{"attachments", "backgrounds"} {
-			ts := strings.TrimRight(t, "s")
-
-			fmt.Printf("--> Downloading %s\n", t)
-			for _, m := range regexp.MustCompile(`"url": ?"(https?://trello-`+t+`.s3.amazonaws.com/[^"]+)"`).FindAllStringSubmatch(string(buf), -1) {
-				fmt.Printf("    Downloading %s %s\n", ts, m[1])
-
-				u, err := url.Parse(m[1])
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: could not parse %s url: %v\n", ts, err)
-					os.Exit(1)
-				}
-
-				fn := filepath.Join(t, strings.Replace(u.Path, "/", "_", -1))
-				if _, err := os.Stat(fn); err == nil {
-					continue // already downloaded
-				}
-
-				resp, err := c.Get(m[1])
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "Error: could not get %s: %v\n", ts, err)
-					os.Exit(1)
-				}
-
-				os.MkdirAll(t, 0755)
-				f, err := os.Create(fn)
-				if err != nil {
-					resp.Body.Close()
-					fmt.Fprintf(os.Stderr, "Error: could not create file for %s: %v\n", ts, err)
-					os.Exit(1)
-				}
-
-				_, err = io.Copy(f, resp.Body)
-				resp.Body.Close()
-				if err != nil {
-					resp.Body.Close()
-					fmt.Fprintf(os.Stderr, "Error: could not download %s: %v\n", ts, err)
-					os.Exit(1)
-				}
-			}
-		}
+	if err := os.Chdir(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not change to backup directory: %v\n", err)
+		os.Exit(1)
 	}
+}
 
-	fmt.Println("Successfully backed up Trello data")
-	os.Exit(0)
+// isFlagSet checks whether the flag name was set on fs.
+func isFlagSet(fs *flag.FlagSet, name string) bool {
+	var set bool
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func getLoginToken(c *http.Client) (string, error) {
@@ -251,11 +214,17 @@ func getUsername(c *http.Client) (string, error) {
 	return obj.Username, nil
 }
 
-func getBoards(c *http.Client) (boards []struct {
+type boardInfo struct {
 	ShortURL, ShortLink, ID, Name string
+	IDOrganization                string
 	Closed                        bool
-}, err error) {
-	resp, err := c.Get("https://trello.com/1/Members/me/boards")
+	DateLastActivity              *time.Time
+	Memberships                   []struct{ IDMember string }
+	Organization                  *struct{ ID, Name, DisplayName string }
+}
+
+func getBoards(c *http.Client) (boards []boardInfo, err error) {
+	resp, err := c.Get("https://trello.com/1/Members/me/boards?organization=true&organization_fields=name,displayName")
 	if err != nil {
 		return nil, fmt.Errorf("could not send request to api (trellobackup may need to be updated): %w", err)
 	}
@@ -266,3 +235,139 @@ func getBoards(c *http.Client) (boards []struct {
 	}
 	return boards, nil
 }
+
+// authFlags are the flags and arguments for choosing how to log in.
+type authFlags struct {
+	Atlassian bool
+	Browser   string
+	Profile   string
+}
+
+// Register adds the flags to fs.
+func (f *authFlags) Register(fs *flag.FlagSet) {
+	fs.BoolVar(&f.Atlassian, "atlassian", false, "log in with an Atlassian account instead of a Trello one")
+	fs.StringVar(&f.Browser, "browser", "", "import the token cookie from a browser (firefox, chromium)")
+	fs.StringVar(&f.Profile, "profile", "", "browser profile directory or cookie database to use with -browser (default: most recently used)")
+}
+
+// PrintNotes writes the usage notes for the credential arguments.
+func (f *authFlags) PrintNotes(w io.Writer) {
+	fmt.Fprintln(w, "Note: If you're using an Atlassian account, use -atlassian, the token cookie, or an API token.")
+	fmt.Fprintln(w, "Note: If no credentials are specified, the API token saved by the login command is used.")
+	fmt.Fprintln(w, "Note: Credentials can be secret references (vault:PATH#FIELD, pass:NAME, cmd:COMMAND).")
+}
+
+// ValidArgs checks whether the credential arguments are valid with the flags.
+func (f *authFlags) ValidArgs(args []string) bool {
+	return len(args) <= 3 && (f.Browser == "" || len(args) == 0) && (!f.Atlassian || len(args) >= 2)
+}
+
+// Authenticator creates the authenticator for the credential arguments,
+// writing progress messages to w.
+func (f *authFlags) Authenticator(args []string, w io.Writer) (authenticator, error) {
+	args = append([]string(nil), args...)
+	for i, arg := range args {
+		v, err := resolveSecret(arg)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve secret: %w", err)
+		}
+		args[i] = v
+	}
+
+	switch len(args) {
+	case 0:
+		if f.Browser != "" {
+			fmt.Fprintf(w, "Importing token cookie from %s\n", f.Browser)
+			token, err := browserCookie(f.Browser, f.Profile)
+			if err != nil {
+				return nil, fmt.Errorf("could not import token cookie: %w", err)
+			}
+			return tokenCookieAuth(token), nil
+		}
+		cr, err := loadCredentials()
+		if err != nil {
+			return nil, fmt.Errorf("could not load credentials: %w", err)
+		}
+		if cr.APIToken == "" {
+			return nil, errors.New("no credentials specified and no saved API token (use trellobackup login)")
+		}
+		key, err := resolveSecret(cr.APIKey)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve secret: %w", err)
+		}
+		token, err := resolveSecret(cr.APIToken)
+		if err != nil {
+			return nil, fmt.Errorf("could not resolve secret: %w", err)
+		}
+		return apiTokenAuth{Key: key, Token: token}, nil
+	case 1:
+		return tokenCookieAuth(args[0]), nil
+	case 2, 3:
+		var totp string
+		if len(args) == 3 {
+			totp = args[2]
+		}
+		if f.Atlassian {
+			return &atlassianAuth{Username: args[0], Password: args[1], TOTPSecret: totp}, nil
+		}
+		return &trelloAuth{Username: args[0], Password: args[1], TOTPSecret: totp}, nil
+	default:
+		panic("invalid arguments")
+	}
+}
+
+// apiRequest sends a request to the Trello API and decodes the response into
+// obj (if not nil). For sessions (rather than API tokens), the dsc cookie is
+// included as required by Trello for requests which modify things.
+func apiRequest(c *http.Client, method, path string, params url.Values, obj interface{}) error {
+	u, err := url.Parse("https://trello.com/1/" + strings.TrimLeft(path, "/"))
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	if method != http.MethodGet && c.Jar != nil {
+		for _, ck := range c.Jar.Cookies(u) {
+			if ck.Name == "dsc" {
+				q.Set("dsc", ck.Value)
+			}
+		}
+	}
+
+	var req *http.Request
+	if method == http.MethodGet {
+		u.RawQuery = q.Encode()
+		req, err = http.NewRequest(method, u.String(), nil)
+	} else {
+		req, err = http.NewRequest(method, u.String(), strings.NewReader(q.Encode()))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return fmt.Errorf("send api request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		buf, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		if msg := strings.TrimSpace(string(buf)); msg != "" && !isHTML(resp) {
+			return fmt.Errorf("response status %s: %s", resp.Status, msg)
+		}
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+	if obj != nil {
+		if err := json.NewDecoder(resp.Body).Decode(obj); err != nil {
+			return fmt.Errorf("decode json: %w", err)
+		}
+	}
+	return nil
+}
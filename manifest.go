@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// runManifest records what a backup run did, saved in the store directory as
+// runs/RUN_ID.json. It is updated after each board, so if a run is stopped
+// early (or crashes), the next one can continue where it left off.
+type runManifest struct {
+	ID          string     `json:"id"`
+	Started     time.Time  `json:"started"`
+	Finished    *time.Time `json:"finished,omitempty"`
+	Complete    bool       `json:"complete"`
+	Stopped     string     `json:"stopped,omitempty"`  // why the run was stopped early
+	Resumed     string     `json:"resumed,omitempty"`  // the incomplete run this one continued
+	Imported    bool       `json:"imported,omitempty"` // if it was created from legacy backups by import-legacy
+	Ingested    string     `json:"ingested,omitempty"` // the file it was created from by ingest
+	Bytes       int64      `json:"bytes"`
+	Attachments int        `json:"attachments"`
+	Boards      []runBoard `json:"boards"`
+}
+
+type runBoard struct {
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	File   string `json:"file,omitempty"`
+	Status string `json:"status"`        // done, partial (stopped before the assets were done), failed, or vanished (no longer accessible)
+	Run    string `json:"run,omitempty"` // the earlier run which did it, if this one continued it or the board vanished
+}
+
+// Board returns the board with the specified ID, or nil.
+func (m *runManifest) Board(id string) *runBoard {
+	for i := range m.Boards {
+		if m.Boards[i].ID == id {
+			return &m.Boards[i]
+		}
+	}
+	return nil
+}
+
+// SetBoard adds or replaces a board.
+func (m *runManifest) SetBoard(rb runBoard) {
+	if b := m.Board(rb.ID); b != nil {
+		*b = rb
+	} else {
+		m.Boards = append(m.Boards, rb)
+	}
+}
+
+// loadRunManifests loads the manifests for the backup directory dir, oldest
+// first.
+func loadRunManifests(dir string) ([]*runManifest, error) {
+	fns, err := filepath.Glob(filepath.Join(dir, storeDir, "runs", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	var ms []*runManifest
+	for _, fn := range fns {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		var m runManifest
+		if err := json.Unmarshal(buf, &m); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", filepath.Base(fn), err)
+		}
+		if m.ID != strings.TrimSuffix(filepath.Base(fn), ".json") {
+			return nil, fmt.Errorf("decode %s: wrong run id %q", filepath.Base(fn), m.ID)
+		}
+		ms = append(ms, &m)
+	}
+	sort.SliceStable(ms, func(i, j int) bool {
+		return ms[i].Started.Before(ms[j].Started)
+	})
+	return ms, nil
+}
+
+// save writes the manifest for the backup directory dir.
+func (m *runManifest) save(dir string) error {
+	buf, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, storeDir, "runs"), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, storeDir, "runs", m.ID+".json"), buf, 0644)
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// defaultNameTemplate is the default template for snapshot filenames.
+const defaultNameTemplate = "trello_{time}_{user}_{board_id}_{board_name}"
+
+// nameTimeFormat is RFC 3339 in UTC, with the colons replaced so it's valid on
+// all filesystems.
+const nameTimeFormat = "2006-01-02T15-04-05Z"
+
+// maxNameBytes is the maximum length of a snapshot filename. Most filesystems
+// allow 255 bytes, but this leaves some room for the backup directory on
+// systems with a path length limit.
+const maxNameBytes = 200
+
+// namePlaceholders are the placeholders which can be used in a name template,
+// and the regexp to match them when parsing a filename.
+var namePlaceholders = map[string]string{
+	"time":            `[0-9]{4}-[0-9]{2}-[0-9]{2}T[0-9]{2}-[0-9]{2}-[0-9]{2}Z`,
+	"user":            `.+?`,
+	"board_id":        `[0-9a-f]{24}`,
+	"board_shortlink": `[a-zA-Z0-9]+`,
+	"board_name":      `.*?`,
+	"run_id":          `[0-9a-f]+`,
+}
+
+var namePlaceholderRe = regexp.MustCompile(`\{([a-z_]+)\}`)
+
+// nameVars are the values for the placeholders in a name template.
+type nameVars struct {
+	Time                                     time.Time
+	User, BoardID, BoardShortLink, BoardName string
+	RunID                                    string
+}
+
+// newID generates a random ID for a backup run or snapshot.
+func newID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// checkNameTemplate ensures a name template is usable.
+func checkNameTemplate(tmpl string) error {
+	if strings.ContainsAny(tmpl, `/\`) {
+		return errors.New("template must not contain path separators")
+	}
+	for _, m := range namePlaceholderRe.FindAllStringSubmatch(tmpl, -1) {
+		if _, ok := namePlaceholders[m[1]]; !ok {
+			return fmt.Errorf("unknown placeholder {%s}", m[1])
+		}
+	}
+	if !strings.Contains(tmpl, "{board_id}") {
+		return errors.New("template must contain {board_id}")
+	}
+	if !strings.Contains(tmpl, "{time}") && !strings.Contains(tmpl, "{run_id}") {
+		return errors.New("template must contain {time} or {run_id}")
+	}
+	return nil
+}
+
+// snapshotName generates a filename (without the extension) for a snapshot.
+// It's kept within maxNameBytes (including room for a collision suffix and
+// the extension) by shortening the board name, then the username, and as a
+// last resort (i.e., if the template itself is too long), the name itself.
+func snapshotName(tmpl string, v nameVars) string {
+	repl := func(user, name string) string {
+		return namePlaceholderRe.ReplaceAllStringFunc(tmpl, func(p string) string {
+			switch p[1 : len(p)-1] {
+			case "time":
+				return v.Time.UTC().Format(nameTimeFormat)
+			case "user":
+				return user
+			case "board_id":
+				return v.BoardID
+			case "board_shortlink":
+				return v.BoardShortLink
+			case "board_name":
+				return name
+			case "run_id":
+				return v.RunID
+			}
+			return p
+		})
+	}
+	max := maxNameBytes - len("_00000000-00.json")
+
+	user, name := slugify(v.User), slugify(v.BoardName)
+	if name == "" {
+		name = v.BoardShortLink
+	}
+	if n, over := strings.Count(tmpl, "{board_name}"), len(repl(user, name))-max; n != 0 && over > 0 {
+		name = truncateUTF8(name, len(name)-(over+n-1)/n)
+	}
+	if n, over := strings.Count(tmpl, "{user}"), len(repl(user, name))-max; n != 0 && over > 0 {
+		user = truncateUTF8(user, len(user)-(over+n-1)/n)
+	}
+	return strings.TrimRight(truncateUTF8(repl(user, name), max), ".")
+}
+
+// uniqueName returns the path for a new file named name with ext in dir. If
+// it already exists (including as a delta), the run ID (then a counter) is
+// appended.
+func uniqueName(dir, name, ext, runID string) string {
+	fn := filepath.Join(dir, name+ext)
+	for i := 1; ; i++ {
+		if _, err := os.Lstat(fn); os.IsNotExist(err) && !exists(fn+patchExt) {
+			return fn
+		}
+		if i == 1 {
+			fn = filepath.Join(dir, name+"_"+runID+ext)
+		} else {
+			fn = filepath.Join(dir, name+"_"+runID+"-"+strconv.Itoa(i)+ext)
+		}
+	}
+}
+
+// slugify makes s safe to use in a filename. Letters, numbers, and symbols
+// from any script are kept, but whitespace and characters which aren't
+// allowed on common filesystems are replaced by dashes.
+func slugify(s string) string {
+	var b strings.Builder
+	var dash bool
+	for _, r := range s {
+		if r == utf8.RuneError || unicode.IsSpace(r) || unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) || unicode.Is(unicode.Cf, r) {
+			dash = b.Len() != 0
+			continue
+		}
+		if dash {
+			b.WriteByte('-')
+			dash = false
+		}
+		b.WriteRune(r)
+	}
+	return strings.TrimRight(b.String(), ".") // not allowed at the end on Windows
+}
+
+// sanitizeFilename replaces characters which aren't allowed in filenames on
+// common filesystems with underscores, but otherwise keeps the name as-is.
+func sanitizeFilename(s string) string {
+	s = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, s)
+	s = strings.TrimRight(strings.TrimSpace(s), ".")
+	if s == "." || s == ".." {
+		return ""
+	}
+	return truncateUTF8(s, maxNameBytes)
+}
+
+// truncateUTF8 truncates s to at most n bytes without splitting a character.
+func truncateUTF8(s string, n int) string {
+	if n <= 0 {
+		return ""
+	}
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// nameTemplateRegexp creates a regexp to parse filenames generated by a
+// template, including any collision suffix.
+func nameTemplateRegexp(tmpl string) *regexp.Regexp {
+	var b strings.Builder
+	b.WriteString("^")
+	var last int
+	seen := map[string]bool{}
+	for _, m := range namePlaceholderRe.FindAllStringSubmatchIndex(tmpl, -1) {
+		b.WriteString(regexp.QuoteMeta(tmpl[last:m[0]]))
+		if name := tmpl[m[2]:m[3]]; seen[name] {
+			fmt.Fprintf(&b, "(?:%s)", namePlaceholders[name])
+		} else {
+			fmt.Fprintf(&b, "(?P<%s>%s)", name, namePlaceholders[name])
+			seen[name] = true
+		}
+		last = m[1]
+	}
+	b.WriteString(regexp.QuoteMeta(tmpl[last:]))
+	b.WriteString(`(?:_[0-9a-f]{8}(?:-[0-9]+)?)?\.json$`)
+	return regexp.MustCompile(b.String())
+}
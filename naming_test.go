@@ -0,0 +1,226 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+func TestSlugify(t *testing.T) {
+	for _, c := range []struct {
+		In, Out string
+	}{
+		{"Board", "Board"},
+		{"My Board", "My-Board"},
+		{"  My \t Board\n", "My-Board"},
+		{"a/b\\c:d*e?f\"g<h>i|j", "a-b-c-d-e-f-g-h-i-j"},
+		{"Доска проекта", "Доска-проекта"},
+		{"看板 計画", "看板-計画"},
+		{"🚀 Launch 🎉", "🚀-Launch-🎉"},
+		{"a\u200bb\u00adc", "a-b-c"},
+		{"a\x00b\x1fc", "a-b-c"},
+		{"a\xffb", "a-b"},
+		{"Board...", "Board"},
+		{"v1.0 & more!", "v1.0-&-more!"},
+		{"/?*:", ""},
+		{"...", ""},
+		{"", ""},
+	} {
+		if act := slugify(c.In); act != c.Out {
+			t.Errorf("slugify(%q): expected %q, got %q", c.In, c.Out, act)
+		}
+	}
+}
+
+func TestCheckNameTemplate(t *testing.T) {
+	for _, c := range []struct {
+		Template string
+		Err      string
+	}{
+		{defaultNameTemplate, ""},
+		{"{board_id}_{run_id}", ""},
+		{"{time}-{board_shortlink}-{board_id}", ""},
+		{"backup {board_name} {time} {board_id}", ""},
+		{"{time}/{board_id}", "path separators"},
+		{"{time}\\{board_id}", "path separators"},
+		{"{time}_{board_id}_{board}", "unknown placeholder {board}"},
+		{"{time}_{board_name}", "must contain {board_id}"},
+		{"{board_id}_{board_name}", "must contain {time} or {run_id}"},
+	} {
+		err := checkNameTemplate(c.Template)
+		if c.Err == "" && err != nil {
+			t.Errorf("template %q: unexpected error: %v", c.Template, err)
+		} else if c.Err != "" && (err == nil || !strings.Contains(err.Error(), c.Err)) {
+			t.Errorf("template %q: expected error %q, got %v", c.Template, c.Err, err)
+		}
+	}
+}
+
+func TestSnapshotName(t *testing.T) {
+	v := nameVars{
+		Time:           time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("", -5*60*60)),
+		User:           "some user",
+		BoardID:        "5f0000000000000000000001",
+		BoardShortLink: "AbCd1234",
+		BoardName:      "🚀 My Board",
+		RunID:          "0123abcd",
+	}
+	if exp, act := "trello_2020-01-02T08-04-05Z_some-user_5f0000000000000000000001_🚀-My-Board", snapshotName(defaultNameTemplate, v); act != exp {
+		t.Errorf("expected %q, got %q", exp, act)
+	}
+
+	v.BoardName = "???"
+	if exp, act := "trello_2020-01-02T08-04-05Z_some-user_5f0000000000000000000001_AbCd1234", snapshotName(defaultNameTemplate, v); act != exp {
+		t.Errorf("expected the short link for an empty board name, got %q", act)
+	}
+}
+
+func TestSnapshotNameLength(t *testing.T) {
+	long := strings.Repeat("ж", maxNameBytes)
+	for _, c := range []struct {
+		Name        string
+		Template    string
+		User, Board string
+		KeepUser    bool // whether the full username is expected
+		KeepBoard   bool // whether the full board name is expected
+		Parse       bool // whether it's expected to be parsed back
+	}{
+		{Name: "Short", Template: defaultNameTemplate, User: "user", Board: "Board", KeepUser: true, KeepBoard: true, Parse: true},
+		{Name: "LongBoard", Template: defaultNameTemplate, User: "user", Board: long, KeepUser: true, Parse: true},
+		{Name: "LongUser", Template: defaultNameTemplate, User: long, Board: "Board", Parse: true},
+		{Name: "LongBoth", Template: defaultNameTemplate, User: long, Board: long, Parse: true},
+		{Name: "RepeatedBoard", Template: "{board_name}_{time}_{board_id}_{board_name}", User: "user", Board: long, Parse: true},
+		{Name: "LongTemplate", Template: strings.Repeat("x", maxNameBytes) + "_{time}_{board_id}", User: "user", Board: "Board"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			v := nameVars{
+				Time:           time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+				User:           c.User,
+				BoardID:        "5f0000000000000000000001",
+				BoardShortLink: "AbCd1234",
+				BoardName:      c.Board,
+				RunID:          "0123abcd",
+			}
+			name := snapshotName(c.Template, v)
+
+			fn := name + "_0123abcd-99.json"
+			if len(fn) > maxNameBytes {
+				t.Errorf("expected the filename to be at most %d bytes, got %d: %s", maxNameBytes, len(fn), fn)
+			}
+			if !utf8.ValidString(name) {
+				t.Errorf("expected valid UTF-8, got %q", name)
+			}
+
+			s, ok := parseSnapshotName([]*regexp.Regexp{nameTemplateRegexp(c.Template)}, fn)
+			if ok != c.Parse {
+				t.Fatalf("expected parsed=%t for %s", c.Parse, fn)
+			}
+			if !ok {
+				return
+			}
+			if s.BoardID != v.BoardID || !s.Time.Equal(v.Time) {
+				t.Errorf("incorrect board id or time: %+v", s)
+			}
+			if c.KeepUser != (s.Username == c.User) || !strings.HasPrefix(c.User, s.Username) {
+				t.Errorf("expected username=%q (full=%t), got %q", c.User, c.KeepUser, s.Username)
+			}
+			if c.KeepBoard != (s.BoardName == c.Board) || !strings.HasPrefix(c.Board, s.BoardName) {
+				t.Errorf("expected board name=%q (full=%t), got %q", c.Board, c.KeepBoard, s.BoardName)
+			}
+		})
+	}
+}
+
+func TestSnapshotNameRegexps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	v := nameVars{
+		Time:           time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		User:           "some_user",
+		BoardID:        "5f0000000000000000000001",
+		BoardShortLink: "AbCd1234",
+		BoardName:      "Доска 🚀 v1.0",
+		RunID:          "0123abcd",
+	}
+
+	// snapshots saved with the default template, then another one
+	cfg, err := loadStoreConfig(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn1 := uniqueName(dir, snapshotName(cfg.NameTemplate, v), ".json", v.RunID)
+	if err := ioutil.WriteFile(fn1, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	fn2 := uniqueName(dir, snapshotName(cfg.NameTemplate, v), ".json", v.RunID)
+	if err := ioutil.WriteFile(fn2, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.SetNameTemplate("{board_shortlink}-{run_id}-{board_id}"); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Join(dir, storeDir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := cfg.save(dir); err != nil {
+		t.Fatal(err)
+	}
+	fn3 := uniqueName(dir, snapshotName(cfg.NameTemplate, v), ".json", v.RunID)
+	if err := ioutil.WriteFile(fn3, []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// not a snapshot
+	if err := ioutil.WriteFile(filepath.Join(dir, "other.json"), []byte("{}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := snapshotNameRegexps(dir)
+	if err != nil {
+		t.Fatalf("load regexps: %v", err)
+	}
+	if len(res) != 2 {
+		t.Fatalf("expected the current and old template, got %d regexps", len(res))
+	}
+
+	for _, c := range []struct {
+		Path string
+		Exp  snapshot
+	}{
+		{fn1, snapshot{Time: v.Time, Username: "some_user", BoardID: v.BoardID, BoardName: "Доска-🚀-v1.0"}},
+		{fn2, snapshot{Time: v.Time, Username: "some_user", BoardID: v.BoardID, BoardName: "Доска-🚀-v1.0"}},
+		{fn3, snapshot{BoardID: v.BoardID, RunID: v.RunID}},
+	} {
+		s, ok := parseSnapshotName(res, c.Path)
+		if !ok {
+			t.Errorf("%s: not parsed", filepath.Base(c.Path))
+			continue
+		}
+		if c.Exp.Time.IsZero() {
+			c.Exp.Time = s.Time // from the mtime
+		}
+		c.Exp.Path = c.Path
+		if s != c.Exp {
+			t.Errorf("%s: expected %+v, got %+v", filepath.Base(c.Path), c.Exp, s)
+		}
+	}
+	if _, ok := parseSnapshotName(res, filepath.Join(dir, "other.json")); ok {
+		t.Errorf("expected other files not to be parsed")
+	}
+
+	ss, err := listSnapshots(dir)
+	if err != nil {
+		t.Fatalf("list snapshots: %v", err)
+	}
+	if len(ss) != 3 {
+		t.Errorf("expected 3 snapshots, got %d", len(ss))
+	}
+}
@@ -0,0 +1,277 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"runtime"
+	"strings"
+)
+
+// callbackPage is served at the return URL. Trello puts the token in the
+// fragment, so it needs to be sent back to the listener, along with the state
+// from the return URL's query.
+const callbackPage = `<!DOCTYPE html>
+<html>
+<head><title>trellobackup</title></head>
+<body>
+<p id="msg">Sending token to trellobackup...</p>
+<script>
+var m = /token=([^&]+)/.exec(location.hash), p = document.getElementById("msg"), u = "/token" + location.search;
+if (m) {
+	fetch(u, {method: "POST", body: decodeURIComponent(m[1])}).then(function(r) {
+		p.textContent = r.ok ? "Logged in. You can close this window." : "Error: " + r.statusText;
+	});
+} else {
+	p.textContent = "Error: authorization denied.";
+	fetch(u, {method: "POST", body: ""});
+}
+</script>
+</body>
+</html>
+`
+
+var tokenRe = regexp.MustCompile(`^[a-zA-Z0-9]+$`)
+
+func loginCommand(args []string) {
+	fs := flag.NewFlagSet("login", flag.ExitOnError)
+	key := fs.String("key", "", "Trello API key (from https://trello.com/app-key)")
+	scope := fs.String("scope", "read", "comma-separated scopes to request (read, write, account)")
+	expiration := fs.String("expiration", "never", "token expiration (1hour, 1day, 30days, never)")
+	endpoint := fs.String("endpoint", "https://trello.com/1/authorize", "authorize endpoint")
+	noBrowser := fs.Bool("no-browser", false, "don't try to open a browser")
+	paste := fs.Bool("paste", false, "don't start a callback listener, paste the token instead")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup login -key API_KEY [options]")
+		fmt.Fprintln(fs.Output(), "Note: The return URL (http://127.0.0.1) must be an allowed origin for the API key.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *key == "" || fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var open func(string) error
+	if !*noBrowser {
+		open = openBrowser
+	}
+
+	token, err := authorize(context.Background(), *endpoint, url.Values{
+		"key":        {*key},
+		"name":       {"trellobackup"},
+		"scope":      {*scope},
+		"expiration": {*expiration},
+	}, !*paste, open, os.Stdin)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get token: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println("Checking token")
+	c, err := newClient(apiTokenAuth{Key: *key, Token: token}, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	username, err := getUsername(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get username: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Logged in as", username)
+
+	cr, err := loadCredentials()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load credentials: %v\n", err)
+		os.Exit(1)
+	}
+	cr.APIKey, cr.APIToken = *key, token
+	if err := cr.save(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not save credentials: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Saved API token")
+}
+
+// authorize gets an API token from the authorize endpoint with the specified
+// params. If listen is true, the token is received by a listener on localhost
+// set as the return URL. The token can also be pasted into r. If open is not
+// nil, it is used to open the authorize URL.
+func authorize(ctx context.Context, endpoint string, params url.Values, listen bool, open func(string) error, r io.Reader) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	res := make(chan string, 1)
+	errc := make(chan error, 2)
+
+	q := url.Values{}
+	for k, v := range params {
+		q[k] = v
+	}
+	q.Set("response_type", "token")
+
+	if listen {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return "", fmt.Errorf("start callback listener: %w", err)
+		}
+		// any page open in the browser can post to the listener, so only
+		// accept the token along with a random state (it's in the query
+		// rather than the fragment since Trello replaces the fragment)
+		state, err := randomState()
+		if err != nil {
+			return "", fmt.Errorf("generate state: %w", err)
+		}
+
+		srv := &http.Server{Handler: callbackHandler(state, res, errc)}
+		go srv.Serve(l)
+		defer srv.Close()
+
+		q.Set("return_url", "http://"+l.Addr().String()+"/?"+url.Values{"state": {state}}.Encode())
+		q.Set("callback_method", "fragment")
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", fmt.Errorf("parse endpoint: %w", err)
+	}
+	u.RawQuery = q.Encode()
+
+	fmt.Println("Open the following URL to authorize trellobackup:")
+	fmt.Println(u.String())
+	if open != nil {
+		if err := open(u.String()); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not open browser: %v\n", err)
+		}
+	}
+
+	if r != nil {
+		if listen {
+			fmt.Println("Waiting for authorization, or paste the token here:")
+		} else {
+			fmt.Println("Paste the token here:")
+		}
+		go func() {
+			if token, err := readToken(r); err != nil {
+				if listen && err == io.EOF {
+					return // still have the listener
+				}
+				errc <- err
+			} else {
+				res <- token
+			}
+		}()
+	} else if !listen {
+		return "", errors.New("no way to receive token")
+	}
+
+	select {
+	case token := <-res:
+		return token, nil
+	case err := <-errc:
+		return "", err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// randomState generates the state for the return URL.
+func randomState() (string, error) {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf), nil
+}
+
+// callbackHandler serves the callback page and receives the token from it.
+// Tokens are only accepted with the specified state.
+func callbackHandler(state string, res chan<- string, errc chan<- error) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, callbackPage)
+	})
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.URL.Query().Get("state")), []byte(state)) != 1 {
+			http.Error(w, "Forbidden", http.StatusForbidden) // not from the callback page
+			return
+		}
+		buf, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		token, err := parseToken(string(buf))
+		if err != nil {
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			select {
+			case errc <- fmt.Errorf("callback: %w", err):
+			default:
+			}
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+		select {
+		case res <- token:
+		default:
+		}
+	})
+	return mux
+}
+
+// readToken reads a token from the first line of r.
+func readToken(r io.Reader) (string, error) {
+	line, err := bufio.NewReader(r).ReadString('\n')
+	if err != nil && (err != io.EOF || line == "") {
+		return "", err
+	}
+	return parseToken(line)
+}
+
+// parseToken validates a token.
+func parseToken(s string) (string, error) {
+	token := strings.TrimSpace(s)
+	if token == "" {
+		return "", errors.New("authorization denied")
+	} else if !tokenRe.MatchString(token) {
+		return "", errors.New("invalid token")
+	}
+	return token, nil
+}
+
+// openBrowser opens u in the default browser.
+func openBrowser(u string) error {
+	switch runtime.GOOS {
+	case "windows":
+		return exec.Command("rundll32", "url.dll,FileProtocolHandler", u).Start()
+	case "darwin":
+		return exec.Command("open", u).Start()
+	default:
+		return exec.Command("xdg-open", u).Start()
+	}
+}
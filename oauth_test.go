@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAuthorizeServer is a fake Trello authorize endpoint. If the request is
+// for the API key "key", it redirects to the return URL like Trello does after
+// the user allows access.
+func fakeAuthorizeServer(t *testing.T, token string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if r.URL.Path != "/1/authorize" {
+			http.NotFound(w, r)
+			return
+		}
+		for k, v := range map[string]string{
+			"key":             "key",
+			"name":            "trellobackup",
+			"scope":           "read",
+			"expiration":      "never",
+			"response_type":   "token",
+			"callback_method": "fragment",
+		} {
+			if act := q.Get(k); act != v {
+				t.Errorf("expected %s=%q, got %q", k, v, act)
+			}
+		}
+		ret, err := url.Parse(q.Get("return_url"))
+		if err != nil || ret.Scheme != "http" || ret.Hostname() != "127.0.0.1" {
+			t.Errorf("invalid return url %q", q.Get("return_url"))
+			http.Error(w, "Bad Request", http.StatusBadRequest)
+			return
+		}
+		ret.Fragment = "token=" + token
+		http.Redirect(w, r, ret.String(), http.StatusFound)
+	}))
+}
+
+// fakeBrowser opens u like a browser would, running the callback page's
+// script.
+func fakeBrowser(t *testing.T) func(string) error {
+	return func(u string) error {
+		go func() {
+			resp, err := http.Get(u)
+			if err != nil {
+				t.Errorf("open %s: %v", u, err)
+				return
+			}
+			defer resp.Body.Close()
+			if buf, _ := ioutil.ReadAll(resp.Body); resp.StatusCode != http.StatusOK || !strings.Contains(string(buf), `"/token" + location.search`) {
+				t.Errorf("expected callback page, got %s", resp.Status)
+				return
+			}
+
+			// the fragment isn't sent to the server, so it's only in the
+			// redirect location
+			loc := resp.Request.URL
+			frag, err := url.ParseQuery(loc.Fragment)
+			if err != nil {
+				t.Errorf("parse fragment: %v", err)
+				return
+			}
+			loc.Path, loc.Fragment = "/token", "" // keeping the state in the query
+			tresp, err := http.Post(loc.String(), "text/plain", strings.NewReader(frag.Get("token")))
+			if err != nil {
+				t.Errorf("post token: %v", err)
+				return
+			}
+			tresp.Body.Close()
+		}()
+		return nil
+	}
+}
+
+func testAuthorizeParams() url.Values {
+	return url.Values{
+		"key":        {"key"},
+		"name":       {"trellobackup"},
+		"scope":      {"read"},
+		"expiration": {"never"},
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	srv := fakeAuthorizeServer(t, "abcdef0123456789")
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	token, err := authorize(ctx, srv.URL+"/1/authorize", testAuthorizeParams(), true, fakeBrowser(t), nil)
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if token != "abcdef0123456789" {
+		t.Errorf("expected token %q, got %q", "abcdef0123456789", token)
+	}
+}
+
+func TestAuthorizeDenied(t *testing.T) {
+	srv := fakeAuthorizeServer(t, "")
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second*10)
+	defer cancel()
+
+	if _, err := authorize(ctx, srv.URL+"/1/authorize", testAuthorizeParams(), true, fakeBrowser(t), nil); err == nil || !strings.Contains(err.Error(), "authorization denied") {
+		t.Errorf("expected authorization to be denied, got %v", err)
+	}
+}
+
+func TestAuthorizePaste(t *testing.T) {
+	var opened string
+	open := func(u string) error {
+		opened = u
+		return nil
+	}
+
+	token, err := authorize(context.Background(), "https://trello.com/1/authorize", testAuthorizeParams(), false, open, strings.NewReader("  abcdef0123456789\r\n"))
+	if err != nil {
+		t.Fatalf("authorize: %v", err)
+	}
+	if token != "abcdef0123456789" {
+		t.Errorf("expected token %q, got %q", "abcdef0123456789", token)
+	}
+
+	u, err := url.Parse(opened)
+	if err != nil {
+		t.Fatalf("parse opened url: %v", err)
+	}
+	if q := u.Query(); q.Get("key") != "key" || q.Get("response_type") != "token" || q.Get("return_url") != "" {
+		t.Errorf("unexpected authorize url %s", opened)
+	}
+
+	if _, err := authorize(context.Background(), "https://trello.com/1/authorize", testAuthorizeParams(), false, nil, strings.NewReader("not a token\n")); err == nil {
+		t.Errorf("expected error for invalid token")
+	}
+}
+
+func TestCallbackState(t *testing.T) {
+	res, errc := make(chan string, 1), make(chan error, 1)
+	srv := httptest.NewServer(callbackHandler("state1", res, errc))
+	defer srv.Close()
+
+	for _, q := range []string{"", "?state=", "?state=state2"} {
+		resp, err := http.Post(srv.URL+"/token"+q, "text/plain", strings.NewReader("abcdef0123456789"))
+		if err != nil {
+			t.Fatalf("post token: %v", err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusForbidden {
+			t.Errorf("%q: expected token without the state to be rejected, got %s", q, resp.Status)
+		}
+	}
+	select {
+	case token := <-res:
+		t.Errorf("expected no token, got %q", token)
+	case err := <-errc:
+		t.Errorf("expected the authorization to continue, got %v", err)
+	default:
+	}
+
+	resp, err := http.Post(srv.URL+"/token?state=state1", "text/plain", strings.NewReader("abcdef0123456789"))
+	if err != nil {
+		t.Fatalf("post token: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected token with the state to be accepted, got %s", resp.Status)
+	}
+	if token := <-res; token != "abcdef0123456789" {
+		t.Errorf("expected token %q, got %q", "abcdef0123456789", token)
+	}
+}
@@ -0,0 +1,575 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+func reconstructCommand(args []string) {
+	fs := flag.NewFlagSet("reconstruct", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	output := fs.String("o", "", "output file (default: stdout)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup reconstruct [options] BOARD TIME")
+		fmt.Fprintln(fs.Output(), "Note: BOARD can be a board ID or short link.")
+		fmt.Fprintln(fs.Output(), "Note: TIME is in RFC 3339 format, or a date (YYYY-MM-DD) for the end of that day in local time.")
+		fmt.Fprintln(fs.Output(), "Note: The output is a board JSON export, which can be used as the SNAPSHOT for the other commands.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 2 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	at, err := parseReconstructTime(fs.Arg(1))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(2)
+	}
+
+	w := io.Writer(os.Stdout)
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not create output file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		w = f
+	}
+
+	chdir(*dir)
+
+	id := fs.Arg(0)
+	if cb, err := catalogBoardByID(".", id); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+		os.Exit(1)
+	} else if cb != nil {
+		id = cb.ID
+	}
+
+	ls, err := listCatalogSnapshots(".", id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	// the nearest snapshot before the time (or after, if there isn't one),
+	// and the next one after it, which has the actions since the first one
+	var base, next *snapshotListing
+	for i := range ls {
+		if !ls[i].Time.After(at) {
+			base = &ls[i]
+		} else if next == nil {
+			next = &ls[i]
+		}
+	}
+	if base == nil {
+		base, next = next, nil
+	}
+	if base == nil {
+		fmt.Fprintf(os.Stderr, "Error: no snapshots of board %q\n", fs.Arg(0))
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stderr, "Starting from snapshot %s (%s)\n", orDash(base.ID), base.Time.UTC().Format(time.RFC3339))
+
+	b, err := loadBoardState(base.File)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load snapshot: %v\n", err)
+		os.Exit(1)
+	}
+	if b.ID() != id {
+		fmt.Fprintf(os.Stderr, "Error: snapshot %s is not of board %q\n", base.File, fs.Arg(0))
+		os.Exit(1)
+	}
+
+	as := b.Actions()
+	if next != nil {
+		nb, err := loadBoardState(next.File)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not load snapshot: %v\n", err)
+			os.Exit(1)
+		}
+		nas := nb.Actions()
+		if len(nas) >= exportLimits["actions"] && nas[0].Date.After(base.Time) {
+			fmt.Fprintf(os.Stderr, "Warning: snapshot %s doesn't have all actions since the previous one, so the result may be incomplete\n", orDash(next.ID))
+		}
+		as = append(as, nas...)
+	}
+
+	es, err := readJournal(".", id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: could not read all of the journal: %v\n", err)
+	}
+	for _, e := range es {
+		if a, ok := parseReplayAction(e.Action); ok {
+			as = append(as, a)
+		}
+	}
+
+	as = uniqueActions(as)
+	applied, skipped := b.Replay(as, base.Time, at)
+	fmt.Fprintf(os.Stderr, "Replayed %d actions\n", applied)
+	if len(skipped) != 0 {
+		var ts []string
+		for t, n := range skipped {
+			ts = append(ts, fmt.Sprintf("%s (%d)", t, n))
+		}
+		sort.Strings(ts)
+		fmt.Fprintf(os.Stderr, "Warning: skipped actions which can't be replayed: %s\n", strings.Join(ts, ", "))
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(b.doc); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not write board JSON: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func parseReconstructTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation("2006-01-02", s, time.Local); err == nil {
+		return t.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+	}
+	return time.Time{}, fmt.Errorf("invalid time %q", s)
+}
+
+func catalogBoardByID(dir, id string) (*catalogBoard, error) {
+	cat, err := openCatalog(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer cat.Close()
+	return cat.Board(id)
+}
+
+// replayAction is an action which can be replayed onto a boardState.
+type replayAction struct {
+	ID   string
+	Type string
+	Date time.Time
+	Data map[string]interface{}
+	Raw  map[string]interface{}
+}
+
+func parseReplayAction(buf []byte) (replayAction, bool) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal(buf, &raw); err != nil {
+		return replayAction{}, false
+	}
+	return newReplayAction(raw)
+}
+
+func newReplayAction(raw map[string]interface{}) (replayAction, bool) {
+	a := replayAction{Raw: raw}
+	a.ID, _ = raw["id"].(string)
+	a.Type, _ = raw["type"].(string)
+	a.Data, _ = raw["data"].(map[string]interface{})
+	date, _ := raw["date"].(string)
+	t, err := time.Parse(time.RFC3339Nano, date)
+	if err != nil || a.ID == "" || a.Type == "" {
+		return a, false
+	}
+	a.Date = t
+	return a, true
+}
+
+// uniqueActions removes duplicate actions (by ID) and sorts them oldest
+// first.
+func uniqueActions(as []replayAction) []replayAction {
+	seen := map[string]bool{}
+	var r []replayAction
+	for _, a := range as {
+		if !seen[a.ID] {
+			seen[a.ID] = true
+			r = append(r, a)
+		}
+	}
+	sort.SliceStable(r, func(i, j int) bool {
+		if !r[i].Date.Equal(r[j].Date) {
+			return r[i].Date.Before(r[j].Date)
+		}
+		return r[i].ID < r[j].ID // they start with the timestamp
+	})
+	return r
+}
+
+// boardState is a board export being modified by replaying actions. Unlike
+// boardDoc, it keeps all fields so it can be written as a board export again.
+type boardState struct {
+	doc map[string]interface{}
+}
+
+// loadBoardState reads a board export.
+func loadBoardState(fn string) (*boardState, error) {
+	f, err := openSnapshot(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(f)
+	dec.UseNumber() // keep ids and positions exactly
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if doc == nil {
+		return nil, errors.New("decode json: not an object")
+	}
+	return &boardState{doc}, nil
+}
+
+// ID returns the board's ID.
+func (b *boardState) ID() string {
+	id, _ := b.doc["id"].(string)
+	return id
+}
+
+// Actions returns the actions in the export, oldest first.
+func (b *boardState) Actions() []replayAction {
+	var as []replayAction
+	for _, v := range b.items("actions") {
+		if m, ok := v.(map[string]interface{}); ok {
+			if a, ok := newReplayAction(m); ok {
+				as = append(as, a)
+			}
+		}
+	}
+	return uniqueActions(as)
+}
+
+// Replay changes the board from the state at from to the state at to, by
+// applying the actions between them (if to is later) or undoing them (if to
+// is earlier). The actions must be sorted oldest first. The actions in the
+// export are replaced by the ones up to to. It returns the number of actions
+// replayed, and the number of actions which couldn't be by type.
+func (b *boardState) Replay(as []replayAction, from, to time.Time) (int, map[string]int) {
+	var n int
+	skipped := map[string]int{}
+	replay := func(a replayAction, forward bool) {
+		if b.apply(a, forward) {
+			n++
+		} else {
+			skipped[a.Type]++
+		}
+	}
+	if to.After(from) {
+		for _, a := range as {
+			if a.Date.After(from) && !a.Date.After(to) {
+				replay(a, true)
+			}
+		}
+	} else {
+		for i := len(as) - 1; i >= 0; i-- {
+			if a := as[i]; a.Date.After(to) && !a.Date.After(from) {
+				replay(a, false)
+			}
+		}
+	}
+
+	var items []interface{}
+	for i := len(as) - 1; i >= 0; i-- {
+		if !as[i].Date.After(to) {
+			items = append(items, as[i].Raw) // newest first, like the export
+		}
+	}
+	if items == nil {
+		items = []interface{}{}
+	}
+	b.doc["actions"] = items
+	return n, skipped
+}
+
+// apply applies (or undoes, if forward is false) an action. It returns false
+// if the action type isn't supported.
+func (b *boardState) apply(a replayAction, forward bool) bool {
+	d := a.Data
+	switch a.Type {
+	case "createCard", "copyCard", "convertToCardFromCheckItem", "moveCardToBoard":
+		if forward {
+			card := object(d, "card")
+			b.add("cards", map[string]interface{}{
+				"id":          card["id"],
+				"name":        card["name"],
+				"idShort":     card["idShort"],
+				"shortLink":   card["shortLink"],
+				"idList":      object(d, "list")["id"],
+				"idBoard":     b.ID(),
+				"pos":         card["pos"],
+				"desc":        "",
+				"closed":      false,
+				"idLabels":    []interface{}{},
+				"idMembers":   []interface{}{},
+				"attachments": []interface{}{},
+			})
+		} else {
+			b.remove("cards", str(object(d, "card")["id"]))
+		}
+	case "deleteCard", "moveCardFromBoard":
+		if forward {
+			b.remove("cards", str(object(d, "card")["id"]))
+		} else {
+			// only what's in the action is known
+			card := object(d, "card")
+			b.add("cards", map[string]interface{}{
+				"id":          card["id"],
+				"name":        card["name"],
+				"idShort":     card["idShort"],
+				"shortLink":   card["shortLink"],
+				"idList":      object(d, "list")["id"],
+				"idBoard":     b.ID(),
+				"desc":        "",
+				"closed":      false,
+				"idLabels":    []interface{}{},
+				"idMembers":   []interface{}{},
+				"attachments": []interface{}{},
+			})
+		}
+	case "updateCard":
+		b.update(b.find("cards", str(object(d, "card")["id"])), d, "card", forward)
+	case "createList", "moveListToBoard":
+		if forward {
+			list := object(d, "list")
+			b.add("lists", map[string]interface{}{
+				"id":      list["id"],
+				"name":    list["name"],
+				"idBoard": b.ID(),
+				"pos":     list["pos"],
+				"closed":  false,
+			})
+		} else {
+			b.remove("lists", str(object(d, "list")["id"]))
+		}
+	case "moveListFromBoard":
+		if forward {
+			b.remove("lists", str(object(d, "list")["id"]))
+		} else {
+			list := object(d, "list")
+			b.add("lists", map[string]interface{}{
+				"id":      list["id"],
+				"name":    list["name"],
+				"idBoard": b.ID(),
+				"closed":  false,
+			})
+		}
+	case "updateList":
+		b.update(b.find("lists", str(object(d, "list")["id"])), d, "list", forward)
+	case "updateBoard":
+		b.update(b.doc, d, "board", forward)
+	case "createLabel":
+		if forward {
+			label := object(d, "label")
+			b.add("labels", map[string]interface{}{
+				"id":      label["id"],
+				"name":    label["name"],
+				"color":   label["color"],
+				"idBoard": b.ID(),
+			})
+		} else {
+			b.remove("labels", str(object(d, "label")["id"]))
+		}
+	case "updateLabel":
+		b.update(b.find("labels", str(object(d, "label")["id"])), d, "label", forward)
+	case "deleteLabel":
+		if !forward {
+			return false // the label isn't in the action
+		}
+		b.remove("labels", str(object(d, "label")["id"]))
+	case "addLabelToCard", "removeLabelFromCard":
+		card := b.find("cards", str(object(d, "card")["id"]))
+		setMember(card, "idLabels", str(object(d, "label")["id"]), (a.Type == "addLabelToCard") == forward)
+	case "addMemberToCard", "removeMemberFromCard":
+		card := b.find("cards", str(object(d, "card")["id"]))
+		setMember(card, "idMembers", str(d["idMember"]), (a.Type == "addMemberToCard") == forward)
+	case "addChecklistToCard":
+		if forward {
+			cl := object(d, "checklist")
+			b.add("checklists", map[string]interface{}{
+				"id":         cl["id"],
+				"name":       cl["name"],
+				"idCard":     object(d, "card")["id"],
+				"idBoard":    b.ID(),
+				"checkItems": []interface{}{},
+			})
+		} else {
+			b.remove("checklists", str(object(d, "checklist")["id"]))
+		}
+	case "removeChecklistFromCard":
+		if !forward {
+			return false // the check items aren't in the action
+		}
+		b.remove("checklists", str(object(d, "checklist")["id"]))
+	case "updateChecklist":
+		b.update(b.find("checklists", str(object(d, "checklist")["id"])), d, "checklist", forward)
+	case "createCheckItem":
+		cl := b.find("checklists", str(object(d, "checklist")["id"]))
+		if cl == nil {
+			break
+		}
+		item := object(d, "checkItem")
+		if forward {
+			cl["checkItems"] = append(items(cl, "checkItems"), map[string]interface{}{
+				"id":    item["id"],
+				"name":  item["name"],
+				"state": "incomplete",
+				"pos":   item["pos"],
+			})
+		} else {
+			cl["checkItems"], _ = removeItem(items(cl, "checkItems"), str(item["id"]))
+		}
+	case "updateCheckItemStateOnCard":
+		cl := b.find("checklists", str(object(d, "checklist")["id"]))
+		if cl == nil {
+			break
+		}
+		item := object(d, "checkItem")
+		if ci := findItem(items(cl, "checkItems"), str(item["id"])); ci != nil {
+			state := str(item["state"])
+			if !forward {
+				if state == "complete" {
+					state = "incomplete"
+				} else {
+					state = "complete"
+				}
+			}
+			ci["state"] = state
+		}
+	case "addAttachmentToCard":
+		card := b.find("cards", str(object(d, "card")["id"]))
+		if card == nil {
+			break
+		}
+		att := object(d, "attachment")
+		if forward {
+			card["attachments"] = append(items(card, "attachments"), map[string]interface{}{
+				"id":       att["id"],
+				"name":     att["name"],
+				"url":      att["url"],
+				"date":     a.Raw["date"],
+				"isUpload": isUploadURL(str(att["url"])),
+			})
+		} else {
+			card["attachments"], _ = removeItem(items(card, "attachments"), str(att["id"]))
+		}
+	case "deleteAttachmentFromCard":
+		if !forward {
+			return false // only the id and name are in the action
+		}
+		if card := b.find("cards", str(object(d, "card")["id"])); card != nil {
+			card["attachments"], _ = removeItem(items(card, "attachments"), str(object(d, "attachment")["id"]))
+		}
+	case "commentCard", "updateComment", "deleteComment", "copyCommentCard":
+		// only in the actions
+	default:
+		return false
+	}
+	return true
+}
+
+// update applies the changes in an update action to obj. The new values are
+// in d[key], and the old ones are in d["old"].
+func (b *boardState) update(obj map[string]interface{}, d map[string]interface{}, key string, forward bool) {
+	if obj == nil {
+		return // created and deleted between the snapshots, or wasn't in one
+	}
+	cur, old := object(d, key), object(d, "old")
+	for k, v := range old {
+		if forward {
+			if nv, ok := cur[k]; ok {
+				obj[k] = nv
+			}
+		} else {
+			obj[k] = v
+		}
+	}
+}
+
+func (b *boardState) items(key string) []interface{} {
+	return items(b.doc, key)
+}
+
+func (b *boardState) find(key, id string) map[string]interface{} {
+	return findItem(b.items(key), id)
+}
+
+func (b *boardState) add(key string, item map[string]interface{}) {
+	if b.find(key, str(item["id"])) == nil {
+		b.doc[key] = append(b.items(key), item)
+	}
+}
+
+func (b *boardState) remove(key, id string) {
+	b.doc[key], _ = removeItem(b.items(key), id)
+}
+
+func items(obj map[string]interface{}, key string) []interface{} {
+	v, _ := obj[key].([]interface{})
+	return v
+}
+
+func findItem(vs []interface{}, id string) map[string]interface{} {
+	for _, v := range vs {
+		if m, ok := v.(map[string]interface{}); ok && m["id"] == id {
+			return m
+		}
+	}
+	return nil
+}
+
+func removeItem(vs []interface{}, id string) ([]interface{}, bool) {
+	for i, v := range vs {
+		if m, ok := v.(map[string]interface{}); ok && m["id"] == id {
+			return append(vs[:i:i], vs[i+1:]...), true
+		}
+	}
+	return vs, false
+}
+
+// setMember adds or removes id from the array obj[key].
+func setMember(obj map[string]interface{}, key, id string, add bool) {
+	if obj == nil || id == "" {
+		return
+	}
+	vs := items(obj, key)
+	for i, v := range vs {
+		if v == id {
+			if !add {
+				obj[key] = append(vs[:i:i], vs[i+1:]...)
+			}
+			return
+		}
+	}
+	if add {
+		obj[key] = append(vs, id)
+	}
+}
+
+// isUploadURL guesses whether an attachment URL is for an uploaded file
+// rather than a link, since only the URL is in the action.
+func isUploadURL(s string) bool {
+	return strings.Contains(s, "://trello-attachments.s3.amazonaws.com/") || (strings.HasPrefix(s, "https://trello.com/1/cards/") && strings.Contains(s, "/attachments/"))
+}
+
+func object(obj map[string]interface{}, key string) map[string]interface{} {
+	v, _ := obj[key].(map[string]interface{})
+	return v
+}
+
+func str(v interface{}) string {
+	s, _ := v.(string)
+	return s
+}
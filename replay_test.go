@@ -0,0 +1,251 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testBoardState creates a board with the lists and cards (JSON arrays).
+func testBoardState(t *testing.T, lists, cards string) *boardState {
+	dec := json.NewDecoder(strings.NewReader(`{"id":"b1","name":"Board","actions":[],"checklists":[],"labels":[],"lists":` + lists + `,"cards":` + cards + `}`))
+	dec.UseNumber()
+	var doc map[string]interface{}
+	if err := dec.Decode(&doc); err != nil {
+		t.Fatalf("decode board: %v", err)
+	}
+	return &boardState{doc}
+}
+
+// testCard is a card with the fields replay creates. If pos is negative, it
+// isn't set, like cards restored from a deleteCard action.
+func testCard(id, name, list string, pos int, closed bool) string {
+	var p string
+	if pos >= 0 {
+		p = fmt.Sprintf(`"pos":%d,`, pos)
+	}
+	return fmt.Sprintf(`{"id":%q,"name":%q,"idShort":null,"shortLink":null,"idList":%q,"idBoard":"b1",%s"desc":"","closed":%t,"idLabels":[],"idMembers":[],"attachments":[]}`, id, name, list, p, closed)
+}
+
+func testList(id, name string, pos int, closed bool) string {
+	return fmt.Sprintf(`{"id":%q,"name":%q,"idBoard":"b1","pos":%d,"closed":%t}`, id, name, pos, closed)
+}
+
+// testAction creates an action at minute min of 2020-01-01.
+func testAction(t *testing.T, id, typ string, min int, data string) replayAction {
+	a, ok := parseReplayAction([]byte(fmt.Sprintf(`{"id":%q,"type":%q,"date":"2020-01-01T00:%02d:00.000Z","data":%s}`, id, typ, min, data)))
+	if !ok {
+		t.Fatalf("invalid action %s", id)
+	}
+	return a
+}
+
+func testReplayTime(min int) time.Time {
+	return time.Date(2020, 1, 1, 0, min, 0, 0, time.UTC)
+}
+
+// boardContent returns the lists and cards of b as JSON, so boards decoded
+// differently (e.g., numbers) can be compared.
+func boardContent(t *testing.T, b *boardState) string {
+	buf, err := json.Marshal(map[string]interface{}{
+		"lists": b.doc["lists"],
+		"cards": b.doc["cards"],
+	})
+	if err != nil {
+		t.Fatalf("encode board: %v", err)
+	}
+	return string(buf)
+}
+
+func TestReplayAction(t *testing.T) {
+	l1, c1 := testList("l1", "Todo", 1, false), testCard("c1", "one", "l1", 1, false)
+	for _, c := range []struct {
+		Name                     string
+		Type, Data               string
+		ListsBefore, CardsBefore string
+		ListsAfter, CardsAfter   string
+	}{
+		{
+			Name:        "CreateCard",
+			Type:        "createCard",
+			Data:        `{"card":{"id":"c2","name":"two","pos":2},"list":{"id":"l1"}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[` + c1 + `]`,
+			ListsAfter: `[` + l1 + `]`, CardsAfter: `[` + c1 + `,` + testCard("c2", "two", "l1", 2, false) + `]`,
+		},
+		{
+			Name:        "DeleteCard",
+			Type:        "deleteCard",
+			Data:        `{"card":{"id":"c2","name":"two"},"list":{"id":"l1"}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[` + c1 + `,` + testCard("c2", "two", "l1", -1, false) + `]`,
+			ListsAfter: `[` + l1 + `]`, CardsAfter: `[` + c1 + `]`,
+		},
+		{
+			Name:        "RenameCard",
+			Type:        "updateCard",
+			Data:        `{"card":{"id":"c1","name":"uno"},"old":{"name":"one"}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[` + c1 + `]`,
+			ListsAfter: `[` + l1 + `]`, CardsAfter: `[` + testCard("c1", "uno", "l1", 1, false) + `]`,
+		},
+		{
+			Name:        "MoveCard",
+			Type:        "updateCard",
+			Data:        `{"card":{"id":"c1","idList":"l2","pos":5},"old":{"idList":"l1","pos":1},"listBefore":{"id":"l1"},"listAfter":{"id":"l2"}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[` + c1 + `]`,
+			ListsAfter: `[` + l1 + `]`, CardsAfter: `[` + testCard("c1", "one", "l2", 5, false) + `]`,
+		},
+		{
+			Name:        "ArchiveCard",
+			Type:        "updateCard",
+			Data:        `{"card":{"id":"c1","closed":true},"old":{"closed":false}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[` + c1 + `]`,
+			ListsAfter: `[` + l1 + `]`, CardsAfter: `[` + testCard("c1", "one", "l1", 1, true) + `]`,
+		},
+		{
+			Name:        "CreateList",
+			Type:        "createList",
+			Data:        `{"list":{"id":"l2","name":"Done","pos":2}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[]`,
+			ListsAfter: `[` + l1 + `,` + testList("l2", "Done", 2, false) + `]`, CardsAfter: `[]`,
+		},
+		{
+			Name:        "RenameList",
+			Type:        "updateList",
+			Data:        `{"list":{"id":"l1","name":"Doing"},"old":{"name":"Todo"}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[]`,
+			ListsAfter: `[` + testList("l1", "Doing", 1, false) + `]`, CardsAfter: `[]`,
+		},
+		{
+			Name:        "MoveList",
+			Type:        "updateList",
+			Data:        `{"list":{"id":"l1","pos":3},"old":{"pos":1}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[]`,
+			ListsAfter: `[` + testList("l1", "Todo", 3, false) + `]`, CardsAfter: `[]`,
+		},
+		{
+			Name:        "ArchiveList",
+			Type:        "updateList",
+			Data:        `{"list":{"id":"l1","closed":true},"old":{"closed":false}}`,
+			ListsBefore: `[` + l1 + `]`, CardsBefore: `[]`,
+			ListsAfter: `[` + testList("l1", "Todo", 1, true) + `]`, CardsAfter: `[]`,
+		},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			as := []replayAction{testAction(t, "a1", c.Type, 1, c.Data)}
+			before := boardContent(t, testBoardState(t, c.ListsBefore, c.CardsBefore))
+			after := boardContent(t, testBoardState(t, c.ListsAfter, c.CardsAfter))
+
+			b := testBoardState(t, c.ListsBefore, c.CardsBefore)
+			if n, skipped := b.Replay(as, testReplayTime(0), testReplayTime(1)); n != 1 || len(skipped) != 0 {
+				t.Errorf("forward: expected 1 action replayed, got %d (skipped %v)", n, skipped)
+			}
+			if act := boardContent(t, b); act != after {
+				t.Errorf("forward: expected\n%s\ngot\n%s", after, act)
+			}
+
+			b = testBoardState(t, c.ListsAfter, c.CardsAfter)
+			if n, skipped := b.Replay(as, testReplayTime(1), testReplayTime(0)); n != 1 || len(skipped) != 0 {
+				t.Errorf("backward: expected 1 action replayed, got %d (skipped %v)", n, skipped)
+			}
+			if act := boardContent(t, b); act != before {
+				t.Errorf("backward: expected\n%s\ngot\n%s", before, act)
+			}
+		})
+	}
+}
+
+// testReplayExports returns two exports of a board (A at minute 0, B at
+// minute 7) and the actions between them, including an unsupported one.
+func testReplayExports(t *testing.T) (a, b func() *boardState, as []replayAction) {
+	a = func() *boardState {
+		return testBoardState(t,
+			`[`+testList("l1", "Todo", 1, false)+`]`,
+			`[`+testCard("c1", "one", "l1", 1, false)+`]`)
+	}
+	b = func() *boardState {
+		return testBoardState(t,
+			`[`+testList("l1", "Todo", 1, true)+`,`+testList("l2", "Done", 2, false)+`]`,
+			`[`+testCard("c1", "uno", "l1", 1, true)+`,`+testCard("c2", "two", "l2", 3, false)+`]`)
+	}
+	as = uniqueActions([]replayAction{
+		testAction(t, "a1", "createList", 1, `{"list":{"id":"l2","name":"Done","pos":2}}`),
+		testAction(t, "a2", "createCard", 2, `{"card":{"id":"c2","name":"two","pos":2},"list":{"id":"l1"}}`),
+		testAction(t, "a3", "updateCard", 3, `{"card":{"id":"c1","name":"uno"},"old":{"name":"one"}}`),
+		testAction(t, "a4", "updateCard", 4, `{"card":{"id":"c2","idList":"l2","pos":3},"old":{"idList":"l1","pos":2}}`),
+		testAction(t, "a5", "enablePlugin", 5, `{"plugin":{"id":"p1"}}`),
+		testAction(t, "a6", "updateCard", 6, `{"card":{"id":"c1","closed":true},"old":{"closed":false}}`),
+		testAction(t, "a7", "updateList", 7, `{"list":{"id":"l1","closed":true},"old":{"closed":false}}`),
+	})
+	return a, b, as
+}
+
+func TestReplayForward(t *testing.T) {
+	a, b, as := testReplayExports(t)
+
+	s := a()
+	n, skipped := s.Replay(as, testReplayTime(0), testReplayTime(7))
+	if n != 6 {
+		t.Errorf("expected 6 actions replayed, got %d", n)
+	}
+	if !reflect.DeepEqual(skipped, map[string]int{"enablePlugin": 1}) {
+		t.Errorf("expected the unsupported action to be skipped, got %v", skipped)
+	}
+	if exp, act := boardContent(t, b()), boardContent(t, s); act != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, act)
+	}
+	if n := len(s.items("actions")); n != len(as) {
+		t.Errorf("expected all %d actions in the export, got %d", len(as), n)
+	}
+}
+
+func TestReplayBackward(t *testing.T) {
+	a, b, as := testReplayExports(t)
+
+	s := b()
+	n, skipped := s.Replay(as, testReplayTime(7), testReplayTime(0))
+	if n != 6 || skipped["enablePlugin"] != 1 {
+		t.Errorf("expected 6 actions replayed and 1 skipped, got %d and %v", n, skipped)
+	}
+	if exp, act := boardContent(t, a()), boardContent(t, s); act != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, act)
+	}
+	if n := len(s.items("actions")); n != 0 {
+		t.Errorf("expected no actions in the export, got %d", n)
+	}
+}
+
+func TestReplayPartial(t *testing.T) {
+	_, b, as := testReplayExports(t)
+
+	s := b()
+	if n, _ := s.Replay(as, testReplayTime(7), testReplayTime(3)); n != 3 {
+		t.Errorf("expected 3 actions undone, got %d", n)
+	}
+	exp := testBoardState(t,
+		`[`+testList("l1", "Todo", 1, false)+`,`+testList("l2", "Done", 2, false)+`]`,
+		`[`+testCard("c1", "uno", "l1", 1, false)+`,`+testCard("c2", "two", "l1", 2, false)+`]`)
+	if exp, act := boardContent(t, exp), boardContent(t, s); act != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, act)
+	}
+
+	var ids []string
+	for _, v := range s.items("actions") {
+		ids = append(ids, str(v.(map[string]interface{})["id"]))
+	}
+	if act := strings.Join(ids, " "); act != "a3 a2 a1" {
+		t.Errorf("expected the actions up to the time newest first, got %s", act)
+	}
+}
+
+func TestReplayRoundTrip(t *testing.T) {
+	_, b, as := testReplayExports(t)
+
+	s := b()
+	s.Replay(as, testReplayTime(7), testReplayTime(0))
+	s.Replay(as, testReplayTime(0), testReplayTime(7))
+	if exp, act := boardContent(t, b()), boardContent(t, s); act != exp {
+		t.Errorf("expected\n%s\ngot\n%s", exp, act)
+	}
+}
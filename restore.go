@@ -0,0 +1,216 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func restoreCommand(args []string) {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	name := fs.String("name", "", "name for the new board (default: the original name with the snapshot date)")
+	org := fs.String("workspace", "", "ID of the workspace to create the board in (default: personal)")
+	archived := fs.Bool("archived", false, "also restore archived lists and cards")
+	comments := fs.Bool("comments", true, "restore comments (posted as the current user, with the original author and date)")
+	var af authFlags
+	af.Register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup restore [options] SNAPSHOT [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+		fmt.Fprintln(fs.Output(), "Note: SNAPSHOT can be a file or a board ID (for the latest snapshot). It is always restored as a new board.")
+		fmt.Fprintln(fs.Output(), "Note: Attachments, members, and custom fields are not restored.")
+		af.PrintNotes(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() < 1 || !af.ValidArgs(fs.Args()[1:]) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	chdir(*dir)
+
+	fn, err := resolveSnapshot(".", fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	b, err := loadBoard(fn)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load snapshot: %v\n", err)
+		os.Exit(1)
+	}
+
+	if *name == "" {
+		res, err := snapshotNameRegexps(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		*name = b.Name
+		if s, ok := parseSnapshotName(res, fn); ok {
+			*name += " (restored from " + s.Time.Format("2006-01-02 15:04") + ")"
+		} else {
+			*name += " (restored)"
+		}
+	}
+
+	auth, err := af.Authenticator(fs.Args()[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := newClient(auth, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	u, err := restoreBoard(c, b, *name, *org, *archived, *comments)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not restore board: %v\n", err)
+		if u != "" {
+			fmt.Fprintf(os.Stderr, "Note: the partially restored board is at %s\n", u)
+		}
+		os.Exit(1)
+	}
+	fmt.Println("Successfully restored board to", u)
+}
+
+// restoreBoard creates a new board from b, returning its URL.
+func restoreBoard(c *http.Client, b *boardDoc, name, org string, archived, comments bool) (string, error) {
+	fmt.Printf("Creating board %s\n", name)
+	params := url.Values{
+		"name":          {name},
+		"desc":          {b.Desc},
+		"defaultLists":  {"false"},
+		"defaultLabels": {"false"},
+	}
+	if org != "" {
+		params.Set("idOrganization", org)
+	}
+
+	var nb struct{ ID, ShortURL string }
+	if err := apiRequest(c, http.MethodPost, "boards", params, &nb); err != nil {
+		return "", fmt.Errorf("create board: %w", err)
+	}
+
+	fmt.Println("--> Creating labels")
+	labels := map[string]string{}
+	for _, lb := range b.Labels {
+		var nl struct{ ID string }
+		if err := apiRequest(c, http.MethodPost, "labels", url.Values{
+			"idBoard": {nb.ID},
+			"name":    {lb.Name},
+			"color":   {lb.Color},
+		}, &nl); err != nil {
+			return nb.ShortURL, fmt.Errorf("create label %q: %w", lb.Name, err)
+		}
+		labels[lb.ID] = nl.ID
+	}
+
+	for _, l := range b.SortedLists() {
+		if l.Closed && !archived {
+			continue
+		}
+
+		fmt.Printf("--> Creating list %s\n", l.Name)
+		var nl struct{ ID string }
+		if err := apiRequest(c, http.MethodPost, "lists", url.Values{
+			"idBoard": {nb.ID},
+			"name":    {l.Name},
+			"pos":     {"bottom"},
+		}, &nl); err != nil {
+			return nb.ShortURL, fmt.Errorf("create list %q: %w", l.Name, err)
+		}
+
+		for _, card := range b.SortedCards(l.ID) {
+			if card.Closed && !archived {
+				continue
+			}
+			if err := restoreCard(c, b, card, nl.ID, labels, comments); err != nil {
+				return nb.ShortURL, fmt.Errorf("create card %q: %w", card.Name, err)
+			}
+		}
+
+		if l.Closed {
+			if err := apiRequest(c, http.MethodPut, "lists/"+nl.ID+"/closed", url.Values{"value": {"true"}}, nil); err != nil {
+				return nb.ShortURL, fmt.Errorf("archive list %q: %w", l.Name, err)
+			}
+		}
+	}
+	return nb.ShortURL, nil
+}
+
+func restoreCard(c *http.Client, b *boardDoc, card boardCard, idList string, labels map[string]string, comments bool) error {
+	fmt.Printf("    Creating card %s\n", card.Name)
+
+	var idLabels []string
+	for _, id := range card.IDLabels {
+		if nid, ok := labels[id]; ok {
+			idLabels = append(idLabels, nid)
+		}
+	}
+
+	params := url.Values{
+		"idList":      {idList},
+		"name":        {card.Name},
+		"desc":        {card.Desc},
+		"pos":         {"bottom"},
+		"idLabels":    {strings.Join(idLabels, ",")},
+		"dueComplete": {strconv.FormatBool(card.DueComplete)},
+	}
+	if card.Due != nil {
+		params.Set("due", card.Due.Format(time.RFC3339))
+	}
+
+	var nc struct{ ID string }
+	if err := apiRequest(c, http.MethodPost, "cards", params, &nc); err != nil {
+		return err
+	}
+
+	for _, cl := range b.CardChecklists(card.ID) {
+		var ncl struct{ ID string }
+		if err := apiRequest(c, http.MethodPost, "checklists", url.Values{
+			"idCard": {nc.ID},
+			"name":   {cl.Name},
+			"pos":    {"bottom"},
+		}, &ncl); err != nil {
+			return fmt.Errorf("create checklist %q: %w", cl.Name, err)
+		}
+		for _, it := range cl.CheckItems {
+			if err := apiRequest(c, http.MethodPost, "checklists/"+ncl.ID+"/checkItems", url.Values{
+				"name":    {it.Name},
+				"pos":     {"bottom"},
+				"checked": {strconv.FormatBool(it.State == "complete")},
+			}, nil); err != nil {
+				return fmt.Errorf("create checklist item %q: %w", it.Name, err)
+			}
+		}
+	}
+
+	if comments {
+		for _, cm := range b.Comments(card.ID) {
+			if err := apiRequest(c, http.MethodPost, "cards/"+nc.ID+"/actions/comments", url.Values{
+				"text": {fmt.Sprintf("%s (%s):\n\n%s", cm.Author, cm.Date.Format("2006-01-02 15:04 MST"), cm.Text)},
+			}, nil); err != nil {
+				return fmt.Errorf("create comment: %w", err)
+			}
+		}
+	}
+
+	if card.Closed {
+		if err := apiRequest(c, http.MethodPut, "cards/"+nc.ID, url.Values{"closed": {"true"}}, nil); err != nil {
+			return fmt.Errorf("archive card: %w", err)
+		}
+	}
+	return nil
+}
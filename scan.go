@@ -0,0 +1,243 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// boardScan is the information needed from a board export after saving it.
+// It is extracted while streaming the export so the whole thing never needs
+// to be held in memory.
+type boardScan struct {
+	boardSummary
+	Board       boardDoc // only the id, name, members, and cards with attachments
+	ShortLink   string
+	Stats       boardStats
+	Backgrounds []string
+	SHA256      string // set by saveBoard
+	Size        int64  // set by saveBoard
+}
+
+var backgroundURLRe = regexp.MustCompile(`"url": ?"(https?://trello-backgrounds.s3.amazonaws.com/[^"]+)"`)
+
+// scanBoard reads a board export from r. Each item in the collections is
+// decoded separately, so memory usage is bounded by the size of the largest
+// item rather than the size of the board.
+func scanBoard(r io.Reader) (*boardScan, error) {
+	s := &boardScan{
+		boardSummary: boardSummary{Counts: map[string]int{}},
+		Stats: boardStats{
+			Cards:   map[string]bool{},
+			Lists:   map[string]string{},
+			Descs:   map[string]string{},
+			Members: map[string]string{},
+		},
+	}
+	seen := map[string]bool{}
+	addBackgrounds := func(raw []byte) {
+		for _, m := range backgroundURLRe.FindAllSubmatch(raw, -1) {
+			if u := string(m[1]); !seen[u] {
+				seen[u] = true
+				s.Backgrounds = append(s.Backgrounds, u)
+			}
+		}
+	}
+
+	dec := json.NewDecoder(r)
+	if err := expectDelim(dec, '{'); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("decode json: %w", err)
+		}
+		key, _ := tok.(string)
+
+		if isBoardCollection(key) {
+			if err := expectDelim(dec, '['); err != nil {
+				return nil, fmt.Errorf("decode json: %s is not an array", key)
+			}
+			var n int
+			for ; dec.More(); n++ {
+				var raw json.RawMessage
+				if err := dec.Decode(&raw); err != nil {
+					return nil, fmt.Errorf("decode json: %s: %w", key, err)
+				}
+				if err := s.addItem(key, raw); err != nil {
+					return nil, fmt.Errorf("decode json: %s: %w", key, err)
+				}
+				addBackgrounds(raw)
+			}
+			if err := expectDelim(dec, ']'); err != nil {
+				return nil, fmt.Errorf("decode json: %w", err)
+			}
+			s.Counts[key] = n
+			continue
+		}
+
+		var raw json.RawMessage
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("decode json: %s: %w", key, err)
+		}
+		switch key {
+		case "id":
+			json.Unmarshal(raw, &s.ID)
+		case "name":
+			json.Unmarshal(raw, &s.Board.Name)
+		case "shortLink":
+			json.Unmarshal(raw, &s.ShortLink)
+		case "desc":
+			var desc string
+			json.Unmarshal(raw, &desc)
+			s.Stats.Desc = desc != ""
+		}
+		addBackgrounds(raw)
+	}
+	if err := expectDelim(dec, '}'); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	if s.ID == "" {
+		return nil, errors.New("decode json: missing id")
+	}
+	s.Board.ID = s.ID
+	return s, nil
+}
+
+// addItem keeps the parts of a collection item which are needed later.
+func (s *boardScan) addItem(key string, raw json.RawMessage) error {
+	switch key {
+	case "members":
+		var m boardMember
+		if err := json.Unmarshal(raw, &m); err != nil {
+			return err
+		}
+		s.Board.Members = append(s.Board.Members, m)
+		s.Stats.Members[m.ID] = m.Username
+	case "lists":
+		var l boardList
+		if err := json.Unmarshal(raw, &l); err != nil {
+			return err
+		}
+		if !l.Closed {
+			s.Stats.Lists[l.ID] = l.Name
+		}
+	case "cards":
+		var c boardCard
+		if err := json.Unmarshal(raw, &c); err != nil {
+			return err
+		}
+		if !objectIDRe.MatchString(c.ID) {
+			s.InvalidIDs = append(s.InvalidIDs, fmt.Sprintf("card id %q", c.ID))
+		}
+		for _, a := range c.Attachments {
+			if !objectIDRe.MatchString(a.ID) {
+				s.InvalidIDs = append(s.InvalidIDs, fmt.Sprintf("attachment id %q on card %q", a.ID, c.ID))
+			}
+		}
+		s.Stats.Cards[c.ID] = true
+		if !c.Closed {
+			s.Stats.OpenCards++
+		}
+		if c.Desc != "" {
+			s.Stats.Descs[c.ID] = c.Name
+		}
+		if len(c.Attachments) != 0 {
+			s.Board.Cards = append(s.Board.Cards, boardCard{
+				ID:          c.ID,
+				Name:        c.Name,
+				Attachments: c.Attachments,
+			})
+		}
+	}
+	return nil
+}
+
+// AttachmentFiles returns the slash-separated paths the uploaded attachments
+// are saved to.
+func (s *boardScan) AttachmentFiles() []string {
+	var fns []string
+	for _, card := range s.Board.Cards {
+		for _, a := range card.Attachments {
+			if a.IsUpload {
+				if fn, _, err := attachmentPath(s.ID, card.ID, a); err == nil {
+					fns = append(fns, filepath.ToSlash(fn))
+				}
+			}
+		}
+	}
+	return fns
+}
+
+// scanBoardFile reads a board export from a file.
+func scanBoardFile(fn string) (*boardScan, error) {
+	f, err := openSnapshot(fn)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return scanBoard(f)
+}
+
+// streamBoard copies a board export from r to w, scanning it along the way.
+// All of r is copied even if it isn't a valid export so it can be
+// quarantined. Errors reading r or writing w are returned as a *streamError.
+func streamBoard(w io.Writer, r io.Reader) (*boardScan, error) {
+	tr := streamReader{io.TeeReader(r, w)}
+	s, err := scanBoard(tr)
+	if _, cerr := io.Copy(ioutil.Discard, tr); cerr != nil {
+		return nil, cerr
+	}
+	return s, err
+}
+
+// streamError is an error reading or writing the export (rather than an
+// invalid one).
+type streamError struct {
+	err error
+}
+
+func (e *streamError) Error() string {
+	return e.err.Error()
+}
+
+func (e *streamError) Unwrap() error {
+	return e.err
+}
+
+type streamReader struct {
+	r io.Reader
+}
+
+func (s streamReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = &streamError{err}
+	}
+	return n, err
+}
+
+func expectDelim(dec *json.Decoder, d json.Delim) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+	if tok != d {
+		return fmt.Errorf("expected %s, got %v", d, tok)
+	}
+	return nil
+}
+
+func isBoardCollection(key string) bool {
+	for _, k := range boardCollections {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
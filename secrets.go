@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"time"
+)
+
+// vaultClient is used for Vault requests, so an unreachable server doesn't
+// hang the command.
+var vaultClient = &http.Client{Timeout: time.Second * 30}
+
+// resolveSecret resolves a secret reference. Values without a recognized
+// prefix are returned as-is.
+//
+//	vault:PATH#FIELD  read FIELD from PATH in Vault (using VAULT_ADDR and VAULT_TOKEN)
+//	pass:NAME         the first line of the password NAME in pass
+//	cmd:COMMAND       the output of COMMAND run with the shell
+func resolveSecret(s string) (string, error) {
+	switch {
+	case strings.HasPrefix(s, "vault:"):
+		v, err := vaultSecret(vaultClient, os.Getenv("VAULT_ADDR"), os.Getenv("VAULT_TOKEN"), strings.TrimPrefix(s, "vault:"))
+		if err != nil {
+			return "", fmt.Errorf("resolve %s: %w", s, err)
+		}
+		return v, nil
+	case strings.HasPrefix(s, "pass:"):
+		v, err := commandSecret(exec.Command("pass", "show", strings.TrimPrefix(s, "pass:")))
+		if err != nil {
+			return "", fmt.Errorf("resolve %s: %w", s, err)
+		}
+		if i := strings.IndexByte(v, '\n'); i != -1 {
+			v = v[:i]
+		}
+		return strings.TrimSpace(v), nil
+	case strings.HasPrefix(s, "cmd:"):
+		var cmd *exec.Cmd
+		if runtime.GOOS == "windows" {
+			cmd = exec.Command("cmd", "/C", strings.TrimPrefix(s, "cmd:"))
+		} else {
+			cmd = exec.Command("sh", "-c", strings.TrimPrefix(s, "cmd:"))
+		}
+		v, err := commandSecret(cmd)
+		if err != nil {
+			return "", fmt.Errorf("resolve %s: %w", s, err)
+		}
+		return strings.TrimSpace(v), nil
+	}
+	return s, nil
+}
+
+// commandSecret runs cmd and returns its output.
+func commandSecret(cmd *exec.Cmd) (string, error) {
+	var stderr bytes.Buffer
+	cmd.Stdin = os.Stdin // for gpg pinentry and the like
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	if len(bytes.TrimSpace(out)) == 0 {
+		return "", errors.New("empty output")
+	}
+	return string(out), nil
+}
+
+// vaultSecret reads a field from a secret in Vault. Both version 1 and 2 of
+// the KV secrets engine are supported. If the field isn't specified, the
+// secret must only have one.
+func vaultSecret(c *http.Client, addr, token, ref string) (string, error) {
+	if addr == "" {
+		return "", errors.New("VAULT_ADDR not set")
+	}
+	if token == "" {
+		if buf, err := readVaultTokenHelper(); err == nil {
+			token = buf
+		} else {
+			return "", errors.New("VAULT_TOKEN not set")
+		}
+	}
+
+	path, field := ref, ""
+	if i := strings.LastIndexByte(ref, '#'); i != -1 {
+		path, field = ref[:i], ref[i+1:]
+	}
+	path = strings.Trim(path, "/")
+
+	// try kv v2 first (it puts data after the mount), then kv v1
+	var paths []string
+	if i := strings.IndexByte(path, '/'); i != -1 {
+		paths = append(paths, path[:i]+"/data/"+path[i+1:])
+	}
+	paths = append(paths, path)
+
+	var denied error
+	for _, p := range paths {
+		data, err := vaultRead(c, strings.TrimRight(addr, "/")+"/v1/"+p, token)
+		if errors.Is(err, errVaultDenied) && p != path {
+			denied = err // a policy may only allow the kv v1 path
+			continue
+		} else if err != nil {
+			return "", err
+		} else if data == nil {
+			continue
+		}
+
+		// kv v2 nests it under data
+		var v2 struct {
+			Data     map[string]interface{} `json:"data"`
+			Metadata json.RawMessage        `json:"metadata"`
+		}
+		if p != path && json.Unmarshal(data, &v2) == nil && v2.Metadata != nil {
+			return vaultField(v2.Data, field)
+		}
+
+		var v1 map[string]interface{}
+		if err := json.Unmarshal(data, &v1); err != nil {
+			return "", fmt.Errorf("decode json: %w", err)
+		}
+		return vaultField(v1, field)
+	}
+	if denied != nil {
+		return "", denied
+	}
+	return "", fmt.Errorf("no secret at %s", path)
+}
+
+// errVaultDenied is returned by vaultRead if the token isn't allowed to read
+// the secret.
+var errVaultDenied = errors.New("permission denied")
+
+// vaultRead reads the data for the secret at u. If it doesn't exist, nil is
+// returned. If the token isn't allowed to read it, the error wraps
+// errVaultDenied.
+func vaultRead(c *http.Client, u, token string) (json.RawMessage, error) {
+	req, err := http.NewRequest(http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("send vault request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+
+	var obj struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []string        `json:"errors"`
+	}
+	if resp.StatusCode == http.StatusForbidden {
+		return nil, fmt.Errorf("vault error: %w", errVaultDenied)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decode json (response status %s): %w", resp.Status, err)
+	}
+	if len(obj.Errors) != 0 {
+		return nil, fmt.Errorf("vault error: %s", strings.Join(obj.Errors, "; "))
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status %s", resp.Status)
+	}
+	return obj.Data, nil
+}
+
+func vaultField(data map[string]interface{}, field string) (string, error) {
+	if field == "" {
+		if len(data) != 1 {
+			keys := make([]string, 0, len(data))
+			for k := range data {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			return "", fmt.Errorf("secret has multiple fields, specify one of %s", strings.Join(keys, ", "))
+		}
+		for k := range data {
+			field = k
+		}
+	}
+	v, ok := data[field].(string)
+	if !ok {
+		return "", fmt.Errorf("secret does not have string field %q", field)
+	}
+	return v, nil
+}
+
+// readVaultTokenHelper reads the token saved by vault login.
+func readVaultTokenHelper() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	buf, err := ioutil.ReadFile(filepath.Join(home, ".vault-token"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(buf)), nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeVault is a fake Vault server with a kv v2 engine at secret/ and a kv v1
+// engine at kv/. The token can only read kv/* (not kv/data/*), like a policy
+// written for kv v1.
+func fakeVault() *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.Header.Get("X-Vault-Token") != "token" || strings.HasPrefix(r.URL.Path, "/v1/kv/data/") {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"errors":["1 error occurred:\n\t* permission denied\n\n"]}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/v1/secret/data/trello":
+			w.Write([]byte(`{"data":{"data":{"password":"v2pass","totp":"v2totp"},"metadata":{"version":3}}}`))
+		case "/v1/secret/data/single":
+			w.Write([]byte(`{"data":{"data":{"password":"v2single"},"metadata":{"version":1}}}`))
+		case "/v1/kv/trello":
+			w.Write([]byte(`{"data":{"password":"v1pass","totp":"v1totp"}}`))
+		case "/v1/slow":
+			time.Sleep(time.Millisecond * 500)
+			w.Write([]byte(`{"data":{"password":"slow"}}`))
+		case "/v1/broken":
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"errors":["internal error"]}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"errors":[]}`))
+		}
+	}))
+}
+
+func TestVaultSecret(t *testing.T) {
+	srv := fakeVault()
+	defer srv.Close()
+
+	for _, c := range []struct {
+		ref, token, exp, err string
+	}{
+		{"secret/trello#password", "token", "v2pass", ""},
+		{"/secret/trello/#totp", "token", "v2totp", ""},
+		{"secret/single", "token", "v2single", ""},
+		{"secret/trello", "token", "", "multiple fields, specify one of password, totp"},
+		{"secret/trello#user", "token", "", `does not have string field "user"`},
+		{"secret/missing#password", "token", "", "no secret at secret/missing"},
+		{"kv/trello#password", "token", "v1pass", ""}, // 403 for kv v2, then kv v1
+		{"kv/missing#password", "token", "", "permission denied"},
+		{"secret/trello#password", "wrong", "", "permission denied"},
+		{"broken", "token", "", "internal error"},
+	} {
+		v, err := vaultSecret(srv.Client(), srv.URL+"/", c.token, c.ref)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: expected error containing %q, got %v", c.ref, c.err, err)
+			}
+		} else if err != nil {
+			t.Errorf("%s: %v", c.ref, err)
+		} else if v != c.exp {
+			t.Errorf("%s: expected %q, got %q", c.ref, c.exp, v)
+		}
+	}
+}
+
+func TestVaultSecretTimeout(t *testing.T) {
+	srv := fakeVault()
+	defer srv.Close()
+
+	if vaultClient.Timeout == 0 {
+		t.Errorf("expected vault client to have a timeout")
+	}
+
+	c := *srv.Client()
+	c.Timeout = time.Millisecond * 100
+	if _, err := vaultSecret(&c, srv.URL, "token", "slow"); err == nil {
+		t.Errorf("expected timeout")
+	}
+}
+
+func TestResolveSecretVault(t *testing.T) {
+	srv := fakeVault()
+	defer srv.Close()
+
+	for k, v := range map[string]string{"VAULT_ADDR": srv.URL, "VAULT_TOKEN": "token"} {
+		if old, ok := os.LookupEnv(k); ok {
+			defer os.Setenv(k, old)
+		} else {
+			defer os.Unsetenv(k)
+		}
+		os.Setenv(k, v)
+	}
+
+	if v, err := resolveSecret("vault:kv/trello#totp"); err != nil {
+		t.Errorf("resolve: %v", err)
+	} else if v != "v1totp" {
+		t.Errorf("expected %q, got %q", "v1totp", v)
+	}
+	if v, err := resolveSecret("plain"); err != nil || v != "plain" {
+		t.Errorf("expected plain value to be returned as-is, got %q, %v", v, err)
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Runs can be signed with an ed25519 key so it can be proven that the backup
+// hasn't been changed since. Each signature is saved in the store directory as
+// signatures/SEQ.json, and covers the run manifest, the snapshots saved by the
+// run, and their attachments and raw exports. Each one also includes the hash
+// of the previous one, so they can't be removed or reordered without breaking
+// the chain.
+
+// runSignature is a signed statement of what a run saved.
+type runSignature struct {
+	Seq       int               `json:"seq"`
+	Run       string            `json:"run"`
+	Signed    time.Time         `json:"signed"`
+	Previous  string            `json:"previous_sha256,omitempty"` // of the previous signature file
+	Manifest  string            `json:"manifest_sha256"`           // of runs/RUN_ID.json
+	Snapshots map[string]string `json:"snapshots"`                 // path to the sha256 of the content (reconstructed if stored as a delta)
+	Files     map[string]string `json:"files"`                     // path to sha256, for attachments and raw exports
+	PublicKey string            `json:"public_key"`                // base64
+	Signature string            `json:"signature,omitempty"`       // base64 ed25519 signature of the JSON encoding without it
+}
+
+// signedData returns the data covered by the signature.
+func (s runSignature) signedData() ([]byte, error) {
+	s.Signature = ""
+	return json.Marshal(s)
+}
+
+// parseSigningKey parses a base64 ed25519 private key (either the 32-byte
+// seed or the 64-byte key).
+func parseSigningKey(s string) (ed25519.PrivateKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decode signing key: %w", err)
+	}
+	switch len(buf) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(buf), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(buf), nil
+	}
+	return nil, fmt.Errorf("decode signing key: invalid length %d", len(buf))
+}
+
+// parsePublicKey parses a base64 ed25519 public key.
+func parsePublicKey(s string) (ed25519.PublicKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("decode public key: %w", err)
+	}
+	if len(buf) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("decode public key: invalid length %d", len(buf))
+	}
+	return ed25519.PublicKey(buf), nil
+}
+
+// resolveSigningKey resolves and parses a -signing-key option. If it is
+// empty, nil is returned.
+func resolveSigningKey(s string) (ed25519.PrivateKey, error) {
+	if s == "" {
+		return nil, nil
+	}
+	v, err := resolveSecret(s)
+	if err != nil {
+		return nil, err
+	}
+	return parseSigningKey(v)
+}
+
+// listSignatures finds the signature files in the backup directory dir, in
+// order.
+func listSignatures(dir string) ([]string, error) {
+	fns, err := filepath.Glob(filepath.Join(dir, storeDir, "signatures", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(fns) // zero-padded
+	return fns, nil
+}
+
+// signRun signs what the run m saved in the current directory, chaining it to
+// the latest signature. It returns the signature file.
+func signRun(cat *catalog, m *runManifest, key ed25519.PrivateKey) (string, error) {
+	s := runSignature{
+		Run:       m.ID,
+		Snapshots: map[string]string{},
+		Files:     map[string]string{},
+		PublicKey: base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)),
+	}
+
+	var err error
+	if s.Manifest, _, err = fileSHA256(filepath.Join(storeDir, "runs", m.ID+".json")); err != nil {
+		return "", fmt.Errorf("hash manifest: %w", err)
+	}
+
+	for _, rb := range m.Boards {
+		if rb.File == "" || rb.Run != "" {
+			continue // not saved by this run
+		}
+		if s.Snapshots[rb.File], _, err = snapshotSHA256(filepath.FromSlash(rb.File)); err != nil {
+			return "", fmt.Errorf("hash snapshot: %w", err)
+		}
+		cs, err := cat.SnapshotFile(rb.File)
+		if err != nil {
+			return "", err
+		} else if cs == nil {
+			continue
+		}
+		fns := cs.Attachments
+		if cs.Raw != "" {
+			fns = append(fns, cs.Raw)
+		}
+		for _, fn := range fns {
+			if !exists(filepath.FromSlash(fn)) {
+				continue // not downloaded yet
+			}
+			if s.Files[fn], _, err = fileSHA256(filepath.FromSlash(fn)); err != nil {
+				return "", fmt.Errorf("hash file: %w", err)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(filepath.Join(storeDir, "signatures"), 0755); err != nil {
+		return "", err
+	}
+	for {
+		fns, err := listSignatures(".")
+		if err != nil {
+			return "", err
+		}
+		s.Seq, s.Previous = 1, ""
+		if len(fns) != 0 {
+			buf, err := ioutil.ReadFile(fns[len(fns)-1])
+			if err != nil {
+				return "", err
+			}
+			var p runSignature
+			if err := json.Unmarshal(buf, &p); err != nil {
+				return "", fmt.Errorf("decode %s: %w", filepath.Base(fns[len(fns)-1]), err)
+			}
+			sum := sha256.Sum256(buf)
+			s.Seq, s.Previous = p.Seq+1, hex.EncodeToString(sum[:])
+		}
+		s.Signed = time.Now().UTC()
+
+		data, err := s.signedData()
+		if err != nil {
+			return "", err
+		}
+		s.Signature = base64.StdEncoding.EncodeToString(ed25519.Sign(key, data))
+
+		buf, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return "", err
+		}
+
+		// another process may have signed a run at the same time
+		fn := filepath.Join(storeDir, "signatures", fmt.Sprintf("%06d.json", s.Seq))
+		f, err := os.OpenFile(fn, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if os.IsExist(err) {
+			continue
+		} else if err != nil {
+			return "", err
+		}
+		if _, err := f.Write(buf); err != nil {
+			f.Close()
+			os.Remove(fn)
+			return "", err
+		}
+		if err := f.Close(); err != nil {
+			os.Remove(fn)
+			return "", err
+		}
+		return fn, nil
+	}
+}
+
+// verifySignatures checks the chain of signatures in the current directory,
+// and that the files they cover haven't changed. If pub is nil, the key from
+// the first signature is used. It returns the number of signatures checked
+// and failed.
+func verifySignatures(pub ed25519.PublicKey) (int, int, error) {
+	fns, err := listSignatures(".")
+	if err != nil {
+		return 0, 0, err
+	}
+
+	var failed int
+	var prev []byte
+	for i, fn := range fns {
+		var errs []string
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		var s runSignature
+		if err := json.Unmarshal(buf, &s); err != nil {
+			errs = append(errs, fmt.Sprintf("decode: %v", err))
+		} else {
+			errs = append(errs, checkSignature(s, i, fn, prev, &pub)...)
+		}
+		prev = buf
+
+		if len(errs) != 0 {
+			fmt.Printf("FAIL %s: %s\n", filepath.Base(fn), strings.Join(errs, "; "))
+			failed++
+		} else {
+			fmt.Printf("OK   %s (run %s, signed %s, %d snapshots, %d files)\n", filepath.Base(fn), s.Run, s.Signed.Format(time.RFC3339), len(s.Snapshots), len(s.Files))
+		}
+	}
+	return len(fns), failed, nil
+}
+
+// checkSignature checks the signature s (the ith one in file fn, after the
+// file prev). If *pub is nil, it is set to the key s was signed with.
+func checkSignature(s runSignature, i int, fn string, prev []byte, pub *ed25519.PublicKey) []string {
+	var errs []string
+
+	if s.Seq != i+1 || filepath.Base(fn) != fmt.Sprintf("%06d.json", s.Seq) {
+		errs = append(errs, "wrong sequence number "+strconv.Itoa(s.Seq)+" (a signature was removed or renamed)")
+	}
+	if prev == nil {
+		if s.Previous != "" {
+			errs = append(errs, "the previous signature is missing")
+		}
+	} else if sum := sha256.Sum256(prev); s.Previous != hex.EncodeToString(sum[:]) {
+		errs = append(errs, "doesn't match the previous signature")
+	}
+
+	if k, err := parsePublicKey(s.PublicKey); err != nil {
+		errs = append(errs, err.Error())
+	} else if *pub == nil {
+		*pub = k
+	} else if !bytes.Equal(k, *pub) {
+		errs = append(errs, "signed with a different key ("+s.PublicKey+")")
+	}
+	if sig, err := base64.StdEncoding.DecodeString(s.Signature); err != nil {
+		errs = append(errs, "decode signature: "+err.Error())
+	} else if data, err := s.signedData(); err != nil {
+		errs = append(errs, err.Error())
+	} else if *pub != nil && !ed25519.Verify(*pub, data, sig) {
+		errs = append(errs, "invalid signature")
+	}
+
+	check := func(what, fn, sum string, hash func(string) (string, int64, error)) {
+		if cur, _, err := hash(fn); err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				errs = append(errs, what+" "+fn+" is missing")
+			} else {
+				errs = append(errs, what+" "+fn+": "+err.Error())
+			}
+		} else if cur != sum {
+			errs = append(errs, what+" "+fn+" was modified")
+		}
+	}
+	check("manifest", filepath.Join(storeDir, "runs", s.Run+".json"), s.Manifest, fileSHA256)
+	for _, fn := range sortedKeys(s.Snapshots) {
+		check("snapshot", filepath.FromSlash(fn), s.Snapshots[fn], snapshotSHA256)
+	}
+	for _, fn := range sortedKeys(s.Files) {
+		check("file", filepath.FromSlash(fn), s.Files[fn], fileSHA256)
+	}
+	return errs
+}
+
+// unsigned finds the runs in the current directory which finished after the
+// first signed run but aren't signed, and the snapshots saved since then which
+// aren't signed or part of a run. This catches signatures (and runs) removed
+// from the end of the chain.
+func unsigned() ([]string, error) {
+	fns, err := listSignatures(".")
+	if err != nil {
+		return nil, err
+	}
+	var first time.Time
+	signed, files := map[string]bool{}, map[string]bool{}
+	for i, fn := range fns {
+		buf, err := ioutil.ReadFile(fn)
+		if err != nil {
+			return nil, err
+		}
+		var s runSignature
+		if json.Unmarshal(buf, &s) == nil {
+			if i == 0 {
+				first = s.Signed
+			}
+			signed[s.Run] = true
+			for fn := range s.Snapshots {
+				files[fn] = true
+			}
+		}
+	}
+
+	ms, err := loadRunManifests(".")
+	if err != nil {
+		return nil, err
+	}
+	var res []string
+	var after bool
+	for _, m := range ms {
+		for _, rb := range m.Boards {
+			if rb.File != "" {
+				files[rb.File] = true // checked with the run
+			}
+		}
+		if signed[m.ID] {
+			after = true
+		} else if after && m.Finished != nil && !m.Imported && m.Ingested == "" {
+			res = append(res, "run "+m.ID)
+		}
+	}
+
+	if !first.IsZero() {
+		ss, err := listSnapshots(".")
+		if err != nil {
+			return nil, err
+		}
+		for _, x := range ss {
+			if fn := filepath.ToSlash(x.Path); !files[fn] && x.Time.After(first) {
+				res = append(res, "snapshot "+fn)
+			}
+		}
+	}
+	return res, nil
+}
+
+func sortedKeys(m map[string]string) []string {
+	ks := make([]string, 0, len(m))
+	for k := range m {
+		ks = append(ks, k)
+	}
+	sort.Strings(ks)
+	return ks
+}
+
+func keygenCommand(args []string) {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup keygen")
+		fmt.Fprintln(fs.Output(), "Note: This generates an ed25519 key for signing runs with backup -signing-key.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not generate key: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Signing key: %s\n", base64.StdEncoding.EncodeToString(key.Seed()))
+	fmt.Printf("Public key:  %s\n", base64.StdEncoding.EncodeToString(pub))
+	fmt.Println("Keep the signing key secret, and pass it to backup -signing-key (it can be a secret reference).")
+	fmt.Println("Keep a copy of the public key somewhere else, and pass it to verify -signatures -public-key.")
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testSignedRuns saves and signs two runs in the current directory, each with
+// a snapshot and an attachment.
+func testSignedRuns(t *testing.T, key ed25519.PrivateKey) {
+	cat, err := openCatalog(".", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cat.Close()
+
+	if err := os.MkdirAll(filepath.Join("attachments", "b1"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	for i, id := range []string{"00000001", "00000002"} {
+		fn, afn := "board"+id+".json", "attachments/b1/"+id+".txt"
+		if err := ioutil.WriteFile(fn, []byte(`{"id":"b1","run":"`+id+`"}`), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(filepath.FromSlash(afn), []byte("attachment "+id), 0644); err != nil {
+			t.Fatal(err)
+		}
+		now := time.Date(2020, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		if err := cat.PutSnapshot(catalogSnapshot{
+			ID:          id,
+			Run:         id,
+			Time:        now,
+			BoardID:     "b1",
+			File:        fn,
+			Attachments: []string{afn},
+		}, ""); err != nil {
+			t.Fatal(err)
+		}
+		m := &runManifest{
+			ID:       id,
+			Started:  now,
+			Finished: &now,
+			Complete: true,
+			Boards:   []runBoard{{ID: "b1", File: fn, Status: "done"}},
+		}
+		if err := m.save("."); err != nil {
+			t.Fatal(err)
+		}
+		if sfn, err := signRun(cat, m, key); err != nil {
+			t.Fatalf("sign run: %v", err)
+		} else if exp := filepath.Join(storeDir, "signatures", "00000"+id[7:]+".json"); sfn != exp {
+			t.Errorf("expected signature %s, got %s", exp, sfn)
+		}
+	}
+}
+
+func testKey(t *testing.T) (ed25519.PublicKey, ed25519.PrivateKey) {
+	pub, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return pub, key
+}
+
+func TestSignRun(t *testing.T) {
+	defer testCanonicalDir(t)()
+	pub, key := testKey(t)
+	testSignedRuns(t, key)
+
+	buf, err := ioutil.ReadFile(filepath.Join(storeDir, "signatures", "000002.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s runSignature
+	if err := json.Unmarshal(buf, &s); err != nil {
+		t.Fatal(err)
+	}
+	if s.Seq != 2 || s.Run != "00000002" || s.Previous == "" {
+		t.Errorf("expected the second signature to be chained to the first, got %+v", s)
+	}
+	if len(s.Snapshots) != 1 || s.Snapshots["board00000002.json"] == "" {
+		t.Errorf("expected the snapshot saved by the run to be signed, got %v", s.Snapshots)
+	}
+	if len(s.Files) != 1 || s.Files["attachments/b1/00000002.txt"] == "" {
+		t.Errorf("expected the attachment saved by the run to be signed, got %v", s.Files)
+	}
+
+	if n, failed, err := verifySignatures(pub); err != nil {
+		t.Fatalf("verify: %v", err)
+	} else if n != 2 || failed != 0 {
+		t.Errorf("expected 2 signatures to be verified, got %d (%d failed)", n, failed)
+	}
+	if missing, err := unsigned(); err != nil {
+		t.Fatalf("check unsigned: %v", err)
+	} else if len(missing) != 0 {
+		t.Errorf("expected all runs to be signed, got %v", missing)
+	}
+}
+
+func TestVerifySignaturesTampered(t *testing.T) {
+	for _, c := range []struct {
+		Name   string
+		Tamper func(t *testing.T)
+		Failed int // with the correct key
+	}{
+		{"Snapshot", func(t *testing.T) {
+			testWrite(t, "board00000001.json", `{"id":"b1","run":"changed"}`)
+		}, 1},
+		{"Attachment", func(t *testing.T) {
+			testWrite(t, "attachments/b1/00000002.txt", "changed")
+		}, 1},
+		{"AttachmentRemoved", func(t *testing.T) {
+			os.Remove(filepath.FromSlash("attachments/b1/00000001.txt"))
+		}, 1},
+		{"Manifest", func(t *testing.T) {
+			testWrite(t, filepath.Join(storeDir, "runs", "00000001.json"), `{"id":"00000001"}`)
+		}, 1},
+		{"SignatureRemoved", func(t *testing.T) {
+			os.Remove(filepath.Join(storeDir, "signatures", "000001.json"))
+		}, 1},
+		{"SignatureEdited", func(t *testing.T) {
+			// a statement for the tampered snapshot, but with the old signature
+			fn := filepath.Join(storeDir, "signatures", "000002.json")
+			var s runSignature
+			buf, err := ioutil.ReadFile(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := json.Unmarshal(buf, &s); err != nil {
+				t.Fatal(err)
+			}
+			testWrite(t, "board00000002.json", `{"id":"b1","run":"changed"}`)
+			s.Snapshots["board00000002.json"], _, _ = snapshotSHA256("board00000002.json")
+			buf, _ = json.Marshal(s)
+			testWrite(t, fn, string(buf))
+		}, 1},
+		{"Resigned", func(t *testing.T) {
+			// everything signed again with someone else's key
+			os.RemoveAll(filepath.Join(storeDir, "signatures"))
+			_, other := testKey(t)
+			testSignedRuns(t, other)
+		}, 2},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			defer testCanonicalDir(t)()
+			pub, key := testKey(t)
+			testSignedRuns(t, key)
+
+			c.Tamper(t)
+			if _, failed, err := verifySignatures(pub); err != nil {
+				t.Fatalf("verify: %v", err)
+			} else if failed != c.Failed {
+				t.Errorf("expected %d signatures to fail verification, got %d", c.Failed, failed)
+			}
+		})
+	}
+}
+
+func TestVerifySignaturesKey(t *testing.T) {
+	defer testCanonicalDir(t)()
+	_, key := testKey(t)
+	testSignedRuns(t, key)
+
+	other, _ := testKey(t)
+	if _, failed, err := verifySignatures(other); err != nil {
+		t.Fatalf("verify: %v", err)
+	} else if failed != 2 {
+		t.Errorf("expected all signatures to fail verification with another key, got %d", failed)
+	}
+
+	// the embedded key only detects changes by someone without the key
+	if _, failed, err := verifySignatures(nil); err != nil {
+		t.Fatalf("verify: %v", err)
+	} else if failed != 0 {
+		t.Errorf("expected all signatures to be verified with the embedded key, got %d failed", failed)
+	}
+}
+
+func TestVerifySignaturesUnsigned(t *testing.T) {
+	defer testCanonicalDir(t)()
+	_, key := testKey(t)
+	testSignedRuns(t, key)
+
+	// the latest signature is removed along with the run's files
+	os.Remove(filepath.Join(storeDir, "signatures", "000002.json"))
+	if missing, err := unsigned(); err != nil {
+		t.Fatalf("check unsigned: %v", err)
+	} else if len(missing) != 1 || missing[0] != "run 00000002" {
+		t.Errorf("expected the unsigned run to be found, got %v", missing)
+	}
+}
+
+func testWrite(t *testing.T, fn, s string) {
+	if err := ioutil.WriteFile(filepath.FromSlash(fn), []byte(s), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
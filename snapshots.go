@@ -0,0 +1,402 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// snapshot is a saved board export.
+type snapshot struct {
+	Path      string
+	Time      time.Time
+	Username  string
+	BoardID   string
+	BoardName string
+	RunID     string
+}
+
+// legacySnapshotNameRe matches the filenames used before name templates.
+var legacySnapshotNameRe = regexp.MustCompile(`^trello_([0-9]{4}-[0-9]{2}-[0-9]{2}_[0-9]{2}-[0-9]{2})_(.+)_([0-9a-f]{24})_(.*)\.json$`)
+
+// parseSnapshotName parses the metadata from a snapshot filename generated by
+// the first matching name template in res (see nameTemplateRegexp) or the
+// legacy format.
+func parseSnapshotName(res []*regexp.Regexp, fn string) (snapshot, bool) {
+	base := filepath.Base(fn)
+next:
+	for _, re := range res {
+		m := re.FindStringSubmatch(base)
+		if m == nil {
+			continue
+		}
+		s := snapshot{Path: fn}
+		for i, name := range re.SubexpNames() {
+			switch name {
+			case "time":
+				t, err := time.Parse(nameTimeFormat, m[i])
+				if err != nil {
+					continue next
+				}
+				s.Time = t
+			case "user":
+				s.Username = m[i]
+			case "board_id":
+				s.BoardID = m[i]
+			case "board_name":
+				s.BoardName = m[i]
+			case "run_id":
+				s.RunID = m[i]
+			}
+		}
+		if s.Time.IsZero() {
+			if fi, err := os.Stat(fn); err == nil {
+				s.Time = fi.ModTime()
+			} else if fi, err := os.Stat(fn + patchExt); err == nil {
+				s.Time = fi.ModTime()
+			}
+		}
+		return s, true
+	}
+	if m := legacySnapshotNameRe.FindStringSubmatch(base); m != nil {
+		t, err := time.ParseInLocation("2006-01-02_15-04", m[1], time.Local)
+		if err != nil {
+			return snapshot{}, false
+		}
+		return snapshot{
+			Path:      fn,
+			Time:      t,
+			Username:  m[2],
+			BoardID:   m[3],
+			BoardName: m[4],
+		}, true
+	}
+	return snapshot{}, false
+}
+
+// snapshotNameRegexps gets the regexps for parsing snapshot filenames in the
+// backup directory dir, for the current name template, then the old ones.
+func snapshotNameRegexps(dir string) ([]*regexp.Regexp, error) {
+	cfg, err := loadStoreConfig(dir)
+	if err != nil {
+		return nil, fmt.Errorf("load config: %w", err)
+	}
+	res := []*regexp.Regexp{nameTemplateRegexp(cfg.NameTemplate)}
+	for _, tmpl := range cfg.OldTemplates {
+		res = append(res, nameTemplateRegexp(tmpl))
+	}
+	return res, nil
+}
+
+// listSnapshots finds the snapshots in dir, oldest first.
+func listSnapshots(dir string) ([]snapshot, error) {
+	res, err := snapshotNameRegexps(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	fns, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	// snapshots stored as a delta
+	pfns, err := filepath.Glob(filepath.Join(dir, "*.json"+patchExt))
+	if err != nil {
+		return nil, err
+	}
+	for _, pfn := range pfns {
+		if fn := strings.TrimSuffix(pfn, patchExt); !exists(fn) {
+			fns = append(fns, fn)
+		}
+	}
+
+	var ss []snapshot
+	for _, fn := range fns {
+		if s, ok := parseSnapshotName(res, fn); ok {
+			ss = append(ss, s)
+		}
+	}
+	sort.SliceStable(ss, func(i, j int) bool {
+		return ss[i].Time.Before(ss[j].Time)
+	})
+	return ss, nil
+}
+
+// findPreviousSnapshot finds the most recent saved export of the board id in
+// dir. If there isn't one, an empty string is returned.
+func findPreviousSnapshot(dir, id string) (string, error) {
+	ss, err := listSnapshots(dir)
+	if err != nil {
+		return "", err
+	}
+	for i := len(ss) - 1; i >= 0; i-- {
+		if ss[i].BoardID == id {
+			return ss[i].Path, nil
+		}
+	}
+	return "", nil
+}
+
+// resolveSnapshot finds the snapshot for arg, which is either the path to a
+// snapshot, a snapshot ID from the catalog, or a board ID (for the latest
+// snapshot of it).
+func resolveSnapshot(dir, arg string) (string, error) {
+	if snapshotExists(arg) {
+		return arg, nil
+	}
+	if cs, err := catalogSnapshotByID(dir, arg); err != nil {
+		return "", err
+	} else if cs != nil {
+		return filepath.Join(dir, filepath.FromSlash(cs.File)), nil
+	}
+	if fn, err := findPreviousSnapshot(dir, arg); err != nil {
+		return "", err
+	} else if fn != "" {
+		return fn, nil
+	}
+	return "", fmt.Errorf("no snapshot file, snapshot, or board %q", arg)
+}
+
+func catalogSnapshotByID(dir, id string) (*catalogSnapshot, error) {
+	cat, err := openCatalog(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer cat.Close()
+	return cat.Snapshot(id)
+}
+
+// snapshotListing is a snapshot from the catalog, or a snapshot file which
+// isn't in it (with an empty ID).
+type snapshotListing struct {
+	catalogSnapshot
+	Status string
+}
+
+// listCatalogSnapshots lists the snapshots of the board id (or all boards if
+// empty) in the catalog for dir, along with any snapshot files which aren't
+// in it, oldest first.
+func listCatalogSnapshots(dir, id string) ([]snapshotListing, error) {
+	cat, err := openCatalog(dir, true)
+	if err != nil {
+		return nil, err
+	}
+	defer cat.Close()
+
+	cs, err := cat.Snapshots(id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ls []snapshotListing
+	seen := map[string]bool{}
+	for _, c := range cs {
+		status := "ok"
+		switch {
+		case c.Partial:
+			status = "partial"
+		case len(c.Anomalies) != 0:
+			status = "anomalies"
+		case c.Protected != "":
+			status = "protected"
+		}
+		ls = append(ls, snapshotListing{c, status})
+		seen[c.File] = true
+	}
+
+	ss, err := listSnapshots(dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range ss {
+		if rel, err := filepath.Rel(dir, s.Path); err == nil && seen[filepath.ToSlash(rel)] {
+			continue
+		}
+		if id != "" && s.BoardID != id {
+			continue
+		}
+		ls = append(ls, snapshotListing{catalogSnapshot{
+			Run:       s.RunID,
+			Time:      s.Time,
+			User:      s.Username,
+			BoardID:   s.BoardID,
+			BoardName: s.BoardName,
+			File:      filepath.ToSlash(s.Path),
+		}, "uncataloged"})
+	}
+
+	sort.SliceStable(ls, func(i, j int) bool {
+		return ls[i].Time.Before(ls[j].Time)
+	})
+	return ls, nil
+}
+
+func snapshotsListCommand(args []string) {
+	fs := flag.NewFlagSet("snapshots list", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	board := fs.String("board", "", "only list snapshots of the board with this ID")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup snapshots list [options]")
+		fmt.Fprintln(fs.Output(), "Note: Snapshot files which aren't in the catalog (e.g. from older versions) are listed without an ID.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	chdir(*dir)
+
+	ls, err := listCatalogSnapshots(".", *board)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, l := range ls {
+		fmt.Printf("%-8s  %s  %-24s  %-20s  %-11s  %s\n", orDash(l.ID), l.Time.UTC().Format(time.RFC3339), l.BoardID, l.User, l.Status, l.BoardName)
+	}
+}
+
+func snapshotsShowCommand(args []string) {
+	fs := flag.NewFlagSet("snapshots show", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup snapshots show [options] SNAPSHOT")
+		fmt.Fprintln(fs.Output(), "Note: SNAPSHOT can be a snapshot ID, a file, or a board ID (for the latest snapshot).")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	chdir(*dir)
+
+	cat, err := openCatalog(".", true)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cat.Close()
+
+	cs, err := cat.Snapshot(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+		os.Exit(1)
+	}
+	if cs == nil {
+		fn, err := resolveSnapshot(".", fs.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		if cs, err = cat.SnapshotFile(fn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+			os.Exit(1)
+		}
+		if cs == nil {
+			if cs, err = uncatalogedSnapshot(fn); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not read snapshot: %v\n", err)
+				os.Exit(1)
+			}
+		}
+	}
+
+	fmt.Printf("Snapshot:    %s\n", orDash(cs.ID))
+	fmt.Printf("Board:       %s (id: %s)\n", cs.BoardName, cs.BoardID)
+	fmt.Printf("Time:        %s\n", cs.Time.UTC().Format(time.RFC3339))
+	fmt.Printf("User:        %s\n", orDash(cs.User))
+	if cs.Run != "" {
+		if m, err := cat.Run(cs.Run); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+			os.Exit(1)
+		} else if m == nil {
+			fmt.Printf("Run:         %s\n", cs.Run)
+		} else if m.Imported {
+			fmt.Printf("Run:         %s (imported from legacy backups)\n", cs.Run)
+		} else if m.Stopped != "" {
+			fmt.Printf("Run:         %s (stopped early: %s)\n", cs.Run, m.Stopped)
+		} else if !m.Complete {
+			fmt.Printf("Run:         %s (incomplete)\n", cs.Run)
+		} else {
+			fmt.Printf("Run:         %s (complete)\n", cs.Run)
+		}
+	}
+	fmt.Printf("File:        %s\n", cs.File)
+	if !snapshotExists(filepath.FromSlash(cs.File)) {
+		fmt.Printf("             (missing)\n")
+	} else if st := snapshotStorage(filepath.FromSlash(cs.File)); st != "full" {
+		fmt.Printf("             (stored as a %s)\n", st)
+	}
+	if cs.ID == "" {
+		fmt.Printf("Status:      not in the catalog\n")
+	} else if cs.Partial {
+		fmt.Printf("Status:      partial (the run stopped before the attachments were saved)\n")
+	} else {
+		fmt.Printf("Status:      ok\n")
+	}
+	if cs.Protected != "" {
+		fmt.Printf("Protected:   %s\n", cs.Protected)
+	}
+	for _, a := range cs.Anomalies {
+		fmt.Printf("Anomaly:     %s\n", a)
+	}
+	if cs.Raw != "" {
+		fmt.Printf("Raw export:  %s\n", cs.Raw)
+	}
+	if cs.SHA256 != "" {
+		fmt.Printf("Size:        %d bytes\n", cs.Size)
+		fmt.Printf("SHA-256:     %s\n", cs.SHA256)
+	}
+	fmt.Print("Items:      ")
+	for _, k := range boardCollections {
+		fmt.Printf(" %s=%d", k, cs.Counts[k])
+	}
+	fmt.Println()
+	fmt.Printf("Attachments: %d\n", len(cs.Attachments))
+	for _, fn := range cs.Attachments {
+		if ca, err := cat.Attachment(fn); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not read catalog: %v\n", err)
+			os.Exit(1)
+		} else if ca != nil {
+			fmt.Printf("  %s (%d bytes, sha256 %s)\n", fn, ca.Size, ca.SHA256)
+		} else if exists(filepath.FromSlash(fn)) {
+			fmt.Printf("  %s (not in the catalog)\n", fn)
+		} else {
+			fmt.Printf("  %s (missing)\n", fn)
+		}
+	}
+}
+
+// uncatalogedSnapshot gets the information for a snapshot file which isn't in
+// the catalog.
+func uncatalogedSnapshot(fn string) (*catalogSnapshot, error) {
+	b, err := scanBoardFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	cs := &catalogSnapshot{
+		BoardID:   b.ID,
+		BoardName: b.Board.Name,
+		File:      filepath.ToSlash(fn),
+		Counts:    b.Counts,
+	}
+	if res, err := snapshotNameRegexps("."); err == nil {
+		if s, ok := parseSnapshotName(res, fn); ok {
+			cs.Time, cs.User, cs.Run = s.Time, s.Username, s.RunID
+		}
+	}
+	cs.Attachments = b.AttachmentFiles()
+	return cs, nil
+}
@@ -0,0 +1,387 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"os"
+	"strings"
+)
+
+// sqliteDB is a minimal read-only SQLite 3 reader. It only supports reading
+// rows from tables in UTF-8 databases, which is all that's needed for reading
+// browser cookies. Committed frames in the WAL are used if it exists.
+type sqliteDB struct {
+	buf      []byte
+	pageSize int
+	usable   int
+	wal      map[uint32][]byte
+}
+
+// openSQLite reads a SQLite database and its WAL into memory.
+func openSQLite(fn string) (*sqliteDB, error) {
+	buf, err := ioutil.ReadFile(fn)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) < 100 || !bytes.HasPrefix(buf, []byte("SQLite format 3\x00")) {
+		return nil, errors.New("not a sqlite database")
+	}
+
+	db := &sqliteDB{buf: buf}
+	if db.pageSize = int(binary.BigEndian.Uint16(buf[16:])); db.pageSize == 1 {
+		db.pageSize = 65536
+	}
+	if db.pageSize < 512 || db.pageSize&(db.pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid page size %d", db.pageSize)
+	}
+	if db.usable = db.pageSize - int(buf[20]); db.usable < 480 {
+		return nil, fmt.Errorf("invalid usable page size %d", db.usable)
+	}
+	if enc := binary.BigEndian.Uint32(buf[56:]); enc != 0 && enc != 1 {
+		return nil, errors.New("unsupported text encoding (only utf-8 is supported)")
+	}
+
+	if wal, err := ioutil.ReadFile(fn + "-wal"); err == nil {
+		if err := db.readWAL(wal); err != nil {
+			return nil, fmt.Errorf("read wal: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("read wal: %w", err)
+	}
+	return db, nil
+}
+
+// readWAL reads the pages from the committed frames in the WAL. Checksums are
+// not verified, but frames with a different salt are ignored.
+func (db *sqliteDB) readWAL(buf []byte) error {
+	if len(buf) < 32 {
+		return nil // empty
+	}
+	if m := binary.BigEndian.Uint32(buf); m&^1 != 0x377f0682 {
+		return errors.New("invalid magic")
+	}
+	if ps := int(binary.BigEndian.Uint32(buf[8:])); ps != db.pageSize {
+		return fmt.Errorf("page size %d does not match database", ps)
+	}
+	salt := buf[16:24]
+
+	pending := map[uint32][]byte{}
+	for off := 32; off+24+db.pageSize <= len(buf); off += 24 + db.pageSize {
+		fh := buf[off : off+24]
+		if !bytes.Equal(fh[8:16], salt) {
+			break
+		}
+		pending[binary.BigEndian.Uint32(fh)] = buf[off+24 : off+24+db.pageSize]
+		if binary.BigEndian.Uint32(fh[4:]) != 0 { // commit
+			if db.wal == nil {
+				db.wal = map[uint32][]byte{}
+			}
+			for pg, b := range pending {
+				db.wal[pg] = b
+			}
+			pending = map[uint32][]byte{}
+		}
+	}
+	return nil
+}
+
+func (db *sqliteDB) page(n uint32) ([]byte, error) {
+	if b, ok := db.wal[n]; ok {
+		return b, nil
+	}
+	off := int64(n-1) * int64(db.pageSize)
+	if n == 0 || off+int64(db.pageSize) > int64(len(db.buf)) {
+		return nil, fmt.Errorf("page %d out of range", n)
+	}
+	return db.buf[off : off+int64(db.pageSize)], nil
+}
+
+// Table calls fn for each row in the table. Columns missing from a row (i.e.
+// added later) are nil, and values are int64, float64, string, []byte or nil.
+func (db *sqliteDB) Table(name string, fn func(row map[string]interface{}) error) error {
+	var root uint32
+	var cols []string
+	if err := db.walk(1, map[uint32]bool{}, func(rec []interface{}) error {
+		if len(rec) >= 5 && rec[0] == "table" && strings.EqualFold(fmt.Sprint(rec[1]), name) {
+			if r, ok := rec[3].(int64); ok {
+				root = uint32(r)
+			}
+			if sql, ok := rec[4].(string); ok {
+				cols = sqliteColumns(sql)
+			}
+		}
+		return nil
+	}); err != nil {
+		return fmt.Errorf("read schema: %w", err)
+	}
+	if root == 0 {
+		return fmt.Errorf("no such table %q", name)
+	}
+	return db.walk(root, map[uint32]bool{}, func(rec []interface{}) error {
+		row := make(map[string]interface{}, len(cols))
+		for i, col := range cols {
+			if i < len(rec) {
+				row[col] = rec[i]
+			} else {
+				row[col] = nil
+			}
+		}
+		return fn(row)
+	})
+}
+
+// walk calls fn with the record for each row in the table b-tree at pg. The
+// pages already walked are added to seen, so a corrupt b-tree with a cycle is
+// detected.
+func (db *sqliteDB) walk(pg uint32, seen map[uint32]bool, fn func(rec []interface{}) error) error {
+	if seen[pg] {
+		return fmt.Errorf("page %d: referenced more than once (corrupt database?)", pg)
+	}
+	seen[pg] = true
+
+	p, err := db.page(pg)
+	if err != nil {
+		return err
+	}
+	h := p
+	if pg == 1 {
+		h = p[100:]
+	}
+	if len(h) < 12 {
+		return fmt.Errorf("page %d: truncated", pg)
+	}
+
+	n := int(binary.BigEndian.Uint16(h[3:]))
+	switch h[0] {
+	case 0x05: // interior table
+		if 12+n*2 > len(h) {
+			return fmt.Errorf("page %d: cell pointers out of range", pg)
+		}
+		for i := 0; i < n; i++ {
+			off := int(binary.BigEndian.Uint16(h[12+i*2:]))
+			if off+4 > len(p) {
+				return fmt.Errorf("page %d: cell out of range", pg)
+			}
+			if err := db.walk(binary.BigEndian.Uint32(p[off:]), seen, fn); err != nil {
+				return err
+			}
+		}
+		return db.walk(binary.BigEndian.Uint32(h[8:]), seen, fn)
+	case 0x0d: // leaf table
+		if 8+n*2 > len(h) {
+			return fmt.Errorf("page %d: cell pointers out of range", pg)
+		}
+		for i := 0; i < n; i++ {
+			off := int(binary.BigEndian.Uint16(h[8+i*2:]))
+			payload, err := db.cellPayload(p, off)
+			if err != nil {
+				return fmt.Errorf("page %d: %w", pg, err)
+			}
+			rec, err := sqliteRecord(payload)
+			if err != nil {
+				return fmt.Errorf("page %d: %w", pg, err)
+			}
+			if err := fn(rec); err != nil {
+				return err
+			}
+		}
+		return nil
+	default:
+		return fmt.Errorf("page %d: unexpected page type %#x", pg, h[0])
+	}
+}
+
+// cellPayload reads the payload of the table leaf cell at off in p, following
+// overflow pages as necessary.
+func (db *sqliteDB) cellPayload(p []byte, off int) ([]byte, error) {
+	if off >= len(p) {
+		return nil, errors.New("cell out of range")
+	}
+	size, n := sqliteVarint(p[off:])
+	if n == 0 || size < 0 {
+		return nil, errors.New("invalid cell size")
+	}
+	off += n
+	if _, n = sqliteVarint(p[off:]); n == 0 { // rowid
+		return nil, errors.New("invalid cell rowid")
+	}
+	off += n
+
+	u := db.usable
+	local := int(size)
+	if x := u - 35; local > x {
+		m := ((u-12)*32/255 - 23)
+		if local = m + (int(size)-m)%(u-4); local > x {
+			local = m
+		}
+	}
+	if off+local > len(p) {
+		return nil, errors.New("cell payload out of range")
+	}
+
+	payload := make([]byte, 0, local) // don't trust the size until the overflow pages are read
+	payload = append(payload, p[off:off+local]...)
+	if int64(local) == size {
+		return payload, nil
+	}
+	if off+local+4 > len(p) {
+		return nil, errors.New("cell overflow pointer out of range")
+	}
+
+	next := binary.BigEndian.Uint32(p[off+local:])
+	for i := 0; int64(len(payload)) < size; i++ {
+		if next == 0 || i > len(db.buf)/db.pageSize+len(db.wal) {
+			return nil, errors.New("overflow chain truncated")
+		}
+		op, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		rem := int(size) - len(payload)
+		if rem > u-4 {
+			rem = u - 4
+		}
+		payload = append(payload, op[4:4+rem]...)
+		next = binary.BigEndian.Uint32(op)
+	}
+	return payload, nil
+}
+
+// sqliteRecord decodes a record.
+func sqliteRecord(b []byte) ([]interface{}, error) {
+	hs, n := sqliteVarint(b)
+	if n == 0 || hs < int64(n) || hs > int64(len(b)) {
+		return nil, errors.New("invalid record header")
+	}
+
+	var rec []interface{}
+	hdr, body := b[n:hs], b[hs:]
+	for len(hdr) > 0 {
+		st, n := sqliteVarint(hdr)
+		if n == 0 {
+			return nil, errors.New("invalid record header")
+		}
+		hdr = hdr[n:]
+
+		var sz int
+		switch {
+		case st >= 1 && st <= 4:
+			sz = int(st)
+		case st == 5:
+			sz = 6
+		case st == 6, st == 7:
+			sz = 8
+		case st >= 12:
+			sz = int(st-12) / 2
+		}
+		if sz > len(body) {
+			return nil, errors.New("record value out of range")
+		}
+		v := body[:sz]
+		body = body[sz:]
+
+		switch {
+		case st == 0:
+			rec = append(rec, nil)
+		case st >= 1 && st <= 6:
+			var x int64
+			for _, c := range v {
+				x = x<<8 | int64(c)
+			}
+			if s := uint(64 - 8*sz); s != 0 {
+				x = x << s >> s // sign-extend
+			}
+			rec = append(rec, x)
+		case st == 7:
+			rec = append(rec, math.Float64frombits(binary.BigEndian.Uint64(v)))
+		case st == 8:
+			rec = append(rec, int64(0))
+		case st == 9:
+			rec = append(rec, int64(1))
+		case st >= 12 && st%2 == 0:
+			rec = append(rec, append([]byte(nil), v...))
+		case st >= 13:
+			rec = append(rec, string(v))
+		default:
+			return nil, fmt.Errorf("invalid serial type %d", st)
+		}
+	}
+	return rec, nil
+}
+
+// sqliteVarint decodes a varint, returning the number of bytes read (0 if b is
+// too short).
+func sqliteVarint(b []byte) (int64, int) {
+	var x uint64
+	for i := 0; i < 9; i++ {
+		if i >= len(b) {
+			return 0, 0
+		}
+		if i == 8 {
+			return int64(x<<8 | uint64(b[i])), 9
+		}
+		x = x<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return int64(x), i + 1
+		}
+	}
+	panic("unreachable")
+}
+
+// sqliteColumns gets the column names from a CREATE TABLE statement.
+func sqliteColumns(sql string) []string {
+	i, j := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if i == -1 || j < i {
+		return nil
+	}
+
+	var defs []string
+	var depth, start int
+	var quote byte
+	body := sql[i+1 : j]
+	for k := 0; k < len(body); k++ {
+		switch c := body[k]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'' || c == '`':
+			quote = c
+		case c == '[':
+			quote = ']'
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, body[start:k])
+			start = k + 1
+		}
+	}
+	defs = append(defs, body[start:])
+
+	var cols []string
+	for _, def := range defs {
+		def = strings.TrimSpace(def)
+		if def == "" {
+			continue
+		}
+		if q := strings.IndexByte("\"'`[", def[0]); q != -1 {
+			if i := strings.IndexByte(def[1:], "\"'`]"[q]); i != -1 {
+				cols = append(cols, def[1:i+1]) // quoted names can contain spaces
+				continue
+			}
+		}
+		f := strings.Fields(def)
+		switch strings.ToUpper(f[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			continue
+		}
+		cols = append(cols, strings.Trim(f[0], "\"'`[]"))
+	}
+	return cols
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The fixtures in testdata are generated by testdata/cookies.py.
+
+func TestSQLiteFirefox(t *testing.T) {
+	db, err := openSQLite(filepath.Join("testdata", "firefox.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	var token string
+	if err := db.Table("moz_cookies", func(row map[string]interface{}) error {
+		n++
+		if row["name"] == "token" && row["host"] == ".trello.com" {
+			token, _ = row["value"].(string)
+			if row["isHttpOnly"] != int64(1) || row["path"] != "/" || row["expiry"] != int64(1900000000) || row["lastAccessed"] != int64(1600000000000000) {
+				t.Errorf("unexpected row %v", row)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 102 {
+		t.Errorf("expected 102 rows, got %d", n)
+	}
+	if token != "firefox-token" {
+		t.Errorf("expected token %q, got %q", "firefox-token", token)
+	}
+
+	if err := db.Table("nope", func(map[string]interface{}) error { return nil }); err == nil || !strings.Contains(err.Error(), "no such table") {
+		t.Errorf("expected error for missing table, got %v", err)
+	}
+}
+
+func TestSQLiteChromium(t *testing.T) {
+	db, err := openSQLite(filepath.Join("testdata", "chromium.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n, added int
+	if err := db.Table("cookies", func(row map[string]interface{}) error {
+		n++
+		if _, ok := row["source_scheme"]; !ok {
+			t.Errorf("missing added column")
+		} else if row["source_scheme"] != nil {
+			added++
+		}
+		if row["host_key"] == "trello.com" && row["name"] == "token" {
+			if row["value"] != "chromium-token" || row["is_httponly"] != int64(1) || row["expires_utc"] != int64(13350000000000000) {
+				t.Errorf("unexpected token row %v", row)
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n != 101 {
+		t.Errorf("expected 101 rows, got %d", n)
+	}
+	if added != 69 {
+		t.Errorf("expected 69 rows written after the column was added, got %d", added)
+	}
+}
+
+func TestSQLiteWAL(t *testing.T) {
+	wal, err := ioutil.ReadFile(filepath.Join("testdata", "firefox-wal.sqlite-wal"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the end of each committed transaction
+	var commits []int
+	for off := 32; off+24+512 <= len(wal); off += 24 + 512 {
+		if binary.BigEndian.Uint32(wal[off+4:]) != 0 {
+			commits = append(commits, off+24+512)
+		}
+	}
+	if len(commits) < 2 {
+		t.Fatalf("expected multiple transactions in the wal")
+	}
+
+	for _, c := range []struct {
+		Name  string
+		WAL   []byte
+		Token string
+		Rows  int
+	}{
+		{"NoWAL", nil, "old-token", 21},
+		{"WAL", wal, "wal-token", 41},
+		{"Uncommitted", wal[:commits[len(commits)-1]-1], "wal-token", 40}, // the last transaction is incomplete
+		{"Garbage", append(append([]byte(nil), wal...), bytes.Repeat([]byte{0xFF}, 24+512)...), "wal-token", 41},
+		{"Empty", []byte{}, "old-token", 21},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			td, err := ioutil.TempDir("", "trellobackup")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(td)
+
+			fn := filepath.Join(td, "cookies.sqlite")
+			if err := copyFile(filepath.Join("testdata", "firefox-wal.sqlite"), fn); err != nil {
+				t.Fatal(err)
+			}
+			if c.WAL != nil {
+				if err := ioutil.WriteFile(fn+"-wal", c.WAL, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			db, err := openSQLite(fn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var n int
+			var token string
+			if err := db.Table("moz_cookies", func(row map[string]interface{}) error {
+				if n++; row["name"] == "token" {
+					token, _ = row["value"].(string)
+				}
+				return nil
+			}); err != nil {
+				t.Fatal(err)
+			}
+			if n != c.Rows {
+				t.Errorf("expected %d rows, got %d", c.Rows, n)
+			}
+			if token != c.Token {
+				t.Errorf("expected token %q, got %q", c.Token, token)
+			}
+		})
+	}
+}
+
+func TestSQLiteOverflow(t *testing.T) {
+	db, err := openSQLite(filepath.Join("testdata", "overflow.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sizes := []int{0, 100, 476, 477, 478, 1000, 5000, 20000}
+	var i int
+	if err := db.Table("t", func(row map[string]interface{}) error {
+		if i >= len(sizes) {
+			t.Fatalf("too many rows")
+		}
+		n := sizes[i]
+		if a, _ := row["a"].(string); a != strings.Repeat("x", n) {
+			t.Errorf("row %d: expected a to be %d bytes, got %d", i, n, len(a))
+		}
+		b, _ := row["b"].([]byte)
+		exp := make([]byte, n)
+		for j := range exp {
+			exp[j] = byte(j)
+		}
+		if !bytes.Equal(b, exp) {
+			t.Errorf("row %d: wrong blob value (%d bytes)", i, len(b))
+		}
+		if row["c"] != float64(i)+0.5 {
+			t.Errorf("row %d: expected c to be %v, got %v", i, float64(i)+0.5, row["c"])
+		}
+		if row["d"] != int64(-i*1000000007) {
+			t.Errorf("row %d: expected d to be %d, got %v", i, -i*1000000007, row["d"])
+		}
+		i++
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if i != len(sizes) {
+		t.Errorf("expected %d rows, got %d", len(sizes), i)
+	}
+}
+
+func TestSQLiteInvalid(t *testing.T) {
+	td, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(td)
+
+	buf, err := ioutil.ReadFile(filepath.Join("testdata", "overflow.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fn := filepath.Join(td, "db")
+	for _, c := range []struct {
+		Name string
+		Buf  []byte
+	}{
+		{"NotSQLite", []byte(strings.Repeat("not a database", 10))},
+		{"Truncated", buf[:len(buf)/4]},
+		{"UsableSize", append(append(append([]byte(nil), buf[:20]...), 0xff), buf[21:]...)},
+	} {
+		if err := ioutil.WriteFile(fn, c.Buf, 0644); err != nil {
+			t.Fatal(err)
+		}
+		db, err := openSQLite(fn)
+		if err == nil {
+			err = db.Table("t", func(map[string]interface{}) error { return nil })
+		}
+		if err == nil {
+			t.Errorf("%s: expected error", c.Name)
+		}
+	}
+}
+
+func TestSQLiteCorrupt(t *testing.T) {
+	db, err := openSQLite(filepath.Join("testdata", "firefox.sqlite"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ps := db.pageSize // pages 1 and 2 are interior pages, and 4 is a leaf
+
+	// the record header of the first cell on page 4
+	leaf := 3 * ps
+	rec := leaf + int(binary.BigEndian.Uint16(db.buf[leaf+8:]))
+	for i := 0; i < 2; i++ { // size, rowid
+		_, n := sqliteVarint(db.buf[rec:])
+		rec += n
+	}
+
+	for _, c := range []struct {
+		Name string
+		Off  int
+		Val  []byte
+		Err  string
+		Buf  []byte
+	}{
+		{Name: "InteriorCellCount", Off: ps + 3, Val: []byte{0xff, 0xff}, Err: "cell pointers out of range"},
+		{Name: "InteriorCellPointer", Off: ps + 12, Val: []byte{0xff, 0xff}, Err: "cell out of range"},
+		{Name: "InteriorCycle", Off: ps + 8, Val: []byte{0, 0, 0, 2}, Err: "referenced more than once"},
+		{Name: "InteriorChildRange", Off: ps + 8, Val: []byte{0xff, 0xff, 0xff, 0xff}, Err: "out of range"},
+		{Name: "LeafCellCount", Off: leaf + 3, Val: []byte{0xff, 0xff}, Err: "cell pointers out of range"},
+		{Name: "LeafCellPointer", Off: leaf + 8, Val: []byte{0xff, 0xff}, Err: "cell out of range"},
+		{Name: "LeafCellSize", Off: leaf + 8, Val: []byte{byte((ps - 2) >> 8), byte(ps - 2)}, Err: "invalid cell"},
+		{Name: "RecordHeaderShort", Off: rec, Val: []byte{0x00}, Err: "invalid record header"},
+		{Name: "PageTruncated", Buf: db.buf[:len(db.buf)-ps/2], Err: "out of range"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			x := *db
+			if c.Buf != nil {
+				x.buf = c.Buf
+			} else {
+				x.buf = append([]byte(nil), db.buf...)
+				copy(x.buf[c.Off:], c.Val)
+			}
+			if c.Name == "LeafCellSize" {
+				// a varint which runs off the end of the page
+				for i := ps - 2; i < ps; i++ {
+					x.buf[leaf+i] = 0xff
+				}
+			}
+			err := x.Table("moz_cookies", func(map[string]interface{}) error { return nil })
+			if err == nil || !strings.Contains(err.Error(), c.Err) {
+				t.Errorf("expected error %q, got %v", c.Err, err)
+			}
+		})
+	}
+
+	// no single corrupt byte in those pages should cause a panic
+	for _, v := range []byte{0x00, 0xff} {
+		x := *db
+		x.buf = append([]byte(nil), db.buf...)
+		for off := 100; off < 4*ps; off++ {
+			if off >= 2*ps && off < 3*ps {
+				continue
+			}
+			orig := x.buf[off]
+			x.buf[off] = v
+			func() {
+				defer func() {
+					if err := recover(); err != nil {
+						t.Errorf("offset %d set to %#x: panic: %v", off, v, err)
+					}
+				}()
+				x.Table("moz_cookies", func(map[string]interface{}) error { return nil })
+			}()
+			x.buf[off] = orig
+		}
+	}
+}
+
+func TestSQLiteColumns(t *testing.T) {
+	for sql, exp := range map[string]string{
+		`CREATE TABLE t (id INTEGER PRIMARY KEY, a TEXT)`:                                         "id a",
+		`CREATE TABLE "t"("a b" TEXT, [c] INT DEFAULT (1, 2), ` + "`d`" + ` BLOB, UNIQUE (a, c))`: "a b c d",
+		`CREATE TABLE t (a, b CHECK (b > 0), CONSTRAINT x PRIMARY KEY (a))`:                       "a b",
+	} {
+		if act := strings.Join(sqliteColumns(sql), " "); act != exp {
+			t.Errorf("%s: expected %q, got %q", sql, exp, act)
+		}
+	}
+}
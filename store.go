@@ -0,0 +1,115 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+// storeDir is the directory in the backup directory for trellobackup's own
+// files.
+const storeDir = ".trellobackup"
+
+// storeConfig is the configuration saved in a backup directory, so the other
+// commands can read what backup wrote.
+type storeConfig struct {
+	NameTemplate string        `json:"name_template,omitempty"`
+	OldTemplates []string      `json:"old_name_templates,omitempty"` // so snapshots named by them are still found
+	Anomalies    anomalyConfig `json:"anomaly_checks"`
+	Storage      string        `json:"storage,omitempty"`    // full (default) or delta
+	FullEvery    int           `json:"full_every,omitempty"` // how often to store a full snapshot in the delta mode
+	Format       string        `json:"format,omitempty"`     // raw (default) or canonical
+	Strip        bool          `json:"strip_volatile,omitempty"`
+	DropRaw      bool          `json:"drop_raw_deltas,omitempty"` // don't keep the raw export for snapshots stored as deltas
+}
+
+// loadStoreConfig loads the configuration for the backup directory dir. If
+// there isn't one, the defaults are returned.
+func loadStoreConfig(dir string) (*storeConfig, error) {
+	cfg := &storeConfig{
+		NameTemplate: defaultNameTemplate,
+		Anomalies:    defaultAnomalyConfig,
+		FullEvery:    defaultFullEvery,
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, storeDir, "config.json"))
+	if os.IsNotExist(err) {
+		return cfg, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(buf, cfg); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return cfg, nil
+}
+
+// SetNameTemplate changes the name template, remembering the old one.
+func (cfg *storeConfig) SetNameTemplate(tmpl string) error {
+	if err := checkNameTemplate(tmpl); err != nil {
+		return err
+	}
+	old := append([]string{cfg.NameTemplate}, cfg.OldTemplates...)
+	cfg.NameTemplate, cfg.OldTemplates = tmpl, nil
+	seen := map[string]bool{tmpl: true}
+	for _, t := range old {
+		if !seen[t] {
+			cfg.OldTemplates = append(cfg.OldTemplates, t)
+			seen[t] = true
+		}
+	}
+	return nil
+}
+
+// SetStorage changes the storage mode, if not empty, and the number of deltas
+// between full snapshots, if not zero.
+func (cfg *storeConfig) SetStorage(storage string, fullEvery int) error {
+	switch storage {
+	case "":
+	case "full", "delta":
+		cfg.Storage = storage
+	default:
+		return fmt.Errorf("unsupported storage mode %q", storage)
+	}
+	if fullEvery < 0 {
+		return fmt.Errorf("invalid number of deltas between full snapshots %d", fullEvery)
+	} else if fullEvery != 0 {
+		cfg.FullEvery = fullEvery
+	}
+	return nil
+}
+
+// SetFormat changes the format snapshots are saved in.
+func (cfg *storeConfig) SetFormat(format string) error {
+	switch format {
+	case "raw", "canonical":
+		cfg.Format = format
+	default:
+		return fmt.Errorf("unsupported format %q", format)
+	}
+	return nil
+}
+
+// check checks that the options can be used together.
+func (cfg *storeConfig) check() error {
+	if cfg.Storage == "delta" && cfg.Format != "canonical" {
+		return errors.New("the delta storage mode requires the canonical format (-format canonical), since snapshots are reconstructed from deltas pretty-printed")
+	}
+	return nil
+}
+
+// save writes the configuration for the backup directory dir.
+func (cfg *storeConfig) save(dir string) error {
+	buf, err := json.MarshalIndent(cfg, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Join(dir, storeDir), 0755); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(dir, storeDir, "config.json"), buf, 0644)
+}
@@ -0,0 +1,80 @@
+#!/usr/bin/env python3
+# Generates the cookie database fixtures for sqlite_test.go and cookies_test.go.
+# The page size is 512 bytes so the tables need interior and overflow pages.
+
+import os
+import shutil
+import sqlite3
+import tempfile
+
+here = os.path.dirname(os.path.abspath(__file__))
+tmp = tempfile.mkdtemp()
+
+
+def create(name, schema, wal=False):
+    fn = os.path.join(tmp, name)
+    con = sqlite3.connect(fn, isolation_level=None)
+    con.execute("PRAGMA page_size=512")
+    if wal:
+        con.execute("PRAGMA journal_mode=WAL")
+        con.execute("PRAGMA wal_autocheckpoint=0")
+    con.execute(schema)
+    return fn, con
+
+
+def save(fn, con, wal=False):
+    for ext in ["", "-wal"] if wal else [""]:
+        shutil.copyfile(fn + ext, os.path.join(here, os.path.basename(fn) + ext))
+    con.close()
+
+
+def filler(i):
+    return "example%d.com" % i, "cookie%d" % i, "value%d" % i * 3
+
+
+# firefox
+fn, con = create("firefox.sqlite", """CREATE TABLE moz_cookies (id INTEGER PRIMARY KEY, originAttributes TEXT NOT NULL DEFAULT '', name TEXT, value TEXT, host TEXT, path TEXT, expiry INTEGER, lastAccessed INTEGER, creationTime INTEGER, isSecure INTEGER, isHttpOnly INTEGER, inBrowserElement INTEGER DEFAULT 0, sameSite INTEGER DEFAULT 0, rawSameSite INTEGER DEFAULT 0, schemeMap INTEGER DEFAULT 0, CONSTRAINT moz_uniqueid UNIQUE (name, host, path, originAttributes))""")
+for i in range(100):
+    host, name, value = filler(i)
+    con.execute("INSERT INTO moz_cookies (name, value, host, path, expiry, lastAccessed, creationTime, isSecure, isHttpOnly) VALUES (?, ?, ?, '/', 1900000000, 1600000000000000, 1600000000000000, 1, 0)", (name, value, host))
+    if i == 50:
+        con.execute("INSERT INTO moz_cookies (name, value, host, path, expiry, lastAccessed, creationTime, isSecure, isHttpOnly) VALUES ('token', 'firefox-token', '.trello.com', '/', 1900000000, 1600000000000000, 1600000000000000, 1, 1)")
+        con.execute("INSERT INTO moz_cookies (name, value, host, path, expiry, lastAccessed, creationTime, isSecure, isHttpOnly) VALUES ('token', 'not-trello', 'nottrello.com', '/', 1900000000, 1600000000000000, 1600000000000000, 1, 1)")
+save(fn, con)
+
+# chromium (unencrypted), with a column added after some rows were written
+fn, con = create("chromium.sqlite", """CREATE TABLE cookies(creation_utc INTEGER NOT NULL,host_key TEXT NOT NULL,name TEXT NOT NULL,value TEXT NOT NULL,path TEXT NOT NULL,expires_utc INTEGER NOT NULL,is_secure INTEGER NOT NULL,is_httponly INTEGER NOT NULL,last_access_utc INTEGER NOT NULL,has_expires INTEGER NOT NULL DEFAULT 1,is_persistent INTEGER NOT NULL DEFAULT 1,priority INTEGER NOT NULL DEFAULT 1,encrypted_value BLOB DEFAULT '',samesite INTEGER NOT NULL DEFAULT -1,UNIQUE (host_key, name, path))""")
+for i in range(100):
+    host, name, value = filler(i)
+    con.execute("INSERT INTO cookies (creation_utc, host_key, name, value, path, expires_utc, is_secure, is_httponly, last_access_utc) VALUES (13250000000000000, ?, ?, ?, '/', 13350000000000000, 1, 0, 13250000000000000)", (host, name, value))
+    if i == 20:
+        con.execute("INSERT INTO cookies (creation_utc, host_key, name, value, path, expires_utc, is_secure, is_httponly, last_access_utc) VALUES (13250000000000000, 'trello.com', 'token', 'chromium-token', '/', 13350000000000000, 1, 1, 13250000000000000)")
+    if i == 30:
+        con.execute("ALTER TABLE cookies ADD COLUMN source_scheme INTEGER NOT NULL DEFAULT 0")
+save(fn, con)
+
+# chromium (encrypted)
+fn, con = create("chromium-encrypted.sqlite", """CREATE TABLE cookies(creation_utc INTEGER NOT NULL,host_key TEXT NOT NULL,name TEXT NOT NULL,value TEXT NOT NULL,path TEXT NOT NULL,expires_utc INTEGER NOT NULL,is_secure INTEGER NOT NULL,is_httponly INTEGER NOT NULL,last_access_utc INTEGER NOT NULL,has_expires INTEGER NOT NULL DEFAULT 1,is_persistent INTEGER NOT NULL DEFAULT 1,priority INTEGER NOT NULL DEFAULT 1,encrypted_value BLOB DEFAULT '',samesite INTEGER NOT NULL DEFAULT -1,UNIQUE (host_key, name, path))""")
+con.execute("INSERT INTO cookies (creation_utc, host_key, name, value, path, expires_utc, is_secure, is_httponly, last_access_utc, encrypted_value) VALUES (13250000000000000, '.trello.com', 'token', '', '/', 13350000000000000, 1, 1, 13250000000000000, X'763130DEADBEEF')")
+save(fn, con)
+
+# firefox, with the token changed in the WAL by a browser which is still open
+fn, con = create("firefox-wal.sqlite", """CREATE TABLE moz_cookies (id INTEGER PRIMARY KEY, originAttributes TEXT NOT NULL DEFAULT '', name TEXT, value TEXT, host TEXT, path TEXT, expiry INTEGER, lastAccessed INTEGER, creationTime INTEGER, isSecure INTEGER, isHttpOnly INTEGER, inBrowserElement INTEGER DEFAULT 0, sameSite INTEGER DEFAULT 0, rawSameSite INTEGER DEFAULT 0, schemeMap INTEGER DEFAULT 0, CONSTRAINT moz_uniqueid UNIQUE (name, host, path, originAttributes))""", wal=True)
+con.execute("INSERT INTO moz_cookies (name, value, host, path) VALUES ('token', 'old-token', 'trello.com', '/')")
+for i in range(20):
+    host, name, value = filler(i)
+    con.execute("INSERT INTO moz_cookies (name, value, host, path) VALUES (?, ?, ?, '/')", (name, value, host))
+con.execute("PRAGMA wal_checkpoint(TRUNCATE)")
+con.execute("UPDATE moz_cookies SET value = 'wal-token' WHERE name = 'token'")
+for i in range(20, 40):
+    host, name, value = filler(i)
+    con.execute("INSERT INTO moz_cookies (name, value, host, path) VALUES (?, ?, ?, '/')", (name, value, host))
+save(fn, con, wal=True)
+
+# values which overflow onto other pages
+fn, con = create("overflow.sqlite", """CREATE TABLE t (id INTEGER PRIMARY KEY, a TEXT, b BLOB, c REAL, d INTEGER)""")
+for i, n in enumerate([0, 100, 476, 477, 478, 1000, 5000, 20000]):
+    con.execute("INSERT INTO t (a, b, c, d) VALUES (?, ?, ?, ?)", ("x" * n, bytes(j % 256 for j in range(n)), i + 0.5, -i * 1000000007))
+save(fn, con)
+
+shutil.rmtree(tmp)
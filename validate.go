@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// boardCollections are the top-level arrays expected in a board export.
+var boardCollections = []string{"actions", "cards", "checklists", "labels", "lists", "members"}
+
+// validateBoardResponse checks that resp is a successful JSON response.
+func validateBoardResponse(resp *http.Response) error {
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response status %s", resp.Status)
+	}
+	if mt, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err != nil {
+		return fmt.Errorf("parse content type: %w", err)
+	} else if mt != "application/json" {
+		return fmt.Errorf("unexpected content type %q", mt)
+	}
+	return nil
+}
+
+// countCollections are the collections which are checked against the previous
+// snapshot by validateBoard. An export where nearly all of them are gone is
+// much more likely to be broken than a board where they were really deleted.
+// Smaller mass deletions are caught by the anomaly checks instead.
+var countCollections = []string{"cards", "lists"}
+
+// maxCountDrop is the percentage of the items in countCollections which can be
+// gone since the previous snapshot before an export is rejected.
+const maxCountDrop = 90
+
+// objectIDRe matches Trello object IDs. The board, card, and attachment IDs
+// are used in paths, so anything else must be rejected.
+var objectIDRe = regexp.MustCompile(`^[0-9a-f]{24}$`)
+
+// validateBoard checks that cur is an export of the board id. If prev (the
+// previous snapshot) is not nil, it also checks that no more than maxCountDrop
+// percent of the items in countCollections are gone.
+func validateBoard(cur boardSummary, id string, prev *boardSummary) error {
+	if cur.ID != id {
+		return fmt.Errorf("board id mismatch: requested %q, got %q", id, cur.ID)
+	}
+	if !objectIDRe.MatchString(cur.ID) {
+		return fmt.Errorf("invalid board id %q", cur.ID)
+	}
+	if len(cur.InvalidIDs) != 0 {
+		return fmt.Errorf("invalid %s", cur.InvalidIDs[0])
+	}
+	for _, k := range boardCollections {
+		if _, ok := cur.Counts[k]; !ok {
+			return fmt.Errorf("missing %s", k)
+		}
+	}
+	if prev == nil {
+		return nil
+	}
+	for _, k := range countCollections {
+		if p, c := prev.Counts[k], cur.Counts[k]; c < p && (p-c)*100/p >= maxCountDrop {
+			return fmt.Errorf("%s went from %d to %d since the previous snapshot", k, p, c)
+		}
+	}
+	return nil
+}
+
+type boardSummary struct {
+	ID         string
+	Counts     map[string]int // only for collections which are present
+	InvalidIDs []string       // descriptions of the card and attachment IDs which aren't object IDs
+}
+
+// quarantine moves a rejected export of the board (saved to tmp) under the
+// quarantine directory as fn alongside a file containing the reason.
+func quarantine(fn, tmp string, reason error) error {
+	if err := os.MkdirAll("quarantine", 0755); err != nil {
+		return err
+	}
+	qfn := filepath.Join("quarantine", filepath.Base(fn))
+	if err := os.Rename(tmp, qfn); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(qfn+".error.txt", []byte(reason.Error()+"\n"), 0644)
+}
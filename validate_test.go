@@ -0,0 +1,163 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidateBoardTraversal(t *testing.T) {
+	b, err := scanBoardFile("testdata/traversal.json")
+	if err != nil {
+		t.Fatalf("scan: %v", err)
+	}
+	if err := validateBoard(b.boardSummary, b.ID, nil); err == nil || !strings.Contains(err.Error(), "invalid card id") {
+		t.Errorf("expected invalid card id error, got %v", err)
+	}
+	if fns := b.AttachmentFiles(); len(fns) != 0 {
+		t.Errorf("expected no attachment paths, got %q", fns)
+	}
+
+	b.ID = "../5f0000000000000000000001"
+	if err := validateBoard(b.boardSummary, b.ID, nil); err == nil || !strings.Contains(err.Error(), "invalid board id") {
+		t.Errorf("expected invalid board id error, got %v", err)
+	}
+}
+
+func TestAttachmentPath(t *testing.T) {
+	const id = "5f0000000000000000000001"
+	a := boardAttachment{ID: id, Name: "../../file.txt"}
+
+	fn, sidecar, err := attachmentPath(id, id, a)
+	if err != nil {
+		t.Fatalf("attachment path: %v", err)
+	}
+	if exp := "attachments/" + id + "/" + id + "/" + id + "/.._.._file.txt"; filepath.ToSlash(fn) != exp {
+		t.Errorf("expected %s, got %s", exp, fn)
+	}
+	if exp := "attachments/" + id + "/" + id + "/" + id + ".json"; filepath.ToSlash(sidecar) != exp {
+		t.Errorf("expected %s, got %s", exp, sidecar)
+	}
+
+	for _, c := range []struct{ board, card, attachment string }{
+		{"../../tmp", id, id},
+		{id, "../../../../../tmp/pwn", id},
+		{id, id, `..\x`},
+		{id, id, ".."},
+		{id, "", id},
+	} {
+		if _, _, err := attachmentPath(c.board, c.card, boardAttachment{ID: c.attachment, Name: "a"}); err == nil {
+			t.Errorf("%q/%q/%q: expected error", c.board, c.card, c.attachment)
+		}
+	}
+}
+
+func TestValidateBoardResponse(t *testing.T) {
+	for _, c := range []struct {
+		Status      int
+		ContentType string
+		Err         string
+	}{
+		{http.StatusOK, "application/json; charset=utf-8", ""},
+		{http.StatusOK, "text/html; charset=utf-8", "unexpected content type"},
+		{http.StatusTooManyRequests, "application/json", "response status"},
+		{http.StatusOK, "", "parse content type"},
+	} {
+		resp := &http.Response{StatusCode: c.Status, Status: http.StatusText(c.Status), Header: http.Header{"Content-Type": {c.ContentType}}}
+		if err := validateBoardResponse(resp); c.Err == "" && err != nil {
+			t.Errorf("%d %q: unexpected error %v", c.Status, c.ContentType, err)
+		} else if c.Err != "" && (err == nil || !strings.Contains(err.Error(), c.Err)) {
+			t.Errorf("%d %q: expected error containing %q, got %v", c.Status, c.ContentType, c.Err, err)
+		}
+	}
+}
+
+func TestValidateBoard(t *testing.T) {
+	const id = "5f0000000000000000000001"
+	counts := func(cards, lists int) map[string]int {
+		return map[string]int{"actions": 0, "cards": cards, "checklists": 0, "labels": 0, "lists": lists, "members": 1}
+	}
+	prev := &boardSummary{ID: id, Counts: counts(100, 10)}
+	for _, c := range []struct {
+		Name string
+		Cur  boardSummary
+		Prev *boardSummary
+		Err  string
+	}{
+		{"Valid", boardSummary{ID: id, Counts: counts(100, 10)}, prev, ""},
+		{"NoPrevious", boardSummary{ID: id, Counts: counts(0, 0)}, nil, ""},
+		{"Mismatch", boardSummary{ID: "5f0000000000000000000002", Counts: counts(100, 10)}, prev, "board id mismatch"},
+		{"Missing", boardSummary{ID: id, Counts: map[string]int{"cards": 100}}, prev, "missing"},
+		{"Grew", boardSummary{ID: id, Counts: counts(200, 20)}, prev, ""},
+		{"SomeCardsRemoved", boardSummary{ID: id, Counts: counts(50, 10)}, prev, ""},
+		{"MostCardsRemoved", boardSummary{ID: id, Counts: counts(5, 10)}, prev, "cards went from 100 to 5"},
+		{"AllCardsRemoved", boardSummary{ID: id, Counts: counts(0, 10)}, prev, "cards went from 100 to 0"},
+		{"AllListsRemoved", boardSummary{ID: id, Counts: counts(100, 0)}, prev, "lists went from 10 to 0"},
+		{"PreviouslyEmpty", boardSummary{ID: id, Counts: counts(0, 0)}, &boardSummary{ID: id, Counts: counts(0, 0)}, ""},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			if err := validateBoard(c.Cur, id, c.Prev); c.Err == "" && err != nil {
+				t.Errorf("unexpected error %v", err)
+			} else if c.Err != "" && (err == nil || !strings.Contains(err.Error(), c.Err)) {
+				t.Errorf("expected error containing %q, got %v", c.Err, err)
+			}
+		})
+	}
+}
+
+func TestSaveBoardQuarantine(t *testing.T) {
+	dir, err := ioutil.TempDir("", "trellobackup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+
+	const id = "5f0000000000000000000001"
+	for _, c := range []struct {
+		Name    string
+		Body    string
+		Invalid error
+		Err     string
+	}{
+		{"HTML", "<html>rate limited</html>", nil, "decode json"},
+		{"Response", `{"id":"` + id + `"}`, errors.New("unexpected content type"), "unexpected content type"},
+		{"Collections", `{"id":"` + id + `","cards":[]}`, nil, "missing actions"},
+	} {
+		t.Run(c.Name, func(t *testing.T) {
+			fn := "board-" + c.Name + ".json"
+			_, err := saveBoard(strings.NewReader(c.Body), c.Invalid, id, fn, nil)
+			var ierr *invalidBoardError
+			if !errors.As(err, &ierr) || !strings.Contains(err.Error(), c.Err) {
+				t.Fatalf("expected invalid board error containing %q, got %v", c.Err, err)
+			}
+			if exists(fn) {
+				t.Errorf("expected the invalid export not to be saved")
+			}
+			if err := quarantine(fn, ierr.tmp, ierr.err); err != nil {
+				t.Fatalf("quarantine: %v", err)
+			}
+			if buf, err := ioutil.ReadFile(filepath.Join("quarantine", fn)); err != nil || string(buf) != c.Body {
+				t.Errorf("expected the export to be quarantined as-is, got %q (err: %v)", buf, err)
+			}
+			if buf, err := ioutil.ReadFile(filepath.Join("quarantine", fn+".error.txt")); err != nil || !strings.Contains(string(buf), c.Err) {
+				t.Errorf("expected the reason to be saved, got %q (err: %v)", buf, err)
+			}
+			if exists(ierr.tmp) {
+				t.Errorf("expected the temporary file to be moved")
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+func verifyCommand(args []string) {
+	fs := flag.NewFlagSet("verify", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	signatures := fs.Bool("signatures", false, "check the chain of run signatures and the files they cover instead")
+	publicKey := fs.String("public-key", "", "public key from keygen to check the signatures with")
+	trustEmbedded := fs.Bool("trust-embedded-key", false, "check the signatures with the key of the first signature if -public-key isn't specified (this doesn't prove they were made by your key)")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup verify [options] [SNAPSHOT...]")
+		fmt.Fprintln(fs.Output(), "       trellobackup verify -signatures [options]")
+		fmt.Fprintln(fs.Output(), "Note: SNAPSHOT can be a file or a board ID (for the latest snapshot). If none are specified, all snapshots are verified.")
+		fmt.Fprintln(fs.Output(), "Note: -signatures requires -public-key (with a copy kept outside the backup directory) or -trust-embedded-key.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if *signatures {
+		if fs.NArg() != 0 {
+			fs.Usage()
+			os.Exit(2)
+		}
+		if *publicKey == "" && !*trustEmbedded {
+			fmt.Fprintln(os.Stderr, "Error: -public-key is required to check that the signatures were made by your key (use -trust-embedded-key to check them with the key they contain)")
+			os.Exit(2)
+		}
+		chdir(*dir)
+		verifySignaturesCommand(*publicKey)
+		return
+	}
+
+	chdir(*dir)
+
+	var ss []snapshot
+	if fs.NArg() == 0 {
+		var err error
+		if ss, err = listSnapshots("."); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not list snapshots: %v\n", err)
+			os.Exit(1)
+		}
+	} else {
+		res, err := snapshotNameRegexps(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		for _, arg := range fs.Args() {
+			fn, err := resolveSnapshot(".", arg)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+				os.Exit(1)
+			}
+			s, ok := parseSnapshotName(res, fn)
+			if !ok {
+				s = snapshot{Path: fn}
+			}
+			ss = append(ss, s)
+		}
+	}
+
+	ac, err := loadAssetCache(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load asset cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	var failed int
+	for _, s := range ss {
+		if err := verifySnapshot(s, ac); err != nil {
+			fmt.Printf("FAIL %s: %v\n", s.Path, err)
+			failed++
+		} else {
+			fmt.Printf("OK   %s\n", s.Path)
+		}
+	}
+
+	if failed != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d of %d snapshots failed verification\n", failed, len(ss))
+		os.Exit(1)
+	}
+	fmt.Printf("Verified %d snapshots\n", len(ss))
+}
+
+func verifySignaturesCommand(publicKey string) {
+	var pub ed25519.PublicKey
+	if publicKey != "" {
+		var err error
+		if pub, err = parsePublicKey(publicKey); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	n, failed, err := verifySignatures(pub)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not check signatures: %v\n", err)
+		os.Exit(1)
+	}
+	if n == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no runs have been signed")
+		os.Exit(1)
+	}
+
+	missing, err := unsigned()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not check runs: %v\n", err)
+		os.Exit(1)
+	}
+	for _, x := range missing {
+		fmt.Printf("FAIL %s: saved since the first signed run, but not signed (or its signature was removed)\n", x)
+	}
+
+	if failed != 0 || len(missing) != 0 {
+		fmt.Fprintf(os.Stderr, "Error: %d of %d signatures failed verification, %d runs or snapshots aren't signed\n", failed, n, len(missing))
+		os.Exit(1)
+	}
+	if publicKey == "" {
+		fmt.Println("Warning: the signatures were checked with the key they contain, use -public-key to check that it's yours")
+	}
+	fmt.Printf("Verified %d signatures\n", n)
+
+	if fns, err := listSignatures("."); err == nil && len(fns) != 0 {
+		if sum, _, err := fileSHA256(fns[len(fns)-1]); err == nil {
+			fmt.Printf("Note: the latest signature is %s (sha256 %s), compare it with a copy kept elsewhere to check that none were removed from the end along with their runs and snapshots\n", filepath.Base(fns[len(fns)-1]), sum)
+		}
+	}
+}
+
+// verifySnapshot checks that a snapshot is a valid board export and that its
+// attachments and backgrounds have been downloaded and still match the MD5
+// they were downloaded with.
+func verifySnapshot(s snapshot, ac *assetCache) error {
+	b, err := scanBoardFile(s.Path)
+	if err != nil {
+		return err
+	}
+
+	id := s.BoardID
+	if id == "" {
+		id = b.ID
+	}
+	if err := validateBoard(b.boardSummary, id, nil); err != nil {
+		return err
+	}
+
+	var missing, corrupted []string
+	check := func(fn string) error {
+		if ok, err := ac.Check(fn); err != nil {
+			return err
+		} else if !ok {
+			corrupted = append(corrupted, fn)
+		}
+		return nil
+	}
+	for _, card := range b.Board.Cards {
+		for _, a := range card.Attachments {
+			if !a.IsUpload {
+				continue
+			}
+			fn, _, err := attachmentPath(b.ID, card.ID, a)
+			if err != nil {
+				return err
+			}
+			if exists(fn) {
+				if err := check(fn); err != nil {
+					return err
+				}
+			} else if lfn, ok := legacyAttachmentPath(a.URL); !ok || !exists(lfn) {
+				missing = append(missing, fn)
+			}
+		}
+	}
+	for _, au := range b.Backgrounds {
+		fn, err := assetPath("backgrounds", au)
+		if err != nil {
+			return fmt.Errorf("parse background url: %w", err)
+		}
+		if !exists(fn) {
+			missing = append(missing, fn)
+		} else if err := check(fn); err != nil {
+			return err
+		}
+	}
+	if len(missing) != 0 {
+		return fmt.Errorf("missing %d files: %s", len(missing), strings.Join(missing, ", "))
+	}
+	if len(corrupted) != 0 {
+		return fmt.Errorf("%d files don't match their md5: %s", len(corrupted), strings.Join(corrupted, ", "))
+	}
+	return nil
+}
+
+func exists(fn string) bool {
+	_, err := os.Stat(fn)
+	return err == nil
+}
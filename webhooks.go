@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// maxWebhookBody is the maximum size of a webhook request.
+const maxWebhookBody = 1 << 20
+
+func webhooksServeCommand(args []string) {
+	fs := flag.NewFlagSet("webhooks serve", flag.ExitOnError)
+	dir := fs.String("dir", "", "backup directory (default: current directory)")
+	listen := fs.String("listen", ":8080", "address to listen on")
+	callbackURL := fs.String("callback-url", "", "public URL Trello sends the webhooks to, which must reach the listener (required)")
+	secret := fs.String("secret", "", "API secret for the API key, used to verify webhooks (required) (can be a secret reference)")
+	boardsFlag := fs.String("boards", "", "comma-separated IDs or short links of the boards to watch (default: all open boards)")
+	debounce := fs.Duration("debounce", 2*time.Minute, "how long to wait after the last action on a board before backing it up")
+	maxDelay := fs.Duration("max-delay", 30*time.Minute, "maximum time to wait after the first action on a board before backing it up, even if there are more")
+	export := fs.String("export", "auto", "how to export boards (see backup -h)")
+	signingKey := fs.String("signing-key", "", "ed25519 key from keygen to sign each run with (can be a secret reference)")
+	var af authFlags
+	af.Register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup webhooks serve [options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+		af.PrintNotes(fs.Output())
+		fmt.Fprintln(fs.Output(), "Note: The API secret is shown below the API key at https://trello.com/app-key.")
+		fmt.Fprintln(fs.Output(), "Note: Every action received is added to .trellobackup/journal/BOARD_ID.jsonl.")
+		fmt.Fprintln(fs.Output(), "Note: The webhooks are deleted when the server is stopped with Ctrl+C or SIGTERM (after the current backup, if any).")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if !af.ValidArgs(fs.Args()) || *callbackURL == "" || *secret == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	switch *export {
+	case "auto", "json", "api":
+	default:
+		fmt.Fprintf(os.Stderr, "Error: unsupported export method %q\n", *export)
+		os.Exit(2)
+	}
+
+	cu, err := url.Parse(*callbackURL)
+	if err != nil || (cu.Scheme != "http" && cu.Scheme != "https") || cu.Host == "" {
+		fmt.Fprintf(os.Stderr, "Error: invalid callback url %q\n", *callbackURL)
+		os.Exit(2)
+	}
+
+	key, err := resolveSecret(*secret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not resolve secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	signer, err := resolveSigningKey(*signingKey)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load signing key: %v\n", err)
+		os.Exit(1)
+	}
+
+	auth, err := af.Authenticator(fs.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	chdir(*dir)
+
+	cfg, err := loadStoreConfig(".")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load config: %v\n", err)
+		os.Exit(1)
+	}
+	if err := cfg.check(); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	cat, err := openCatalog(".", false)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+	defer cat.Close()
+
+	// the asset cache is loaded again for each board, since other commands
+	// may have changed it while waiting for webhooks
+	if _, err := loadAssetCache("."); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not load asset cache: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := newClient(auth, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	username, err := getUsername(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get username: %v\n", err)
+		os.Exit(1)
+	}
+	fmt.Println("Logged in as", username)
+
+	fmt.Println("Getting boards")
+	boards, err := getBoards(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get boards: %v\n", err)
+		os.Exit(1)
+	}
+
+	watch := map[string]boardInfo{}
+	if *boardsFlag == "" {
+		for _, board := range boards {
+			if !board.Closed {
+				watch[board.ID] = board
+			}
+		}
+	} else {
+	selected:
+		for _, id := range strings.Split(*boardsFlag, ",") {
+			id = strings.TrimSpace(id)
+			for _, board := range boards {
+				if board.ID == id || board.ShortLink == id {
+					watch[board.ID] = board
+					continue selected
+				}
+			}
+			fmt.Fprintf(os.Stderr, "Error: no board %q\n", id)
+			os.Exit(1)
+		}
+	}
+	if len(watch) == 0 {
+		fmt.Fprintln(os.Stderr, "Error: no boards to watch")
+		os.Exit(1)
+	}
+
+	exports := make(chan string)
+	d := &debouncer{
+		Delay:    *debounce,
+		MaxDelay: *maxDelay,
+		Fire: func(id string) {
+			exports <- id
+		},
+	}
+
+	// Trello checks the callback URL when the webhook is created, so the
+	// server needs to be running first
+	l, err := net.Listen("tcp", *listen)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not listen: %v\n", err)
+		os.Exit(1)
+	}
+	srv := &http.Server{Handler: &webhookHandler{
+		CallbackURL: *callbackURL,
+		Secret:      key,
+		Boards:      watch,
+		Received: func(id string, e journalEntry) error {
+			if err := appendJournal(".", id, e); err != nil {
+				return err
+			}
+			d.Trigger(id)
+			return nil
+		},
+	}}
+	go func() {
+		if err := srv.Serve(l); err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "Error: could not serve: %v\n", err)
+			os.Exit(1)
+		}
+	}()
+	fmt.Printf("Listening on %s\n", l.Addr())
+
+	var hooks []string
+	for _, board := range watch {
+		fmt.Printf("Registering webhook for %s (%s) (id: %s)\n", board.Name, board.ShortLink, board.ID)
+		id, err := createWebhook(c, *callbackURL, board.ID)
+		if err != nil {
+			if strings.Contains(err.Error(), "already exists") {
+				fmt.Println("--> Already registered")
+				continue
+			}
+			fmt.Fprintf(os.Stderr, "Error: could not register webhook: %v\n", err)
+			deleteWebhooks(c, hooks)
+			os.Exit(1)
+		}
+		hooks = append(hooks, id)
+	}
+
+	// stop between runs, so they aren't cut off in the middle of writing
+	// the catalog
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+
+	fmt.Println("Waiting for webhooks")
+	for {
+		var id string
+		select {
+		case <-sig:
+			fmt.Println("Stopping")
+			srv.Close()
+			deleteWebhooks(c, hooks)
+			return
+		case id = <-exports:
+		}
+
+		ac, err := loadAssetCache(".")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not load asset cache: %v\n", err)
+			fmt.Println("The board will be backed up again after the next webhook")
+			continue
+		}
+
+		m := &runManifest{
+			ID:      newID(),
+			Started: time.Now(),
+		}
+		fmt.Println("Starting run", m.ID)
+
+		rc := *c
+		tt := newThrottleTransport(c.Transport, 0, 0)
+		rc.Transport = tt
+
+		r := &backupRun{
+			c:        &rc,
+			tt:       tt,
+			cat:      cat,
+			ac:       ac,
+			cfg:      cfg,
+			m:        m,
+			username: username,
+			export:   *export,
+			apiToken: isAPIToken(auth),
+		}
+		// a failed board is recorded rather than leaving the run incomplete,
+		// since it's only for one board and the next webhook will retry it
+		board := watch[id]
+		_, err = r.backupBoard(board)
+		if err != nil {
+			m.SetBoard(runBoard{ID: board.ID, Name: board.Name, Status: "failed"})
+			if err := cat.PutFailure(catalogFailure{
+				Time:      m.Started,
+				Run:       m.ID,
+				BoardID:   board.ID,
+				BoardName: board.Name,
+				Error:     err.Error(),
+			}); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not update catalog: %v\n", err)
+			}
+		}
+
+		finished := time.Now()
+		m.Finished = &finished
+		m.Complete = true
+		if err := r.checkpoint(); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			continue
+		}
+
+		if signer != nil {
+			if fn, err := signRun(cat, m, signer); err != nil {
+				fmt.Fprintf(os.Stderr, "Error: could not sign run: %v\n", err)
+			} else {
+				fmt.Printf("Signed run as %s\n", fn)
+			}
+		}
+
+		switch {
+		case err != nil:
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			fmt.Println("The board will be backed up again after the next webhook")
+		case r.failed != 0:
+			fmt.Fprintln(os.Stderr, "Error: board could not be backed up (see the quarantine directory)")
+		case r.alerted != 0:
+			fmt.Fprintln(os.Stderr, "Error: board had large changes since the previous snapshot (the previous snapshot has been protected)")
+		default:
+			fmt.Println("Successfully backed up board")
+		}
+	}
+}
+
+// webhookHandler receives webhooks from Trello.
+type webhookHandler struct {
+	CallbackURL string
+	Secret      string
+	Boards      map[string]boardInfo
+	Received    func(id string, e journalEntry) error
+}
+
+func (h *webhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodHead:
+		w.WriteHeader(http.StatusOK) // Trello checks the URL when creating a webhook
+		return
+	case http.MethodPost:
+	default:
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxWebhookBody))
+	if err != nil {
+		http.Error(w, "Request too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if !hmac.Equal([]byte(r.Header.Get("X-Trello-Webhook")), []byte(webhookSignature(h.Secret, buf, h.CallbackURL))) {
+		fmt.Fprintf(os.Stderr, "Warning: rejected webhook from %s with an invalid signature\n", r.RemoteAddr)
+		http.Error(w, "Invalid signature", http.StatusUnauthorized)
+		return
+	}
+
+	var obj struct {
+		Action json.RawMessage `json:"action"`
+		Model  struct {
+			ID string `json:"id"`
+		} `json:"model"`
+	}
+	if err := json.Unmarshal(buf, &obj); err != nil || len(obj.Action) == 0 {
+		http.Error(w, "Invalid payload", http.StatusBadRequest)
+		return
+	}
+
+	board, ok := h.Boards[obj.Model.ID]
+	if !ok {
+		w.WriteHeader(http.StatusOK) // not watched (anymore), so ignore it
+		return
+	}
+
+	var action struct {
+		Type string `json:"type"`
+	}
+	json.Unmarshal(obj.Action, &action)
+	fmt.Printf("Received %s on %s (%s) (id: %s)\n", action.Type, board.Name, board.ShortLink, board.ID)
+
+	if err := h.Received(board.ID, journalEntry{
+		Received: time.Now(),
+		Action:   obj.Action,
+	}); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not journal action: %v\n", err)
+		http.Error(w, "Internal server error", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// webhookSignature calculates the X-Trello-Webhook header for a webhook sent
+// to callbackURL.
+func webhookSignature(secret string, body []byte, callbackURL string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write(body)
+	mac.Write([]byte(callbackURL))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// createWebhook registers a webhook for the board id.
+func createWebhook(c *http.Client, callbackURL, id string) (string, error) {
+	var obj struct {
+		ID string `json:"id"`
+	}
+	if err := apiRequest(c, http.MethodPost, "webhooks", url.Values{
+		"callbackURL": {callbackURL},
+		"idModel":     {id},
+		"description": {"trellobackup"},
+	}, &obj); err != nil {
+		return "", err
+	}
+	return obj.ID, nil
+}
+
+// deleteWebhooks deletes the webhooks created by createWebhook, printing any
+// errors.
+func deleteWebhooks(c *http.Client, ids []string) {
+	for _, id := range ids {
+		fmt.Printf("Deleting webhook %s\n", id)
+		if err := apiRequest(c, http.MethodDelete, "webhooks/"+url.PathEscape(id), nil, nil); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not delete webhook: %v\n", err)
+		}
+	}
+}
+
+// debouncer calls Fire for an ID once Delay has passed without Trigger being
+// called for it again, or MaxDelay has passed since the first call.
+type debouncer struct {
+	Delay    time.Duration
+	MaxDelay time.Duration
+	Fire     func(id string)
+
+	mu      sync.Mutex
+	pending map[string]*debounced
+}
+
+type debounced struct {
+	first time.Time
+	timer *time.Timer
+}
+
+// Trigger schedules Fire to be called for id.
+func (d *debouncer) Trigger(id string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending == nil {
+		d.pending = map[string]*debounced{}
+	}
+
+	p, ok := d.pending[id]
+	if !ok {
+		p = &debounced{first: time.Now()}
+		d.pending[id] = p
+	} else if !p.timer.Stop() {
+		return // already firing
+	}
+
+	delay := d.Delay
+	if rem := d.MaxDelay - time.Since(p.first); rem < delay {
+		delay = rem
+	}
+	p.timer = time.AfterFunc(delay, func() {
+		d.mu.Lock()
+		delete(d.pending, id)
+		d.mu.Unlock()
+		d.Fire(id)
+	})
+}
+
+func webhooksTestCommand(args []string) {
+	fs := flag.NewFlagSet("webhooks test", flag.ExitOnError)
+	callbackURL := fs.String("callback-url", "http://127.0.0.1:8080/", "URL of the webhook server (must match the server's -callback-url)")
+	secret := fs.String("secret", "", "API secret to sign the webhooks with (required) (can be a secret reference)")
+	typ := fs.String("type", "updateCard", "action type")
+	data := fs.String("data", "{}", "action data as JSON (the board is added to it)")
+	n := fs.Int("n", 1, "number of webhooks to send")
+	badSignature := fs.Bool("bad-signature", false, "send an invalid signature")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup webhooks test [options] BOARD_ID")
+		fmt.Fprintln(fs.Output(), "Note: This sends signed webhooks like Trello does, for testing webhooks serve locally.")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if fs.NArg() != 1 || *secret == "" {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	key, err := resolveSecret(*secret)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not resolve secret: %v\n", err)
+		os.Exit(1)
+	}
+
+	var ad map[string]interface{}
+	if err := json.Unmarshal([]byte(*data), &ad); err != nil {
+		fmt.Fprintf(os.Stderr, "Error: invalid data: %v\n", err)
+		os.Exit(2)
+	}
+	ad["board"] = map[string]string{"id": fs.Arg(0)}
+
+	for i := 0; i < *n; i++ {
+		id := make([]byte, 12)
+		if _, err := rand.Read(id); err != nil {
+			panic(err)
+		}
+		buf, err := json.Marshal(map[string]interface{}{
+			"action": map[string]interface{}{
+				"id":   hex.EncodeToString(id),
+				"type": *typ,
+				"date": time.Now().UTC().Format("2006-01-02T15:04:05.000Z"),
+				"data": ad,
+			},
+			"model": map[string]string{"id": fs.Arg(0)},
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		sig := webhookSignature(key, buf, *callbackURL)
+		if *badSignature {
+			sig = webhookSignature(key+"x", buf, *callbackURL)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, *callbackURL, bytes.NewReader(buf))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Trello-Webhook", sig)
+
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: could not send webhook: %v\n", err)
+			os.Exit(1)
+		}
+		resp.Body.Close()
+		fmt.Printf("Sent %s: %s\n", *typ, resp.Status)
+	}
+}
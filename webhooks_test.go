@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookHandler(t *testing.T) {
+	const callbackURL, secret = "https://example.com/webhook", "secret"
+
+	var received []string
+	h := &webhookHandler{
+		CallbackURL: callbackURL,
+		Secret:      secret,
+		Boards:      map[string]boardInfo{"B1": {ID: "B1", Name: "Board"}},
+		Received: func(id string, e journalEntry) error {
+			var a struct{ ID string }
+			if err := json.Unmarshal(e.Action, &a); err != nil {
+				t.Errorf("invalid action %s: %v", e.Action, err)
+			}
+			received = append(received, id+"/"+a.ID)
+			return nil
+		},
+	}
+
+	post := func(board, action, sig string) int {
+		body := []byte(`{"action":{"id":"` + action + `","type":"updateCard"},"model":{"id":"` + board + `"}}`)
+		if sig == "" {
+			sig = webhookSignature(secret, body, callbackURL)
+		}
+		req := httptest.NewRequest(http.MethodPost, "/webhook", bytes.NewReader(body))
+		req.Header.Set("X-Trello-Webhook", sig)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	if code := post("B1", "a1", ""); code != http.StatusOK {
+		t.Errorf("signed webhook: got status %d", code)
+	}
+	if code := post("B1", "a2", webhookSignature("wrong", []byte("{}"), callbackURL)); code != http.StatusUnauthorized {
+		t.Errorf("badly signed webhook: got status %d", code)
+	}
+	if code := post("B1", "a3", "invalid"); code != http.StatusUnauthorized {
+		t.Errorf("invalid signature: got status %d", code)
+	}
+	if code := post("B2", "a4", ""); code != http.StatusOK {
+		t.Errorf("unwatched board: got status %d", code)
+	}
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest(http.MethodHead, "/webhook", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("head: got status %d", w.Code)
+	}
+
+	if len(received) != 1 || received[0] != "B1/a1" {
+		t.Errorf("expected only B1/a1 to be received, got %q", received)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	// base64(HMAC-SHA1(secret, body + callbackURL)), calculated separately
+	if sig := webhookSignature("secret", []byte("body"), "https://example.com/"); sig != "tDKiYHhn8y9tS3F/Q9Bp5rwW+wM=" {
+		t.Errorf("unexpected signature %q", sig)
+	}
+}
+
+func TestDebouncer(t *testing.T) {
+	var mu sync.Mutex
+	fired := map[string][]time.Time{}
+	d := &debouncer{
+		Delay:    50 * time.Millisecond,
+		MaxDelay: 200 * time.Millisecond,
+		Fire: func(id string) {
+			mu.Lock()
+			fired[id] = append(fired[id], time.Now())
+			mu.Unlock()
+		},
+	}
+
+	start := time.Now()
+
+	// a burst is fired once
+	for i := 0; i < 5; i++ {
+		d.Trigger("a")
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// continuous triggers are fired after MaxDelay
+	for i := 0; i < 15; i++ {
+		d.Trigger("b")
+		time.Sleep(25 * time.Millisecond)
+	}
+	time.Sleep(150 * time.Millisecond)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if n := len(fired["a"]); n != 1 {
+		t.Errorf("expected a to be fired once, got %d", n)
+	}
+	if n := len(fired["b"]); n < 2 {
+		t.Errorf("expected b to be fired at least twice because of MaxDelay, got %d", n)
+	} else if el := fired["b"][0].Sub(start); el > 400*time.Millisecond {
+		t.Errorf("expected b to be fired after about MaxDelay, got %s", el)
+	}
+}
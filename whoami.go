@@ -0,0 +1,186 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+func whoamiCommand(args []string) {
+	fs := flag.NewFlagSet("whoami", flag.ExitOnError)
+	var af authFlags
+	af.Register(fs)
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: trellobackup whoami [options] [TOKEN_COOKIE | USERNAME PASSWORD [TOTP_SECRET]]")
+		af.PrintNotes(fs.Output())
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	if !af.ValidArgs(fs.Args()) {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	auth, err := af.Authenticator(fs.Args(), os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	c, err := newClient(auth, os.Stdout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+		os.Exit(1)
+	}
+
+	member, err := getMember(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get member info: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println()
+	fmt.Printf("Username:   %s\n", member.Username)
+	fmt.Printf("Full name:  %s\n", member.FullName)
+	fmt.Printf("Member ID:  %s\n", member.ID)
+	fmt.Printf("Auth mode:  %s\n", authMode(auth))
+	if len(member.Organizations) == 0 {
+		fmt.Printf("Workspaces: (none)\n")
+	} else {
+		fmt.Printf("Workspaces:\n")
+		for _, org := range member.Organizations {
+			fmt.Printf("  %s (%s) (id: %s)\n", org.DisplayName, org.Name, org.ID)
+		}
+	}
+
+	a, ok := auth.(apiTokenAuth)
+	if !ok {
+		os.Exit(0)
+	}
+
+	token, err := getToken(c, a.Token)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get token info: %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("Token:\n")
+	fmt.Printf("  Application: %s\n", token.Identifier)
+	fmt.Printf("  Created:     %s\n", token.DateCreated.Local().Format(time.RFC1123))
+	if token.DateExpires == nil {
+		fmt.Printf("  Expires:     never\n")
+	} else {
+		fmt.Printf("  Expires:     %s\n", token.DateExpires.Local().Format(time.RFC1123))
+	}
+	fmt.Printf("  Permissions:\n")
+	for _, p := range token.Permissions {
+		var access []string
+		if p.Read {
+			access = append(access, "read")
+		}
+		if p.Write {
+			access = append(access, "write")
+		}
+		if len(access) == 0 {
+			access = append(access, "none")
+		}
+		fmt.Printf("    %s %s: %s\n", p.ModelType, p.IDModel, strings.Join(access, ", "))
+	}
+
+	boards, err := getBoards(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error: could not get boards: %v\n", err)
+		os.Exit(1)
+	}
+
+	var missing int
+	for _, board := range boards {
+		if !token.CanRead(board) {
+			fmt.Fprintf(os.Stderr, "Warning: token can't read board %s (%s) (id: %s)\n", board.Name, board.ShortLink, board.ID)
+			missing++
+		}
+	}
+	if missing != 0 {
+		fmt.Fprintf(os.Stderr, "Warning: %d of %d boards can't be backed up with this token\n", missing, len(boards))
+		os.Exit(1)
+	}
+	fmt.Printf("Token can read all %d boards\n", len(boards))
+}
+
+type memberInfo struct {
+	ID, Username, FullName string
+	Organizations          []struct {
+		ID, Name, DisplayName string
+	}
+}
+
+func getMember(c *http.Client) (*memberInfo, error) {
+	var obj memberInfo
+
+	resp, err := c.Get("https://trello.com/1/members/me?fields=id,username,fullName&organizations=all&organization_fields=name,displayName")
+	if err != nil {
+		return nil, fmt.Errorf("send api request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status %s", resp.Status)
+	} else if err = json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return &obj, nil
+}
+
+type tokenInfo struct {
+	ID, Identifier, IDMember string
+	DateCreated              time.Time
+	DateExpires              *time.Time
+	Permissions              []struct {
+		IDModel, ModelType string
+		Read, Write        bool
+	}
+}
+
+// CanRead checks if the token's permissions allow reading the board, either
+// directly or through its workspace.
+func (t *tokenInfo) CanRead(board boardInfo) bool {
+	for _, p := range t.Permissions {
+		if !p.Read {
+			continue
+		}
+		switch p.ModelType {
+		case "Board":
+			if p.IDModel == "*" || p.IDModel == board.ID {
+				return true
+			}
+		case "Organization":
+			if board.IDOrganization != "" && (p.IDModel == "*" || p.IDModel == board.IDOrganization) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func getToken(c *http.Client, token string) (*tokenInfo, error) {
+	var obj tokenInfo
+
+	resp, err := c.Get("https://trello.com/1/tokens/" + url.PathEscape(token))
+	if err != nil {
+		return nil, fmt.Errorf("send api request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("response status %s", resp.Status)
+	} else if err = json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, fmt.Errorf("decode json: %w", err)
+	}
+	return &obj, nil
+}